@@ -0,0 +1,138 @@
+package logtrics
+
+import (
+	"fmt"
+
+	"github.com/smitajit/logtrics/aggregate"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// LAPIAggregateWindow is the lua binding for aggregate.window(options) api call
+// It returns a window aggregating the values per group. When a window closes, the emit function is called
+// with the result of each group and the functions are recorded as gauges of the metrics api with the group as labels
+//
+//	local rpm = aggregate.window {
+//		name = "requests_per_customer",
+//		size = "1m",                              -- duration string or seconds
+//		slide = "10s",                            -- optional, sliding windows
+//		functions = { "count", "avg", "p99", "distinct" },
+//		emit = function(result) info("%s %d", result.group.customer, result.count) end,
+//		metrics = "customer.requests",            -- customer.requests.count {customer = "..."}
+//	}
+//	rpm.add({ customer = event.customer }, event.latency, event.user)
+func (s *Script) LAPIAggregateWindow(state *lua.LState) int {
+	table := state.CheckTable(1)
+	var (
+		opts    aggregate.Options
+		emit    *lua.LFunction
+		metrics string
+		err     error
+	)
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "name":
+			opts.Name = v.String()
+		case "size":
+			opts.Size, err = luaDuration(v)
+		case "slide":
+			opts.Slide, err = luaDuration(v)
+		case "lateness":
+			opts.Lateness, err = luaDuration(v)
+		case "maxgroups":
+			opts.MaxGroups = int(lua.LVAsNumber(v))
+		case "samples":
+			opts.Samples = int(lua.LVAsNumber(v))
+		case "functions":
+			t, ok := v.(*lua.LTable)
+			if !ok {
+				err = fmt.Errorf("invalid functions %s", v.String())
+				return
+			}
+			t.ForEach(func(_, f lua.LValue) {
+				opts.Functions = append(opts.Functions, f.String())
+			})
+		case "emit":
+			fn, ok := v.(*lua.LFunction)
+			if !ok {
+				err = fmt.Errorf("invalid emit function %s", v.String())
+				return
+			}
+			emit = fn
+		case "metrics":
+			metrics = v.String()
+		default:
+			err = fmt.Errorf("invalid key %s", k.String())
+		}
+	})
+	if err == nil && emit == nil && metrics == "" {
+		err = fmt.Errorf("emit or metrics is required")
+	}
+	if err != nil {
+		state.RaiseError("aggregate: %s", err.Error())
+	}
+
+	w, err := aggregate.NewWindow(opts, func(results []aggregate.Result) {
+		if metrics != "" {
+			s.record(metrics, results)
+		}
+		if emit != nil {
+			s.emit(emit, results)
+		}
+	}, s.logger)
+	if err != nil {
+		state.RaiseError("aggregate: %s", err.Error())
+	}
+	s.closers = append(s.closers, w.Close)
+
+	t := state.NewTable()
+	state.SetField(t, "add", state.NewFunction(func(state *lua.LState) int {
+		group := make(map[string]string)
+		if g := state.OptTable(1, nil); g != nil {
+			g.ForEach(func(k, v lua.LValue) {
+				group[k.String()] = v.String()
+			})
+		}
+		var distinct string
+		if v := state.Get(3); v != lua.LNil {
+			distinct = v.String()
+		}
+		w.Add(s.clock(), group, float64(state.OptNumber(2, 1)), distinct)
+		return 0
+	}))
+	state.Push(t)
+	return 1
+}
+
+// record records the results of the window as gauges of the metrics api
+func (s *Script) record(name string, results []aggregate.Result) {
+	for _, r := range results {
+		for f, v := range r.Values {
+			s.gauge(name+"."+f, r.Group, v)
+		}
+	}
+}
+
+// emit calls the lua function with the result table of each group of the window
+//
+//	{ group = { customer = "a" }, start = 1600000000, ["end"] = 1600000060, count = 12, avg = 0.25 }
+func (s *Script) emit(fn *lua.LFunction, results []aggregate.Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range results {
+		table := s.state.NewTable()
+		group := s.state.NewTable()
+		for k, v := range r.Group {
+			group.RawSetString(k, lua.LString(v))
+		}
+		table.RawSetString("group", group)
+		table.RawSetString("start", unixSeconds(r.Start))
+		table.RawSetString("end", unixSeconds(r.End))
+		for f, v := range r.Values {
+			table.RawSetString(f, lua.LNumber(v))
+		}
+		s.callback(fn, table)
+	}
+}
@@ -0,0 +1,435 @@
+// Package aggregate is responsible for the windowed aggregations of the values of the events
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultMaxGroups is the maximum number of groups of a window when Options.MaxGroups is not set
+	defaultMaxGroups = 10000
+	// defaultSamples is the number of values kept per group for the percentiles when Options.Samples is not set
+	defaultSamples = 1028
+	// tick is the interval of the checks of the closed windows
+	tick = time.Second
+)
+
+//nolint:gochecknoglobals
+var defaultFunctions = []string{"count", "sum", "min", "max", "avg"}
+
+type (
+	// Options are the options of a window
+	Options struct {
+		// Name is the name of the window, used for the logs and the metrics
+		Name string
+		// Size is the duration of the windows
+		Size time.Duration
+		// Slide is the interval between the starts of the sliding windows, tumbling windows if 0 or equal to the size
+		Slide time.Duration
+		// Functions are the aggregations computed. count, sum, min, max, avg, distinct and the percentiles
+		// e.g. p5, p50, p99, p100 and the nines p999, p9999
+		Functions []string
+		// Lateness is the delay of the event times after the end of a window before it is closed, to accept late events
+		Lateness time.Duration
+		// MaxGroups is the maximum number of groups of a window, the values of the other groups are dropped
+		MaxGroups int
+		// Samples is the number of values kept per group for the percentiles
+		Samples int
+	}
+
+	// Result is the aggregation of the values of a group in a window
+	Result struct {
+		Group  map[string]string
+		Start  time.Time
+		End    time.Time
+		Values map[string]float64
+	}
+
+	// Window aggregates the values per group in tumbling or sliding windows
+	// The values are aggregated in panes of the slide, a window is the merge of the panes of its size.
+	// A window is closed when the watermark, the latest time of the values added, passes its end and the lateness.
+	// When no value is added for the size and the lateness, the open windows are closed.
+	// The results are emitted per group
+	Window struct {
+		opts        Options
+		percentiles map[string]float64
+		distinct    bool
+		emit        func([]Result)
+		logger      zerolog.Logger
+
+		mu sync.Mutex
+		// panes are the aggregations per pane start time
+		panes map[int64]map[string]*pane
+		// closed is the end of the last closed window
+		closed time.Time
+		// watermark is the latest time of the values added, updated is the time it was last added
+		watermark time.Time
+		updated   time.Time
+		// dropped is the number of values dropped since the last warning
+		dropped int
+		done    chan struct{}
+		stopped chan struct{}
+	}
+
+	// pane is the aggregation of the values of a group in a pane
+	pane struct {
+		group    map[string]string
+		count    int64
+		sum      float64
+		min      float64
+		max      float64
+		samples  []float64
+		distinct map[string]struct{}
+	}
+)
+
+// NewWindow returns a new Window instance
+// It starts the thread which closes the windows, emit is called with the results of each closed window
+func NewWindow(opts Options, emit func([]Result), logger zerolog.Logger) (*Window, error) {
+	if opts.Size <= 0 {
+		return nil, fmt.Errorf("invalid window size %s", opts.Size)
+	}
+	if opts.Slide <= 0 {
+		opts.Slide = opts.Size
+	}
+	if opts.Slide > opts.Size || opts.Size%opts.Slide != 0 {
+		return nil, fmt.Errorf("invalid window slide %s, the size must be a multiple of the slide", opts.Slide)
+	}
+	if len(opts.Functions) == 0 {
+		opts.Functions = defaultFunctions
+	}
+	if opts.MaxGroups <= 0 {
+		opts.MaxGroups = defaultMaxGroups
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = defaultSamples
+	}
+	w := &Window{
+		opts:        opts,
+		percentiles: make(map[string]float64),
+		emit:        emit,
+		logger:      logger,
+		panes:       make(map[int64]map[string]*pane),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	for _, f := range opts.Functions {
+		switch {
+		case f == "count", f == "sum", f == "min", f == "max", f == "avg":
+		case f == "distinct":
+			w.distinct = true
+		case strings.HasPrefix(f, "p"):
+			p, err := parsePercentile(f[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid percentile %s: %s", f, err.Error())
+			}
+			w.percentiles[f] = p
+		default:
+			return nil, fmt.Errorf("invalid aggregation function %s", f)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Add adds the value of the group at the time. The distinct value is counted by the distinct function
+// The values of the closed windows are dropped
+func (w *Window) Add(t time.Time, group map[string]string, value float64, distinct string) {
+	key := groupKey(group)
+	start := t.Truncate(w.opts.Slide)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.After(w.watermark) {
+		w.watermark = t
+	}
+	w.updated = time.Now()
+	// the last window containing the pane is closed
+	if !start.Add(w.opts.Size).After(w.closed) {
+		w.drop("late value")
+		return
+	}
+	groups, ok := w.panes[start.UnixNano()]
+	if !ok {
+		groups = make(map[string]*pane)
+		w.panes[start.UnixNano()] = groups
+	}
+	p, ok := groups[key]
+	if !ok {
+		if len(groups) >= w.opts.MaxGroups {
+			w.drop("maximum number of groups reached")
+			return
+		}
+		p = &pane{group: group, min: value, max: value}
+		if w.distinct {
+			p.distinct = make(map[string]struct{})
+		}
+		groups[key] = p
+	}
+	p.add(value, distinct, len(w.percentiles) > 0, w.opts.Samples)
+}
+
+// Close closes the open windows and stops the window
+func (w *Window) Close() {
+	close(w.done)
+	<-w.stopped
+	w.close(time.Time{}, true)
+}
+
+// run closes the windows every tick until the window is closed
+func (w *Window) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			w.close(now, false)
+		}
+	}
+}
+
+// close emits the results of the windows ended before the watermark minus the lateness.
+// All the open windows are emitted if all is true or when no value is added since the size and the lateness before now
+func (w *Window) close(now time.Time, all bool) {
+	w.mu.Lock()
+	limit := w.watermark.Add(-w.opts.Lateness)
+	if !all && now.Sub(w.updated) > w.opts.Size+w.opts.Lateness {
+		all = true
+	}
+	var results []Result
+	for _, end := range w.ends() {
+		if !all && end.After(limit) {
+			break
+		}
+		results = append(results, w.merge(end)...)
+		w.closed = end
+	}
+	// the panes of the closed windows are not used by the next windows
+	for start := range w.panes {
+		if !time.Unix(0, start).Add(w.opts.Size).After(w.closed) {
+			delete(w.panes, start)
+		}
+	}
+	if w.dropped > 0 {
+		w.logger.Warn().Str("window", w.opts.Name).Int("values", w.dropped).Msg("aggregate: values dropped")
+		w.dropped = 0
+	}
+	w.mu.Unlock()
+	if len(results) > 0 {
+		w.emit(results)
+	}
+}
+
+// ends returns the sorted end times of the open windows containing at least a pane. The caller must hold the lock
+func (w *Window) ends() []time.Time {
+	seen := make(map[int64]struct{})
+	var ends []time.Time
+	for start := range w.panes {
+		for end := time.Unix(0, start).Add(w.opts.Slide); !end.After(time.Unix(0, start).Add(w.opts.Size)); end = end.Add(w.opts.Slide) {
+			if _, ok := seen[end.UnixNano()]; ok || !end.After(w.closed) {
+				continue
+			}
+			seen[end.UnixNano()] = struct{}{}
+			ends = append(ends, end)
+		}
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i].Before(ends[j]) })
+	return ends
+}
+
+// merge returns the results of the window ending at end, the merge of its panes per group. The caller must hold the lock
+func (w *Window) merge(end time.Time) []Result {
+	start := end.Add(-w.opts.Size)
+	merged := make(map[string]*pane)
+	var keys []string
+	for t := start; t.Before(end); t = t.Add(w.opts.Slide) {
+		for key, p := range w.panes[t.UnixNano()] {
+			m, ok := merged[key]
+			if !ok {
+				m = &pane{group: p.group, min: p.min, max: p.max}
+				if w.distinct {
+					m.distinct = make(map[string]struct{})
+				}
+				merged[key] = m
+				keys = append(keys, key)
+			}
+			m.merge(p, w.opts.Samples)
+		}
+	}
+	sort.Strings(keys)
+	results := make([]Result, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, Result{
+			Group:  merged[key].group,
+			Start:  start,
+			End:    end,
+			Values: w.values(merged[key]),
+		})
+	}
+	return results
+}
+
+// values returns the values of the functions of the pane
+func (w *Window) values(p *pane) map[string]float64 {
+	values := make(map[string]float64, len(w.opts.Functions))
+	if len(w.percentiles) > 0 {
+		sort.Float64s(p.samples)
+	}
+	for _, f := range w.opts.Functions {
+		switch f {
+		case "count":
+			values[f] = float64(p.count)
+		case "sum":
+			values[f] = p.sum
+		case "min":
+			values[f] = p.min
+		case "max":
+			values[f] = p.max
+		case "avg":
+			values[f] = p.sum / float64(p.count)
+		case "distinct":
+			values[f] = float64(len(p.distinct))
+		default:
+			values[f] = percentile(p.samples, w.percentiles[f])
+		}
+	}
+	return values
+}
+
+// drop records a dropped value. The caller must hold the lock
+func (w *Window) drop(reason string) {
+	if w.dropped == 0 {
+		w.logger.Debug().Str("window", w.opts.Name).Msgf("aggregate: %s, dropping value", reason)
+	}
+	w.dropped++
+}
+
+// add adds the value to the pane, the samples are kept with a uniform reservoir of the size
+func (p *pane) add(value float64, distinct string, sample bool, size int) {
+	p.count++
+	p.sum += value
+	if value < p.min {
+		p.min = value
+	}
+	if value > p.max {
+		p.max = value
+	}
+	if p.distinct != nil && distinct != "" {
+		p.distinct[distinct] = struct{}{}
+	}
+	if !sample {
+		return
+	}
+	if len(p.samples) < size {
+		p.samples = append(p.samples, value)
+	} else if i := rand.Int63n(p.count); i < int64(size) {
+		p.samples[i] = value
+	}
+}
+
+// merge merges the aggregation of the other pane
+// The samples are resampled to the size in proportion of the counts of the panes, so the values of a busy pane are not under-represented
+func (p *pane) merge(o *pane, size int) {
+	p.samples = mergeSamples(p.samples, p.count, o.samples, o.count, size)
+	p.count += o.count
+	p.sum += o.sum
+	if o.min < p.min {
+		p.min = o.min
+	}
+	if o.max > p.max {
+		p.max = o.max
+	}
+	for v := range o.distinct {
+		p.distinct[v] = struct{}{}
+	}
+}
+
+// mergeSamples returns up to size samples of both reservoirs, taken in proportion of the number of values they represent
+// The reservoirs holding all their values are concatenated when they fit
+func mergeSamples(a []float64, na int64, b []float64, nb int64, size int) []float64 {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a)+len(b) <= size && int64(len(a)) == na && int64(len(b)) == nb {
+		return append(a, b...)
+	}
+	ka := int(math.Round(float64(size) * float64(na) / float64(na+nb)))
+	if ka > len(a) {
+		ka = len(a)
+	}
+	kb := size - ka
+	if kb > len(b) {
+		kb = len(b)
+	}
+	merged := make([]float64, 0, ka+kb)
+	merged = append(merged, pick(a, ka)...)
+	return append(merged, pick(b, kb)...)
+}
+
+// pick returns n of the samples picked at random
+func pick(samples []float64, n int) []float64 {
+	if n >= len(samples) {
+		return samples
+	}
+	picked := make([]float64, n)
+	for i, j := range rand.Perm(len(samples))[:n] {
+		picked[i] = samples[j]
+	}
+	return picked
+}
+
+// parsePercentile returns the percentile in (0, 1] of the digits of the function.
+// One or two digits are a percent, e.g. 5 and 50, 100 is the maximum and the longer digits are the nines, e.g. 999 and 9999
+func parsePercentile(digits string) (float64, error) {
+	n, err := strconv.Atoi(digits)
+	switch {
+	case err != nil || n <= 0 || strings.HasPrefix(digits, "0") || strings.HasPrefix(digits, "+"):
+		return 0, fmt.Errorf("expected a number after p")
+	case len(digits) <= 2:
+		return float64(n) / 100, nil
+	case digits == "100":
+		return 1, nil
+	case strings.Trim(digits, "9") != "":
+		return 0, fmt.Errorf("expected a percent or nines e.g. p50, p999")
+	}
+	return strconv.ParseFloat("0."+digits, 64)
+}
+
+// percentile returns the value at the percentile p in [0, 1] of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)+1)
+	switch {
+	case pos < 1:
+		return sorted[0]
+	case pos >= float64(len(sorted)):
+		return sorted[len(sorted)-1]
+	}
+	lower := sorted[int(pos)-1]
+	upper := sorted[int(pos)]
+	return lower + (pos-math.Floor(pos))*(upper-lower)
+}
+
+// groupKey returns the key of the group, the pairs sorted by name
+func groupKey(group map[string]string) string {
+	pairs := make([]string, 0, len(group))
+	for k, v := range group {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
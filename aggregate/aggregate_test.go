@@ -0,0 +1,240 @@
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// value is a value added at the offset from the start of the test
+type value struct {
+	at       time.Duration
+	group    string
+	value    float64
+	distinct string
+}
+
+// result is an emitted result with the offsets of the window
+type result struct {
+	start, end time.Duration
+	group      string
+	values     map[string]float64
+}
+
+func TestWindowClose(t *testing.T) {
+	start := time.Unix(1600000000, 0).Truncate(time.Hour)
+	tests := []struct {
+		name string
+		opts Options
+		adds []value
+		// closed are the results of the windows closed by the watermark of the adds
+		closed []result
+		// late are added after the windows are closed by the watermark
+		late []value
+		// remaining are the results of the open windows closed on close
+		remaining []result
+	}{
+		{
+			name: "tumbling",
+			opts: Options{Size: time.Minute, Functions: []string{"count", "sum"}},
+			adds: []value{{at: 10 * time.Second, value: 1}, {at: 20 * time.Second, value: 3}, {at: 65 * time.Second, value: 5}},
+			closed: []result{
+				{start: 0, end: time.Minute, values: map[string]float64{"count": 2, "sum": 4}},
+			},
+			remaining: []result{
+				{start: time.Minute, end: 2 * time.Minute, values: map[string]float64{"count": 1, "sum": 5}},
+			},
+		},
+		{
+			name: "watermark on the end of the window",
+			opts: Options{Size: time.Minute, Functions: []string{"count"}},
+			adds: []value{{at: 10 * time.Second, value: 1}, {at: time.Minute, value: 1}},
+			closed: []result{
+				{start: 0, end: time.Minute, values: map[string]float64{"count": 1}},
+			},
+			remaining: []result{
+				{start: time.Minute, end: 2 * time.Minute, values: map[string]float64{"count": 1}},
+			},
+		},
+		{
+			name: "lateness",
+			opts: Options{Size: time.Minute, Lateness: 10 * time.Second, Functions: []string{"count"}},
+			adds: []value{{at: 10 * time.Second, value: 1}, {at: 65 * time.Second, value: 1}},
+			late: []value{{at: 50 * time.Second, value: 1}},
+			remaining: []result{
+				{start: 0, end: time.Minute, values: map[string]float64{"count": 2}},
+				{start: time.Minute, end: 2 * time.Minute, values: map[string]float64{"count": 1}},
+			},
+		},
+		{
+			name: "late values of the closed windows are dropped",
+			opts: Options{Size: time.Minute, Functions: []string{"count"}},
+			adds: []value{{at: 10 * time.Second, value: 1}, {at: 130 * time.Second, value: 1}},
+			closed: []result{
+				{start: 0, end: time.Minute, values: map[string]float64{"count": 1}},
+			},
+			late: []value{{at: 30 * time.Second, value: 1}, {at: 125 * time.Second, value: 1}},
+			remaining: []result{
+				{start: 2 * time.Minute, end: 3 * time.Minute, values: map[string]float64{"count": 2}},
+			},
+		},
+		{
+			name: "sliding",
+			opts: Options{Size: 2 * time.Minute, Slide: time.Minute, Functions: []string{"count", "sum"}},
+			adds: []value{{at: 30 * time.Second, value: 1}, {at: 90 * time.Second, value: 2}, {at: 150 * time.Second, value: 4}},
+			closed: []result{
+				{start: -time.Minute, end: time.Minute, values: map[string]float64{"count": 1, "sum": 1}},
+				{start: 0, end: 2 * time.Minute, values: map[string]float64{"count": 2, "sum": 3}},
+			},
+			remaining: []result{
+				{start: time.Minute, end: 3 * time.Minute, values: map[string]float64{"count": 2, "sum": 6}},
+				{start: 2 * time.Minute, end: 4 * time.Minute, values: map[string]float64{"count": 1, "sum": 4}},
+			},
+		},
+		{
+			name: "groups",
+			opts: Options{Size: time.Minute, Functions: []string{"count"}},
+			adds: []value{{at: 0, group: "b", value: 1}, {at: 0, group: "a", value: 1}, {at: time.Second, group: "b", value: 1}},
+			remaining: []result{
+				{start: 0, end: time.Minute, group: "a", values: map[string]float64{"count": 1}},
+				{start: 0, end: time.Minute, group: "b", values: map[string]float64{"count": 2}},
+			},
+		},
+		{
+			name: "maximum number of groups",
+			opts: Options{Size: time.Minute, MaxGroups: 1, Functions: []string{"count"}},
+			adds: []value{{at: 0, group: "b", value: 1}, {at: 0, group: "a", value: 1}, {at: time.Second, group: "b", value: 1}},
+			remaining: []result{
+				{start: 0, end: time.Minute, group: "b", values: map[string]float64{"count": 2}},
+			},
+		},
+		{
+			name: "functions",
+			opts: Options{Size: time.Minute, Functions: []string{"min", "max", "avg", "distinct", "p50", "p100"}},
+			adds: []value{
+				{at: 0, value: 4, distinct: "u1"}, {at: time.Second, value: 1, distinct: "u2"},
+				{at: 2 * time.Second, value: 3, distinct: "u1"}, {at: 3 * time.Second, value: 2},
+			},
+			remaining: []result{
+				{start: 0, end: time.Minute, values: map[string]float64{"min": 1, "max": 4, "avg": 2.5, "distinct": 2, "p50": 2.5, "p100": 4}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var emitted []result
+			w, err := NewWindow(tt.opts, func(results []Result) {
+				for _, r := range results {
+					emitted = append(emitted, result{
+						start:  r.Start.Sub(start),
+						end:    r.End.Sub(start),
+						group:  r.Group["g"],
+						values: r.Values,
+					})
+				}
+			}, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the windows are closed by the test instead of the ticker
+			close(w.done)
+			<-w.stopped
+
+			add := func(values []value) {
+				for _, v := range values {
+					group := map[string]string{}
+					if v.group != "" {
+						group["g"] = v.group
+					}
+					w.Add(start.Add(v.at), group, v.value, v.distinct)
+				}
+			}
+			add(tt.adds)
+			w.close(time.Now(), false)
+			if !reflect.DeepEqual(emitted, tt.closed) {
+				t.Fatalf("expected the closed windows %v, got %v", tt.closed, emitted)
+			}
+			emitted = nil
+			add(tt.late)
+			w.close(time.Time{}, true)
+			if !reflect.DeepEqual(emitted, tt.remaining) {
+				t.Fatalf("expected the remaining windows %v, got %v", tt.remaining, emitted)
+			}
+		})
+	}
+}
+
+func TestWindowCloseIdle(t *testing.T) {
+	var emitted []Result
+	w, err := NewWindow(Options{Size: time.Minute, Functions: []string{"count"}}, func(results []Result) {
+		emitted = append(emitted, results...)
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(w.done)
+	<-w.stopped
+
+	w.Add(time.Unix(1600000000, 0), map[string]string{}, 1, "")
+	w.close(time.Now(), false)
+	if len(emitted) != 0 {
+		t.Fatalf("expected the window to be open, got %v", emitted)
+	}
+	// no value is added for the size of the window
+	w.close(time.Now().Add(2*time.Minute), false)
+	if len(emitted) != 1 || emitted[0].Values["count"] != 1 {
+		t.Fatalf("expected the idle window to be closed, got %v", emitted)
+	}
+}
+
+func TestMergeSamples(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      []float64
+		na     int64
+		b      []float64
+		nb     int64
+		size   int
+		wantA  int
+		wantB  int
+		concat bool
+	}{
+		{name: "complete reservoirs fit", a: samples(1, 3), na: 3, b: samples(2, 4), nb: 4, size: 10, wantA: 3, wantB: 4, concat: true},
+		{name: "complete reservoirs over the size", a: samples(1, 6), na: 6, b: samples(2, 6), nb: 6, size: 10, wantA: 5, wantB: 5},
+		{name: "busy pane", a: samples(1, 10), na: 900, b: samples(2, 10), nb: 100, size: 10, wantA: 9, wantB: 1},
+		{name: "quiet pane", a: samples(1, 2), na: 2, b: samples(2, 10), nb: 1000, size: 10, wantA: 0, wantB: 10},
+		{name: "share capped by the samples", a: samples(1, 3), na: 3, b: samples(2, 10), nb: 7, size: 10, wantA: 3, wantB: 7},
+		{name: "empty", a: samples(1, 3), na: 3, size: 10, wantA: 3, concat: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeSamples(tt.a, tt.na, tt.b, tt.nb, tt.size)
+			var a, b int
+			for _, v := range merged {
+				switch v {
+				case 1:
+					a++
+				case 2:
+					b++
+				}
+			}
+			if a != tt.wantA || b != tt.wantB {
+				t.Fatalf("expected %d + %d samples, got %d + %d", tt.wantA, tt.wantB, a, b)
+			}
+			if tt.concat && !reflect.DeepEqual(merged, append(append([]float64{}, tt.a...), tt.b...)) {
+				t.Fatalf("expected the concatenation, got %v", merged)
+			}
+		})
+	}
+}
+
+// samples returns n samples of the value
+func samples(v float64, n int) []float64 {
+	s := make([]float64, n)
+	for i := range s {
+		s[i] = v
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package logtrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/smitajit/logtrics/alert"
+	"github.com/smitajit/logtrics/scheduler"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultAlertInterval is the default evaluation interval of the alert rules
+	defaultAlertInterval = 15 * time.Second
+)
+
+// LAPIAlertRule is the lua binding for alert.rule(options) api call
+// It returns an alert rule. The condition of a group is evaluated on each observation and every interval,
+// the alerts are sent to the Alertmanagers and the webhooks when they fire, every repeat interval and when they are resolved
+//
+//	local errors = alert.rule {
+//		name = "ServiceErrors",
+//		window = "5m",                  -- sliding window of the observations
+//		threshold = 50,                 -- fires if more than 50 observations in the window
+//		-- or condition = function(a) return a.count > 50 and a.labels.service ~= "batch" end,
+//		["for"] = "1m",                 -- the condition must be true for 1m before firing
+//		group_by = { "service" },       -- an alert per service
+//		repeat_interval = "4h",
+//		labels = { severity = "page" },
+//		annotations = { summary = "{{ .service }} logged {{ .count }} errors in 5m" },
+//		alertmanager = "http://127.0.0.1:9093",
+//		webhook = "https://hooks.example.com/T000",
+//	}
+//	errors.observe({ service = event.service })
+//	errors.state({ service = "api" }) -- inactive, pending or firing
+func (s *Script) LAPIAlertRule(state *lua.LState) int {
+	table := state.CheckTable(1)
+	opts := alert.Options{Labels: make(map[string]string), Annotations: make(map[string]string)}
+	interval := defaultAlertInterval
+	if c := s.conf.Alert; c != nil {
+		if c.Interval > 0 {
+			interval = time.Duration(c.Interval) * time.Second
+		}
+		opts.RepeatInterval = time.Duration(c.RepeatInterval) * time.Second
+	}
+	var (
+		threshold *float64
+		condition *lua.LFunction
+		err       error
+	)
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "name":
+			opts.Name = v.String()
+		case "window":
+			opts.Window, err = luaDuration(v)
+		case "for":
+			opts.For, err = luaDuration(v)
+		case "repeat_interval":
+			opts.RepeatInterval, err = luaDuration(v)
+		case "interval":
+			interval, err = luaDuration(v)
+		case "threshold":
+			n, ok := v.(lua.LNumber)
+			if !ok {
+				err = fmt.Errorf("invalid threshold %s", v.String())
+				return
+			}
+			t := float64(n)
+			threshold = &t
+		case "condition":
+			fn, ok := v.(*lua.LFunction)
+			if !ok {
+				err = fmt.Errorf("invalid condition function %s", v.String())
+				return
+			}
+			condition = fn
+		case "group_by":
+			opts.GroupBy, err = luaStrings(v)
+		case "labels":
+			err = luaMap(v, opts.Labels)
+		case "annotations":
+			err = luaMap(v, opts.Annotations)
+		case "alertmanager":
+			opts.Alertmanagers, err = luaStrings(v)
+		case "webhook":
+			opts.Webhooks, err = luaStrings(v)
+		case "maxgroups":
+			opts.MaxGroups = int(lua.LVAsNumber(v))
+		default:
+			err = fmt.Errorf("invalid key %s", k.String())
+		}
+	})
+	if err == nil && threshold == nil && condition == nil {
+		err = fmt.Errorf("threshold or condition is required")
+	}
+	if err == nil && len(opts.Alertmanagers) == 0 && len(opts.Webhooks) == 0 && s.conf.Alert != nil && s.conf.Alert.Alertmanager != "" {
+		opts.Alertmanagers = []string{s.conf.Alert.Alertmanager}
+	}
+	if err != nil {
+		state.RaiseError("alert: %s", err.Error())
+	}
+	rule, err := alert.NewRule(opts, s.notifier, s.logger)
+	if err != nil {
+		state.RaiseError("alert: %s", err.Error())
+	}
+	every, err := scheduler.Every(interval)
+	if err != nil {
+		state.RaiseError("alert: %s", err.Error())
+	}
+
+	// the condition is called with the lock of the script, by the handlers or the schedule
+	active := func(labels map[string]string, v alert.Values) bool {
+		if condition == nil {
+			return v.Count > *threshold
+		}
+		t := s.state.NewTable()
+		l := s.state.NewTable()
+		for k, v := range labels {
+			l.RawSetString(k, lua.LString(v))
+		}
+		t.RawSetString("labels", l)
+		t.RawSetString("count", lua.LNumber(v.Count))
+		t.RawSetString("sum", lua.LNumber(v.Sum))
+		t.RawSetString("last", lua.LNumber(v.Last))
+		p := lua.P{Fn: condition, NRet: 1, Protect: true}
+		if err := s.state.CallByParam(p, t); err != nil {
+			s.logger.Error().Err(err).Str("alert", opts.Name).Msg("alert condition error")
+			return false
+		}
+		ret := s.state.Get(-1)
+		s.state.Pop(1)
+		return lua.LVAsBool(ret)
+	}
+	s.start(every, func() {
+		rule.Evaluate(time.Now(), active)
+	})
+
+	t := state.NewTable()
+	state.SetField(t, "observe", state.NewFunction(func(state *lua.LState) int {
+		labels := make(map[string]string)
+		check(state, luaMap(state.Get(1), labels))
+		now := time.Now()
+		if key, ok := rule.Observe(now, labels, float64(state.OptNumber(2, 1))); ok {
+			rule.Evaluate(now, active, key)
+		}
+		return 0
+	}))
+	state.SetField(t, "state", state.NewFunction(func(state *lua.LState) int {
+		labels := make(map[string]string)
+		check(state, luaMap(state.Get(1), labels))
+		state.Push(lua.LString(rule.State(labels)))
+		return 1
+	}))
+	state.Push(t)
+	return 1
+}
+
+// luaMap adds the pairs of the lua table to the map, nil is an empty table
+func luaMap(v lua.LValue, m map[string]string) error {
+	if v == lua.LNil {
+		return nil
+	}
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("invalid table %s", v.String())
+	}
+	t.ForEach(func(k, v lua.LValue) {
+		m[k.String()] = v.String()
+	})
+	return nil
+}
@@ -0,0 +1,388 @@
+// Package alert is responsible for the alert rules of the scripts, their states and their notifications
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/notify"
+)
+
+const (
+	// Inactive is the state of the alerts whose condition is false
+	Inactive = "inactive"
+	// Pending is the state of the alerts whose condition is true for less than the for duration
+	Pending = "pending"
+	// Firing is the state of the alerts whose condition is true for the for duration
+	Firing = "firing"
+	// Resolved is the status of the notifications of the alerts no longer firing
+	Resolved = "resolved"
+
+	defaultWindow         = 5 * time.Minute
+	defaultRepeatInterval = 4 * time.Hour
+	defaultMaxGroups      = 1000
+	// buckets is the number of buckets of the sliding windows
+	buckets = 60
+	// alertmanagerPath is the path of the alerts of the Alertmanager v2 api
+	alertmanagerPath = "/api/v2/alerts"
+)
+
+type (
+	// Options are the options of a rule
+	Options struct {
+		Name string
+		// Window is the duration of the sliding window of the observed values
+		Window time.Duration
+		// For is the duration for which the condition must be true before the alert fires
+		For time.Duration
+		// RepeatInterval is the interval of the notifications of the firing alerts
+		RepeatInterval time.Duration
+		// GroupBy are the labels of the observations grouping the alerts, a single group of all the observations if empty
+		GroupBy []string
+		// Labels and Annotations are added to the alerts, the annotations are templates of the group labels and the values
+		Labels      map[string]string
+		Annotations map[string]string
+		// Alertmanagers are the urls of the Alertmanager compatible endpoints, Webhooks the urls of the webhooks
+		Alertmanagers []string
+		Webhooks      []string
+		// MaxGroups is the maximum number of groups, the observations of the other groups are dropped
+		MaxGroups int
+	}
+
+	// Values are the values of the observations of a group in the window
+	Values struct {
+		Count float64
+		Sum   float64
+		Last  float64
+	}
+
+	// Condition returns true if the alert of the group is active
+	Condition func(labels map[string]string, v Values) bool
+
+	// Rule tracks the alerts of the groups of the observations
+	// The condition of a group is evaluated on each observation and periodically. An alert is pending while the condition
+	// is true and fires after the for duration. The firing alerts are notified when they fire, every repeat interval and
+	// when they are resolved
+	Rule struct {
+		opts     Options
+		notifier *notify.Notifier
+		logger   zerolog.Logger
+
+		mu     sync.Mutex
+		groups map[string]*group
+	}
+
+	// Alert is a notified alert
+	Alert struct {
+		Status      string            `json:"status"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+		EndsAt      time.Time         `json:"endsAt"`
+	}
+
+	// group is the state of the alert of a group
+	group struct {
+		labels map[string]string
+		window *window
+		state  string
+		// since is the time since which the condition is true
+		since time.Time
+		// sent is the time of the last notification of the firing alert
+		sent time.Time
+		// annotations are the annotations of the last notification of the firing alert, kept for the resolved notification
+		annotations map[string]string
+	}
+
+	// window is a sliding window of the observed values in buckets
+	window struct {
+		width  int64
+		starts [buckets]int64
+		counts [buckets]float64
+		sums   [buckets]float64
+		last   float64
+		// lastAt is the bucket of the last value
+		lastAt int64
+	}
+)
+
+// NewRule returns a new Rule instance sending the notifications with the notifier
+func NewRule(opts Options, notifier *notify.Notifier, logger zerolog.Logger) (*Rule, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("alert name is required")
+	}
+	if len(opts.Alertmanagers) == 0 && len(opts.Webhooks) == 0 {
+		return nil, fmt.Errorf("alert %s has no alertmanager or webhook", opts.Name)
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultWindow
+	}
+	if opts.RepeatInterval <= 0 {
+		opts.RepeatInterval = defaultRepeatInterval
+	}
+	if opts.MaxGroups <= 0 {
+		opts.MaxGroups = defaultMaxGroups
+	}
+	r := &Rule{opts: opts, notifier: notifier, logger: logger, groups: make(map[string]*group)}
+	// the single group of the alert without grouping is evaluated without observations, e.g. to alert on the absence of logs
+	if len(opts.GroupBy) == 0 {
+		r.groups[""] = r.newGroup(map[string]string{})
+	}
+	return r, nil
+}
+
+// Observe adds the value to the window of the group of the labels and returns the key of the group,
+// false if the maximum number of groups is reached
+func (r *Rule) Observe(now time.Time, labels map[string]string, v float64) (string, bool) {
+	labels = r.group(labels)
+	key := groupKey(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.groups[key]
+	if !ok {
+		if len(r.groups) >= r.opts.MaxGroups {
+			r.logger.Warn().Str("alert", r.opts.Name).Msg("maximum number of alert groups reached, dropping the observation")
+			return "", false
+		}
+		g = r.newGroup(labels)
+		r.groups[key] = g
+	}
+	g.window.add(now, v)
+	return key, true
+}
+
+// Evaluate evaluates the condition of the groups of the keys, of all the groups if there is no key, and sends the notifications
+func (r *Rule) Evaluate(now time.Time, condition Condition, keys ...string) {
+	if len(keys) == 0 {
+		r.mu.Lock()
+		for k := range r.groups {
+			keys = append(keys, k)
+		}
+		r.mu.Unlock()
+		sort.Strings(keys)
+	}
+
+	var alerts []Alert
+	for _, k := range keys {
+		r.mu.Lock()
+		g, ok := r.groups[k]
+		var v Values
+		if ok {
+			v = g.window.values(now)
+		}
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+		// the condition is evaluated without the lock, it may observe values
+		active := condition(g.labels, v)
+		r.mu.Lock()
+		if a := r.transition(now, k, g, active, v); a != nil {
+			alerts = append(alerts, *a)
+		}
+		r.mu.Unlock()
+	}
+	if len(alerts) > 0 {
+		r.send(alerts)
+	}
+}
+
+// State returns the state of the alert of the group of the labels
+func (r *Rule) State(labels map[string]string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.groups[groupKey(r.group(labels))]; ok {
+		return g.state
+	}
+	return Inactive
+}
+
+// transition updates the state of the group and returns the alert to notify, if any. The caller must hold the lock
+func (r *Rule) transition(now time.Time, key string, g *group, active bool, v Values) *Alert {
+	switch {
+	case active && g.state == Inactive:
+		g.state, g.since = Pending, now
+		fallthrough
+	case active && g.state == Pending:
+		if now.Sub(g.since) < r.opts.For {
+			return nil
+		}
+		g.state, g.sent = Firing, now
+		r.logger.Info().Str("alert", r.opts.Name).Interface("labels", g.labels).Msg("alert firing")
+		return r.alert(g, Firing, now, v)
+	case active && g.state == Firing:
+		if now.Sub(g.sent) < r.opts.RepeatInterval {
+			return nil
+		}
+		g.sent = now
+		return r.alert(g, Firing, now, v)
+	case !active && g.state == Firing:
+		g.state = Inactive
+		r.logger.Info().Str("alert", r.opts.Name).Interface("labels", g.labels).Msg("alert resolved")
+		a := r.alert(g, Resolved, now, v)
+		r.forget(key, g, now)
+		return a
+	case !active:
+		g.state = Inactive
+		r.forget(key, g, now)
+	}
+	return nil
+}
+
+// forget removes the inactive group without observations in the window. The caller must hold the lock
+func (r *Rule) forget(key string, g *group, now time.Time) {
+	if key != "" && g.window.values(now).Count == 0 {
+		delete(r.groups, key)
+	}
+}
+
+// alert returns the alert of the group. The firing alerts end after 3 repeat intervals
+// so that Alertmanager resolves them if logtrics stops, the resolved alerts have the annotations of the last firing alert
+func (r *Rule) alert(g *group, status string, now time.Time, v Values) *Alert {
+	a := &Alert{
+		Status:      status,
+		Labels:      map[string]string{"alertname": r.opts.Name},
+		Annotations: make(map[string]string, len(r.opts.Annotations)),
+		StartsAt:    g.since,
+		EndsAt:      now,
+	}
+	if status == Firing {
+		a.EndsAt = now.Add(3 * r.opts.RepeatInterval)
+	}
+	for k, v := range r.opts.Labels {
+		a.Labels[k] = v
+	}
+	data := map[string]interface{}{"count": v.Count, "sum": v.Sum, "last": v.Last, "name": r.opts.Name}
+	for k, v := range g.labels {
+		a.Labels[k] = v
+		data[k] = v
+	}
+	if status == Resolved && g.annotations != nil {
+		a.Annotations = g.annotations
+		return a
+	}
+	for k, text := range r.opts.Annotations {
+		b, err := r.notifier.Render(text, data)
+		if err != nil {
+			r.logger.Error().Err(err).Str("alert", r.opts.Name).Str("annotation", k).Msg("failed to render the annotation")
+			b = []byte(text)
+		}
+		a.Annotations[k] = string(b)
+	}
+	g.annotations = a.Annotations
+	return a
+}
+
+// send sends the alerts to the Alertmanagers and the webhooks
+// The webhooks receive a notification per status in the Alertmanager webhook format
+func (r *Rule) send(alerts []Alert) {
+	if len(r.opts.Alertmanagers) > 0 {
+		b, err := json.Marshal(alerts)
+		if err != nil {
+			r.logger.Error().Err(err).Str("alert", r.opts.Name).Msg("failed to encode the alerts")
+			return
+		}
+		for _, u := range r.opts.Alertmanagers {
+			r.notifier.Send(&notify.Request{URL: alertmanagerURL(u), Body: b})
+		}
+	}
+	if len(r.opts.Webhooks) == 0 {
+		return
+	}
+	for _, status := range []string{Firing, Resolved} {
+		var selected []Alert
+		for _, a := range alerts {
+			if a.Status == status {
+				selected = append(selected, a)
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+		b, err := json.Marshal(map[string]interface{}{"version": "4", "status": status, "alerts": selected})
+		if err != nil {
+			r.logger.Error().Err(err).Str("alert", r.opts.Name).Msg("failed to encode the alerts")
+			return
+		}
+		for _, u := range r.opts.Webhooks {
+			r.notifier.Send(&notify.Request{URL: u, Body: b})
+		}
+	}
+}
+
+// group returns the labels grouping the observations, no label without grouping
+func (r *Rule) group(labels map[string]string) map[string]string {
+	if len(r.opts.GroupBy) == 0 {
+		return map[string]string{}
+	}
+	group := make(map[string]string, len(r.opts.GroupBy))
+	for _, k := range r.opts.GroupBy {
+		group[k] = labels[k]
+	}
+	return group
+}
+
+func (r *Rule) newGroup(labels map[string]string) *group {
+	width := int64(r.opts.Window) / buckets
+	if width == 0 {
+		width = 1
+	}
+	return &group{labels: labels, state: Inactive, window: &window{width: width}}
+}
+
+// add adds the value in the bucket of the time
+func (w *window) add(now time.Time, v float64) {
+	i := now.UnixNano() / w.width
+	slot := i % buckets
+	if w.starts[slot] != i {
+		w.starts[slot], w.counts[slot], w.sums[slot] = i, 0, 0
+	}
+	w.counts[slot]++
+	w.sums[slot] += v
+	w.last, w.lastAt = v, i
+}
+
+// values returns the values of the buckets in the window ending at the time, the last value is 0 once its bucket left the window
+func (w *window) values(now time.Time) Values {
+	current := now.UnixNano() / w.width
+	var v Values
+	if w.inside(w.lastAt, current) {
+		v.Last = w.last
+	}
+	for slot := range w.starts {
+		if w.inside(w.starts[slot], current) {
+			v.Count += w.counts[slot]
+			v.Sum += w.sums[slot]
+		}
+	}
+	return v
+}
+
+// inside returns true if the bucket is in the window ending at the current bucket
+func (w *window) inside(bucket, current int64) bool {
+	return bucket > current-buckets && bucket <= current
+}
+
+// alertmanagerURL returns the url of the alerts api of the Alertmanager
+func alertmanagerURL(u string) string {
+	u = strings.TrimSuffix(u, "/")
+	if strings.HasSuffix(u, alertmanagerPath) {
+		return u
+	}
+	return u + alertmanagerPath
+}
+
+// groupKey returns the key of the group, the pairs sorted by name
+func groupKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,218 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/notify"
+)
+
+// step observes the values at the offset from the start, evaluates the rule and expects the state
+type step struct {
+	at     time.Duration
+	values []float64
+	state  string
+}
+
+func TestRuleTransitions(t *testing.T) {
+	threshold := func(labels map[string]string, v Values) bool { return v.Count > 2 }
+	tests := []struct {
+		name      string
+		opts      Options
+		condition Condition
+		steps     []step
+		// notified are the statuses of the webhook notifications in order
+		notified []string
+	}{
+		{
+			name:      "pending then firing then resolved",
+			opts:      Options{Window: time.Minute, For: 30 * time.Second},
+			condition: threshold,
+			steps: []step{
+				{at: 0, values: []float64{1, 1, 1}, state: Pending},
+				{at: 20 * time.Second, state: Pending},
+				{at: 40 * time.Second, state: Firing},
+				{at: 2 * time.Minute, state: Inactive},
+			},
+			notified: []string{Firing, Resolved},
+		},
+		{
+			name:      "pending not firing",
+			opts:      Options{Window: time.Minute, For: 30 * time.Second},
+			condition: threshold,
+			steps: []step{
+				{at: 0, values: []float64{1, 1, 1}, state: Pending},
+				{at: 70 * time.Second, state: Inactive},
+			},
+		},
+		{
+			name:      "firing without for",
+			opts:      Options{Window: time.Minute},
+			condition: threshold,
+			steps: []step{
+				{at: 0, values: []float64{1}, state: Inactive},
+				{at: time.Second, values: []float64{1, 1}, state: Firing},
+				{at: 61 * time.Second, state: Inactive},
+			},
+			notified: []string{Firing, Resolved},
+		},
+		{
+			name:      "repeat interval",
+			opts:      Options{Window: time.Hour, RepeatInterval: time.Minute},
+			condition: threshold,
+			steps: []step{
+				{at: 0, values: []float64{1, 1, 1}, state: Firing},
+				{at: 30 * time.Second, state: Firing},
+				{at: 90 * time.Second, state: Firing},
+			},
+			notified: []string{Firing, Firing},
+		},
+		{
+			name:      "sum",
+			opts:      Options{Window: time.Minute},
+			condition: func(labels map[string]string, v Values) bool { return v.Sum >= 10 },
+			steps: []step{
+				{at: 0, values: []float64{4, 5}, state: Inactive},
+				{at: time.Second, values: []float64{1}, state: Firing},
+			},
+			notified: []string{Firing},
+		},
+		{
+			name:      "last in the window",
+			opts:      Options{Window: time.Minute},
+			condition: func(labels map[string]string, v Values) bool { return v.Last > 5 },
+			steps: []step{
+				{at: 0, values: []float64{9}, state: Firing},
+				{at: 30 * time.Second, state: Firing},
+				{at: 61 * time.Second, state: Inactive},
+			},
+			notified: []string{Firing, Resolved},
+		},
+		{
+			name:      "absence of observations",
+			opts:      Options{Window: time.Minute},
+			condition: func(labels map[string]string, v Values) bool { return v.Count == 0 },
+			steps: []step{
+				{at: 0, state: Firing},
+				{at: time.Second, values: []float64{1}, state: Inactive},
+			},
+			notified: []string{Firing, Resolved},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				notified []string
+			)
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Status string `json:"status"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("invalid notification: %v", err)
+				}
+				mu.Lock()
+				notified = append(notified, body.Status)
+				mu.Unlock()
+			}))
+			defer webhook.Close()
+
+			notifier := notify.NewNotifier(nil, nil, zerolog.Nop())
+			opts := tt.opts
+			opts.Name = "test"
+			opts.Webhooks = []string{webhook.URL}
+			r, err := NewRule(opts, notifier, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Unix(1600000000, 0)
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				for _, v := range s.values {
+					if _, ok := r.Observe(now, nil, v); !ok {
+						t.Fatalf("step %d: observation dropped", i)
+					}
+				}
+				r.Evaluate(now, tt.condition)
+				if got := r.State(nil); got != s.state {
+					t.Fatalf("step %d: expected state %s, got %s", i, s.state, got)
+				}
+				// the notifications of each step are sent before the next step
+				notifier.Close()
+				notifier = notify.NewNotifier(nil, nil, zerolog.Nop())
+				r.notifier = notifier
+			}
+			notifier.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(notified, tt.notified) {
+				t.Fatalf("expected the notifications %v, got %v", tt.notified, notified)
+			}
+		})
+	}
+}
+
+// added is a value added to a window at the offset from the start
+type added struct {
+	at time.Duration
+	v  float64
+}
+
+func TestWindowValues(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		name string
+		// adds are the offsets and values added to the window of a minute
+		adds []added
+		at   time.Duration
+		want Values
+	}{
+		{
+			name: "empty",
+			want: Values{},
+		},
+		{
+			name: "in the window",
+			adds: []added{{0, 1}, {10 * time.Second, 2}, {59 * time.Second, 3}},
+			at:   59 * time.Second,
+			want: Values{Count: 3, Sum: 6, Last: 3},
+		},
+		{
+			name: "first bucket left the window",
+			adds: []added{{0, 1}, {10 * time.Second, 2}},
+			at:   time.Minute,
+			want: Values{Count: 1, Sum: 2, Last: 2},
+		},
+		{
+			name: "last left the window",
+			adds: []added{{0, 1}, {10 * time.Second, 2}},
+			at:   70 * time.Second,
+			want: Values{},
+		},
+		{
+			name: "bucket reused",
+			adds: []added{{0, 1}, {time.Minute, 5}},
+			at:   time.Minute,
+			want: Values{Count: 1, Sum: 5, Last: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &window{width: int64(time.Minute) / buckets}
+			for _, a := range tt.adds {
+				w.add(start.Add(a.at), a.v)
+			}
+			if got := w.values(start.Add(tt.at)); got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
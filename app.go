@@ -9,34 +9,64 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/cardinality"
 	"github.com/smitajit/logtrics/config"
+	"github.com/smitajit/logtrics/graphite"
+	"github.com/smitajit/logtrics/influx"
+	"github.com/smitajit/logtrics/notify"
+	"github.com/smitajit/logtrics/otlp"
+	"github.com/smitajit/logtrics/prometheus"
 	"github.com/smitajit/logtrics/reader"
+	"github.com/smitajit/logtrics/statsd"
 )
 
 // Application represents this application
 // it stores all the application states and maintains the runtime
 type Application struct {
-	readers []reader.LogReader
-	scripts []*Script
-	conf    *config.Configuration
-	logger  zerolog.Logger
+	readers    []reader.LogReader
+	scripts    []*Script
+	prometheus *prometheus.Prometheus
+	otlp       *otlp.Exporter
+	graphite   *graphite.Manager
+	statsd     *statsd.Manager
+	influx     *influx.Manager
+	notifier   *notify.Notifier
+	conf       *config.Configuration
+	logger     zerolog.Logger
 }
 
-//NewApplication returns a new Application instance
+// NewApplication returns a new Application instance
 func NewApplication(conf *config.Configuration, readers ...reader.LogReader) (*Application, error) {
 	app := &Application{
-		readers: readers,
-		scripts: make([]*Script, 0),
-		conf:    conf,
-		logger:  conf.Logger("application"),
+		readers:    readers,
+		scripts:    make([]*Script, 0),
+		prometheus: prometheus.NewPrometheus(conf, conf.Logger("prometheus")),
+		graphite:   graphite.NewManager(conf.Logger("graphite")),
+		statsd:     statsd.NewManager(conf.Logger("statsd")),
+		influx:     influx.NewManager(conf.Logger("influx")),
+		conf:       conf,
+		logger:     conf.Logger("application"),
 	}
 
+	sinks, exporter, err := newSinks(conf, app.prometheus, app.graphite, app.statsd, app.influx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize metric sinks")
+	}
+	app.otlp = exporter
+	app.notifier = notify.NewNotifier(conf.Notify, app.prometheus, conf.Logger("notify"))
+	metrics := NewMetrics(sinks...)
+	c := conf.Cardinality
+	if c == nil {
+		c = &config.Cardinality{}
+	}
+	limiter := cardinality.NewLimiter("global", c.MaxSeries, c.Overflow, nil, app.prometheus, conf.Logger("cardinality"))
+
 	files, err := scripts(conf)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get script files")
 	}
 	for _, f := range files {
-		script, err := NewScript(f, conf)
+		script, err := NewScript(f, conf, app.prometheus, app.graphite, app.statsd, app.influx, app.notifier, metrics, limiter)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to initialize app")
 		}
@@ -85,6 +115,12 @@ func (app *Application) Run(ctx context.Context) error {
 }
 
 func (app *Application) run(ctx context.Context, fn func(event reader.LogEvent)) error {
+	if err := app.prometheus.Start(ctx); err != nil {
+		return err
+	}
+	if app.otlp != nil {
+		app.otlp.Start(ctx)
+	}
 	for _, reader := range app.readers {
 		if err := reader.Start(ctx, fn); err != nil {
 			return errors.Wrap(err, "failed to start the readers")
@@ -93,6 +129,28 @@ func (app *Application) run(ctx context.Context, fn func(event reader.LogEvent))
 	return nil
 }
 
+// Close stops the application, the open aggregation windows are emitted, the queued notifications
+// and the last metrics are sent to graphite, statsd, influx and the otlp receiver
+func (app *Application) Close() error {
+	for _, s := range app.scripts {
+		s.Close()
+	}
+	app.notifier.Close()
+	err := app.graphite.Close()
+	if serr := app.statsd.Close(); serr != nil && err == nil {
+		err = serr
+	}
+	if ierr := app.influx.Close(); ierr != nil && err == nil {
+		err = ierr
+	}
+	if app.otlp != nil {
+		if oerr := app.otlp.Close(); oerr != nil && err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
 func scripts(conf *config.Configuration) ([]string, error) {
 	if conf.ScriptFile != "" {
 		return []string{conf.ScriptFile}, nil
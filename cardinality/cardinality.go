@@ -0,0 +1,180 @@
+// Package cardinality is responsible for limiting the number of distinct metric series
+package cardinality
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/prometheus"
+)
+
+const (
+	// warnInterval is the minimum interval between the warnings of a limiter
+	warnInterval = time.Minute
+)
+
+type (
+	// Limiter limits the number of distinct series. A series is accepted when it is already known
+	// or it can be added within the limit of the limiter and of its parent.
+	// The parent holds a series while it is allowed directly or held by one of its children.
+	// The number of series and the rejections are exposed as prometheus metrics
+	//
+	//	logtrics_cardinality_series{limiter="global"} 100
+	//	logtrics_cardinality_rejected_total{limiter="global"} 12
+	Limiter struct {
+		name     string
+		max      int
+		overflow string
+		parent   *Limiter
+		logger   zerolog.Logger
+
+		mu       sync.Mutex
+		series   map[string]*entry
+		warned   time.Time
+		count    *prometheus.Series
+		rejected *prometheus.Series
+	}
+
+	// entry is a series known by the limiter
+	entry struct {
+		// direct is true when the series is allowed by the limiter, used is the time of the last Allow
+		direct bool
+		used   time.Time
+		// children is the number of children holding the series
+		children int
+	}
+)
+
+// NewLimiter returns a new Limiter instance. The series are unlimited if max is 0.
+// The values of the rejected series are recorded in the overflow metric
+func NewLimiter(name string, max int, overflow string, parent *Limiter, prom *prometheus.Prometheus, logger zerolog.Logger) *Limiter {
+	l := &Limiter{
+		name:     name,
+		max:      max,
+		overflow: overflow,
+		parent:   parent,
+		logger:   logger,
+		series:   make(map[string]*entry),
+	}
+	if prom != nil {
+		labels := map[string]string{"limiter": name}
+		l.count, _ = prom.Gauge("logtrics_cardinality_series", labels, prometheus.Options{Help: "number of distinct metric series"})
+		l.rejected, _ = prom.Counter("logtrics_cardinality_rejected_total", labels, prometheus.Options{Help: "number of rejected metric series"})
+	}
+	return l
+}
+
+// Allow returns true if the series is accepted by the limiter and its parents
+// A nil limiter accepts all the series
+func (l *Limiter) Allow(series string) bool {
+	return l.acquire(series, false)
+}
+
+// acquire adds the series to the limiter, directly or for a child
+func (l *Limiter) acquire(series string, child bool) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.series[series]
+	if !ok {
+		if l.max > 0 && len(l.series) >= l.max {
+			l.reject(series)
+			return false
+		}
+		if !l.parent.acquire(series, true) {
+			return false
+		}
+		e = &entry{}
+		l.series[series] = e
+		if l.count != nil {
+			l.count.Set(float64(len(l.series)))
+		}
+	}
+	if child {
+		e.children++
+	} else {
+		e.direct = true
+		e.used = time.Now()
+	}
+	return true
+}
+
+// reject records the rejection of the series. The caller must hold the lock
+func (l *Limiter) reject(series string) {
+	if l.rejected != nil {
+		l.rejected.Add(1)
+	}
+	if now := time.Now(); now.Sub(l.warned) >= warnInterval {
+		l.warned = now
+		l.logger.Warn().
+			Str("limiter", l.name).
+			Int("max", l.max).
+			Str("series", series).
+			Msgf("cardinality limit reached, recording new series in %s", l.Overflow())
+	}
+}
+
+// Forget removes the series from the limiter. The parents forget it once none of their children holds it
+func (l *Limiter) Forget(series string) {
+	l.release(series, false)
+}
+
+// Expire forgets the series with the prefix which are not allowed for the ttl
+func (l *Limiter) Expire(prefix string, ttl time.Duration) {
+	if l == nil {
+		return
+	}
+	var expired []string
+	now := time.Now()
+	l.mu.Lock()
+	for series, e := range l.series {
+		if e.direct && now.Sub(e.used) > ttl && strings.HasPrefix(series, prefix) {
+			expired = append(expired, series)
+		}
+	}
+	l.mu.Unlock()
+	for _, series := range expired {
+		l.Forget(series)
+	}
+}
+
+// release removes the direct use or a child of the series, the series is removed when it is no more held
+func (l *Limiter) release(series string, child bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	e, ok := l.series[series]
+	if !ok {
+		l.mu.Unlock()
+		return
+	}
+	if child {
+		e.children--
+	} else {
+		e.direct = false
+	}
+	held := e.direct || e.children > 0
+	if !held {
+		delete(l.series, series)
+		if l.count != nil {
+			l.count.Set(float64(len(l.series)))
+		}
+	}
+	l.mu.Unlock()
+	if !held {
+		l.parent.release(series, true)
+	}
+}
+
+// Overflow returns the name of the overflow metric
+func (l *Limiter) Overflow() string {
+	if l == nil || l.overflow == "" {
+		return "logtrics.overflow"
+	}
+	return l.overflow
+}
@@ -0,0 +1,182 @@
+package logtrics
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	cefPrefix  = "CEF:"
+	leefPrefix = "LEEF:"
+)
+
+type (
+	// CEF represents the ArcSight Common Event Format parser
+	//
+	//	CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+	//
+	// The header fields are exposed as version, vendor, product, device_version, signature_id, name and severity,
+	// the extension keys are exposed as they are
+	CEF struct{}
+
+	// LEEF represents the IBM Log Event Extended Format parser
+	//
+	//	LEEF:1.0|Vendor|Product|Version|EventID|Extension
+	//	LEEF:2.0|Vendor|Product|Version|EventID|Delimiter|Extension
+	//
+	// The header fields are exposed as version, vendor, product, device_version and signature_id,
+	// the `sev` extension key is exposed as severity and the extension keys are exposed as they are
+	LEEF struct{}
+)
+
+// FindSubStrings extracts the header and extension fields of the CEF message
+// The message can be prefixed with a syslog header
+func (p *CEF) FindSubStrings(s string) (map[string]string, bool) {
+	i := strings.Index(s, cefPrefix)
+	if i < 0 {
+		return nil, false
+	}
+	header, ext, ok := splitHeader(s[i+len(cefPrefix):], 7)
+	if !ok {
+		return nil, false
+	}
+	results := make(map[string]string)
+	cefExtension(ext, results)
+	for i, k := range []string{"version", "vendor", "product", "device_version", "signature_id", "name", "severity"} {
+		results[k] = header[i]
+	}
+	return results, true
+}
+
+// Anchors returns the CEF prefix
+func (p *CEF) Anchors() []string {
+	return []string{cefPrefix}
+}
+
+// FindSubStrings extracts the header and extension fields of the LEEF message
+// The message can be prefixed with a syslog header
+func (p *LEEF) FindSubStrings(s string) (map[string]string, bool) {
+	i := strings.Index(s, leefPrefix)
+	if i < 0 {
+		return nil, false
+	}
+	header, ext, ok := splitHeader(s[i+len(leefPrefix):], 5)
+	if !ok {
+		return nil, false
+	}
+	delimiter := "\t"
+	if strings.HasPrefix(header[0], "2") {
+		var d []string
+		if d, ext, ok = splitHeader(ext, 1); !ok {
+			return nil, false
+		}
+		if d[0] != "" {
+			delimiter = leefDelimiter(d[0])
+		}
+	}
+
+	results := make(map[string]string)
+	for _, kv := range strings.Split(ext, delimiter) {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			continue
+		}
+		results[kv[:i]] = kv[i+1:]
+	}
+	if sev, ok := results["sev"]; ok {
+		results["severity"] = sev
+	}
+	for i, k := range []string{"version", "vendor", "product", "device_version", "signature_id"} {
+		results[k] = header[i]
+	}
+	return results, true
+}
+
+// Anchors returns the LEEF prefix
+func (p *LEEF) Anchors() []string {
+	return []string{leefPrefix}
+}
+
+// splitHeader splits n pipe separated header fields and returns the fields and the rest of the string
+// `\|` and `\\` are unescaped in the fields
+func splitHeader(s string, n int) ([]string, string, bool) {
+	fields := make([]string, 0, n)
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\'):
+			b.WriteByte(s[i+1])
+			i++
+		case c == '|':
+			fields = append(fields, b.String())
+			b.Reset()
+			if len(fields) == n {
+				return fields, s[i+1:], true
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, "", false
+}
+
+// cefExtension parses the space separated key=value pairs of the CEF extension
+// The values can contain spaces and the escaped `\=`, `\\`, `\n`, `\r` sequences
+func cefExtension(ext string, results map[string]string) {
+	type key struct{ start, eq int }
+	var keys []key
+	for i := 0; i < len(ext); i++ {
+		switch ext[i] {
+		case '\\':
+			i++
+		case '=':
+			start := strings.LastIndexByte(ext[:i], ' ') + 1
+			if start == i || (len(keys) > 0 && start <= keys[len(keys)-1].eq) {
+				continue
+			}
+			keys = append(keys, key{start, i})
+		}
+	}
+	for j, k := range keys {
+		end := len(ext)
+		if j+1 < len(keys) {
+			end = keys[j+1].start
+		}
+		results[ext[k.start:k.eq]] = cefUnescape(strings.TrimRight(ext[k.eq+1:end], " "))
+	}
+}
+
+func cefUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// leefDelimiter returns the LEEF 2.0 delimiter, which can be a character or a hex value (x09 or 0x09)
+func leefDelimiter(d string) string {
+	h := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(d), "0"), "x")
+	if len(d) > 1 && h != strings.ToLower(d) {
+		if c, err := strconv.ParseUint(h, 16, 8); err == nil {
+			return string(rune(c))
+		}
+	}
+	return d
+}
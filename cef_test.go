@@ -0,0 +1,155 @@
+package logtrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCEFFindSubStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want map[string]string
+	}{
+		{
+			name: "header and extension",
+			line: `CEF:0|Security|threatmanager|1.0|100|worm successfully stopped|10|src=10.0.0.1 dst=2.1.2.2 spt=1232`,
+			want: map[string]string{
+				"version": "0", "vendor": "Security", "product": "threatmanager", "device_version": "1.0",
+				"signature_id": "100", "name": "worm successfully stopped", "severity": "10",
+				"src": "10.0.0.1", "dst": "2.1.2.2", "spt": "1232",
+			},
+		},
+		{
+			name: "syslog prefix",
+			line: `Sep 19 08:26:10 host CEF:0|Vendor|Product|1|42|login|3|suser=bob`,
+			want: map[string]string{
+				"version": "0", "vendor": "Vendor", "product": "Product", "device_version": "1",
+				"signature_id": "42", "name": "login", "severity": "3", "suser": "bob",
+			},
+		},
+		{
+			name: "escaped header",
+			line: `CEF:0|Ven\|dor|Pro\\duct|1|42|a\|b|3|`,
+			want: map[string]string{
+				"version": "0", "vendor": "Ven|dor", "product": `Pro\duct`, "device_version": "1",
+				"signature_id": "42", "name": "a|b", "severity": "3",
+			},
+		},
+		{
+			name: "extension values with spaces and escapes",
+			line: `CEF:0|V|P|1|42|n|3|msg=a b\=c\\d\nnext cs1=x=y  act=blocked`,
+			want: map[string]string{
+				"version": "0", "vendor": "V", "product": "P", "device_version": "1",
+				"signature_id": "42", "name": "n", "severity": "3",
+				"msg": "a b=c\\d\nnext", "cs1": "x=y", "act": "blocked",
+			},
+		},
+		{
+			name: "incomplete header",
+			line: `CEF:0|V|P|1|42|n`,
+		},
+		{
+			name: "not cef",
+			line: `LEEF:1.0|V|P|1|42|src=1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := (&CEF{}).FindSubStrings(tt.line)
+			if ok != (tt.want != nil) {
+				t.Fatalf("expected match %v, got %v", tt.want != nil, ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLEEFFindSubStrings(t *testing.T) {
+	header := map[string]string{"vendor": "V", "product": "P", "device_version": "1", "signature_id": "42"}
+	with := func(fields map[string]string) map[string]string {
+		m := make(map[string]string)
+		for k, v := range header {
+			m[k] = v
+		}
+		for k, v := range fields {
+			m[k] = v
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		line string
+		want map[string]string
+	}{
+		{
+			name: "leef 1.0 tab delimited",
+			line: "LEEF:1.0|V|P|1|42|src=10.0.0.1\tdst=10.0.0.2\tsev=5",
+			want: with(map[string]string{"version": "1.0", "src": "10.0.0.1", "dst": "10.0.0.2", "sev": "5", "severity": "5"}),
+		},
+		{
+			name: "leef 2.0 character delimiter",
+			line: "LEEF:2.0|V|P|1|42|^|src=10.0.0.1^usrName=a b",
+			want: with(map[string]string{"version": "2.0", "src": "10.0.0.1", "usrName": "a b"}),
+		},
+		{
+			name: "leef 2.0 hex delimiter",
+			line: "LEEF:2.0|V|P|1|42|0x5E|src=10.0.0.1^dst=10.0.0.2",
+			want: with(map[string]string{"version": "2.0", "src": "10.0.0.1", "dst": "10.0.0.2"}),
+		},
+		{
+			name: "leef 2.0 short hex delimiter",
+			line: "LEEF:2.0|V|P|1|42|x09|src=10.0.0.1\tdst=10.0.0.2",
+			want: with(map[string]string{"version": "2.0", "src": "10.0.0.1", "dst": "10.0.0.2"}),
+		},
+		{
+			name: "leef 2.0 default delimiter",
+			line: "LEEF:2.0|V|P|1|42||src=10.0.0.1\tdst=10.0.0.2",
+			want: with(map[string]string{"version": "2.0", "src": "10.0.0.1", "dst": "10.0.0.2"}),
+		},
+		{
+			name: "leef 2.0 without delimiter",
+			line: "LEEF:2.0|V|P|1|42|src=10.0.0.1",
+		},
+		{
+			name: "pairs without key are skipped",
+			line: "LEEF:1.0|V|P|1|42|=a\tb\tsrc=1",
+			want: with(map[string]string{"version": "1.0", "src": "1"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := (&LEEF{}).FindSubStrings(tt.line)
+			if ok != (tt.want != nil) {
+				t.Fatalf("expected match %v, got %v", tt.want != nil, ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLEEFDelimiter(t *testing.T) {
+	tests := []struct {
+		delimiter string
+		want      string
+	}{
+		{"^", "^"},
+		{"x", "x"},
+		{"0", "0"},
+		{"x09", "\t"},
+		{"0x09", "\t"},
+		{"0X5e", "^"},
+		{"xzz", "xzz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.delimiter, func(t *testing.T) {
+			if got := leefDelimiter(tt.delimiter); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
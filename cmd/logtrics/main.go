@@ -54,10 +54,73 @@ func init() {
 	flags.String("tcp.host", "127.0.0.1", "tcp server listening host")
 	flags.Int("tcp.port", 4003, "tcp server listening port")
 
+	flags.String("prometheus.host", "127.0.0.1", "prometheus scrape endpoint listening host")
+	flags.Int("prometheus.port", 0, "prometheus scrape endpoint listening port, disabled if 0")
+	flags.String("prometheus.path", "/metrics", "prometheus scrape endpoint path")
+
+	flags.String("statsd.network", "udp", `statsd network, choices are "udp", "tcp", "unix", "unixgram"`)
+	flags.String("statsd.address", "127.0.0.1:8125", "statsd agent address")
+	flags.String("statsd.prefix", "", "statsd metric name prefix")
+	flags.Int("statsd.mtu", 1432, "maximum statsd packet size in bytes")
+	flags.Int("statsd.interval", 1, "statsd flush interval in secs")
+	flags.Bool("statsd.dogstatsd", false, "if enabled DogStatsD tags will be sent")
+
+	flags.String("influx.transport", "http", `influx transport, choices are "http", "udp"`)
+	flags.String("influx.address", "127.0.0.1:8089", "influx udp address")
+	flags.String("influx.url", "http://127.0.0.1:8086", "influx http url")
+	flags.Int("influx.version", 1, "influx http api version, choices are 1, 2")
+	flags.String("influx.database", "logtrics", "influx v1 database")
+	flags.String("influx.org", "", "influx v2 organization")
+	flags.String("influx.bucket", "", "influx v2 bucket")
+	flags.String("influx.precision", "ns", `influx timestamp precision, choices are "ns", "us", "ms", "s"`)
+	flags.Int("influx.batch", 1000, "maximum number of influx points in a write")
+	flags.Int("influx.interval", 1, "influx flush interval in secs")
+
+	flags.StringSlice("metrics.sinks", nil, `comma separated metrics api sinks, choices are "graphite", "prometheus", "statsd", "influx", "otlp"`)
+	flags.String("metrics.prefix", "", "prefix of the graphite and statsd metric names, e.g. logtrics.{host}")
+
+	flags.Int("cardinality.maxseries", 0, "maximum number of distinct metric series, unlimited if 0")
+	flags.Int("cardinality.maxlogtricseries", 0, "maximum number of distinct metric series per logtric, unlimited if 0")
+	flags.String("cardinality.overflow", "logtrics.overflow", "metric name recording the values of the series over the limits")
+	flags.Int("cardinality.expiry", 3600, "secs after which the metrics api series not used are forgotten by the limits, never if 0")
+
+	flags.String("store.path", "", "directory of the snapshots and journals of the script stores, memory only if empty")
+	flags.Int("store.interval", 30, "store snapshot interval in secs")
+
+	flags.Int("notify.queuesize", 1000, "maximum number of queued notifications, the notifications are dropped when full")
+	flags.Int("notify.workers", 4, "number of notifications sent concurrently")
+	flags.Int("notify.timeout", 10, "notification request timeout in secs")
+	flags.Int("notify.retries", 3, "number of retries of the failed notifications, no retries if 0")
+
+	flags.String("alert.alertmanager", "", "url of the default alertmanager of the alert rules")
+	flags.Int("alert.interval", 15, "evaluation interval of the alert rules in secs")
+	flags.Int("alert.repeatinterval", 14400, "interval of the notifications of the firing alerts in secs")
+
+	flags.String("otlp.protocol", "grpc", `otlp protocol, choices are "grpc", "http"`)
+	flags.String("otlp.endpoint", "127.0.0.1:4317", "otlp receiver endpoint, host:port for grpc or url for http")
+	flags.Bool("otlp.insecure", false, "disable tls for the otlp receiver")
+	flags.Int("otlp.interval", 10, "otlp export interval in secs")
+	flags.Int("otlp.timeout", 10, "otlp export timeout in secs")
+	flags.Int("otlp.retries", 3, "number of otlp export retries")
+	flags.String("otlp.servicename", "logtrics", "otlp service.name resource attribute")
+
 	flags.String("graphite.host", "127.0.0.1", "graphite server host")
 	flags.Int("graphite.port", 2024, "graphite server port")
 	flags.Int("graphite.interval", 30, "interval in secs")
 	flags.Bool("graphite.debug", false, "if enabled metrics will be logged")
+	flags.Bool("graphite.eventtime", false, "if enabled metrics will be aggregated and sent with the event time")
+	flags.Int("graphite.lateness", 10, "number of intervals to accept late events in event time mode")
+	flags.Bool("graphite.tagged", false, "if enabled the labels of the metrics api will be sent as graphite tags")
+	flags.Int("graphite.expiry", 0, "number of intervals after which the metrics not updated are removed, never if 0")
+	flags.Bool("graphite.delta", false, "if enabled the counters, meters, timers and histograms will be reset after each flush")
+	flags.String("graphite.transport", "tcp", "graphite transport. Choices are tcp, udp, pickle")
+	flags.Int("graphite.queuesize", 100000, "maximum number of datapoints buffered while graphite is unreachable")
+	flags.String("graphite.spool", "", "directory to store the datapoints exceeding the queue size, disabled if empty")
+	flags.StringSlice("graphite.percentiles", []string{"0.5", "0.75", "0.95", "0.99", "0.999"}, "comma separated percentiles of the timers and histograms")
+	flags.String("graphite.timerunit", "ns", "unit of the values of the lua timers. Choices are ns, us, ms, s")
+	flags.String("graphite.outputunit", "s", "unit of the timer values sent to graphite. Choices are ns, us, ms, s")
+	flags.String("graphite.reservoir", "expdecay", "reservoir of the timers and histograms. Choices are uniform, expdecay, hdr")
+	flags.Int("graphite.reservoirsize", 1028, "number of values of the uniform and expdecay reservoirs")
 
 	_ = viper.BindPFlag("config", flags.Lookup("config"))
 	_ = viper.BindPFlag("modes", flags.Lookup("modes"))
@@ -70,10 +133,64 @@ func init() {
 	_ = viper.BindPFlag("udp.host", flags.Lookup("udp.host"))
 	_ = viper.BindPFlag("tcp.port", flags.Lookup("tcp.port"))
 	_ = viper.BindPFlag("tcp.host", flags.Lookup("tcp.host"))
+	_ = viper.BindPFlag("prometheus.host", flags.Lookup("prometheus.host"))
+	_ = viper.BindPFlag("prometheus.port", flags.Lookup("prometheus.port"))
+	_ = viper.BindPFlag("prometheus.path", flags.Lookup("prometheus.path"))
+	_ = viper.BindPFlag("statsd.network", flags.Lookup("statsd.network"))
+	_ = viper.BindPFlag("statsd.address", flags.Lookup("statsd.address"))
+	_ = viper.BindPFlag("statsd.prefix", flags.Lookup("statsd.prefix"))
+	_ = viper.BindPFlag("statsd.mtu", flags.Lookup("statsd.mtu"))
+	_ = viper.BindPFlag("statsd.interval", flags.Lookup("statsd.interval"))
+	_ = viper.BindPFlag("statsd.dogstatsd", flags.Lookup("statsd.dogstatsd"))
+	_ = viper.BindPFlag("influx.transport", flags.Lookup("influx.transport"))
+	_ = viper.BindPFlag("influx.address", flags.Lookup("influx.address"))
+	_ = viper.BindPFlag("influx.url", flags.Lookup("influx.url"))
+	_ = viper.BindPFlag("influx.version", flags.Lookup("influx.version"))
+	_ = viper.BindPFlag("influx.database", flags.Lookup("influx.database"))
+	_ = viper.BindPFlag("influx.org", flags.Lookup("influx.org"))
+	_ = viper.BindPFlag("influx.bucket", flags.Lookup("influx.bucket"))
+	_ = viper.BindPFlag("influx.precision", flags.Lookup("influx.precision"))
+	_ = viper.BindPFlag("influx.batch", flags.Lookup("influx.batch"))
+	_ = viper.BindPFlag("influx.interval", flags.Lookup("influx.interval"))
+	_ = viper.BindPFlag("metrics.sinks", flags.Lookup("metrics.sinks"))
+	_ = viper.BindPFlag("metrics.prefix", flags.Lookup("metrics.prefix"))
+	_ = viper.BindPFlag("cardinality.maxseries", flags.Lookup("cardinality.maxseries"))
+	_ = viper.BindPFlag("cardinality.maxlogtricseries", flags.Lookup("cardinality.maxlogtricseries"))
+	_ = viper.BindPFlag("cardinality.overflow", flags.Lookup("cardinality.overflow"))
+	_ = viper.BindPFlag("cardinality.expiry", flags.Lookup("cardinality.expiry"))
+	_ = viper.BindPFlag("store.path", flags.Lookup("store.path"))
+	_ = viper.BindPFlag("store.interval", flags.Lookup("store.interval"))
+	_ = viper.BindPFlag("notify.queuesize", flags.Lookup("notify.queuesize"))
+	_ = viper.BindPFlag("notify.workers", flags.Lookup("notify.workers"))
+	_ = viper.BindPFlag("notify.timeout", flags.Lookup("notify.timeout"))
+	_ = viper.BindPFlag("notify.retries", flags.Lookup("notify.retries"))
+	_ = viper.BindPFlag("alert.alertmanager", flags.Lookup("alert.alertmanager"))
+	_ = viper.BindPFlag("alert.interval", flags.Lookup("alert.interval"))
+	_ = viper.BindPFlag("alert.repeatinterval", flags.Lookup("alert.repeatinterval"))
+	_ = viper.BindPFlag("otlp.protocol", flags.Lookup("otlp.protocol"))
+	_ = viper.BindPFlag("otlp.endpoint", flags.Lookup("otlp.endpoint"))
+	_ = viper.BindPFlag("otlp.insecure", flags.Lookup("otlp.insecure"))
+	_ = viper.BindPFlag("otlp.interval", flags.Lookup("otlp.interval"))
+	_ = viper.BindPFlag("otlp.timeout", flags.Lookup("otlp.timeout"))
+	_ = viper.BindPFlag("otlp.retries", flags.Lookup("otlp.retries"))
+	_ = viper.BindPFlag("otlp.servicename", flags.Lookup("otlp.servicename"))
 	_ = viper.BindPFlag("graphite.host", flags.Lookup("graphite.host"))
 	_ = viper.BindPFlag("graphite.port", flags.Lookup("graphite.port"))
 	_ = viper.BindPFlag("graphite.interval", flags.Lookup("graphite.interval"))
 	_ = viper.BindPFlag("graphite.debug", flags.Lookup("graphite.debug"))
+	_ = viper.BindPFlag("graphite.eventtime", flags.Lookup("graphite.eventtime"))
+	_ = viper.BindPFlag("graphite.lateness", flags.Lookup("graphite.lateness"))
+	_ = viper.BindPFlag("graphite.tagged", flags.Lookup("graphite.tagged"))
+	_ = viper.BindPFlag("graphite.expiry", flags.Lookup("graphite.expiry"))
+	_ = viper.BindPFlag("graphite.delta", flags.Lookup("graphite.delta"))
+	_ = viper.BindPFlag("graphite.transport", flags.Lookup("graphite.transport"))
+	_ = viper.BindPFlag("graphite.queuesize", flags.Lookup("graphite.queuesize"))
+	_ = viper.BindPFlag("graphite.spool", flags.Lookup("graphite.spool"))
+	_ = viper.BindPFlag("graphite.percentiles", flags.Lookup("graphite.percentiles"))
+	_ = viper.BindPFlag("graphite.timerunit", flags.Lookup("graphite.timerunit"))
+	_ = viper.BindPFlag("graphite.outputunit", flags.Lookup("graphite.outputunit"))
+	_ = viper.BindPFlag("graphite.reservoir", flags.Lookup("graphite.reservoir"))
+	_ = viper.BindPFlag("graphite.reservoirsize", flags.Lookup("graphite.reservoirsize"))
 
 	cobra.OnInitialize(func() {
 		viper.SetConfigFile(viper.GetString("config"))
@@ -124,7 +241,8 @@ func run() error {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
-	return nil
+	cancel()
+	return app.Close()
 }
 
 func main() {
@@ -21,15 +21,24 @@ var (
 type (
 	// Configuration represents the application's configuration
 	Configuration struct {
-		Modes      []string  `toml:"modes"`
-		Expression string    `toml:"expression"`
-		ScriptFile string    `toml:"scriptfile"`
-		ScriptDir  string    `toml:"scriptdir"`
-		BufferSize int       `toml:"buffersize"`
-		Graphite   *Graphite `toml:"graphite"`
-		UDP        *UDP      `toml:"udp"`
-		TCP        *TCP      `toml:"tcp"`
-		Logging    *Logging  `toml:"logging"`
+		Modes       []string     `toml:"modes"`
+		Expression  string       `toml:"expression"`
+		ScriptFile  string       `toml:"scriptfile"`
+		ScriptDir   string       `toml:"scriptdir"`
+		BufferSize  int          `toml:"buffersize"`
+		Graphite    *Graphite    `toml:"graphite"`
+		Prometheus  *Prometheus  `toml:"prometheus"`
+		Statsd      *Statsd      `toml:"statsd"`
+		Influx      *Influx      `toml:"influx"`
+		OTLP        *OTLP        `toml:"otlp"`
+		Metrics     *Metrics     `toml:"metrics"`
+		Cardinality *Cardinality `toml:"cardinality"`
+		Store       *Store       `toml:"store"`
+		Notify      *Notify      `toml:"notify"`
+		Alert       *Alert       `toml:"alert"`
+		UDP         *UDP         `toml:"udp"`
+		TCP         *TCP         `toml:"tcp"`
+		Logging     *Logging     `toml:"logging"`
 	}
 
 	// UDP configuration
@@ -50,12 +59,147 @@ type (
 		Level string `toml:"level"`
 	}
 
+	// Prometheus configuration
+	Prometheus struct {
+		Host string `toml:"host"`
+		Port int    `toml:"port"`
+		Path string `toml:"path"`
+	}
+
+	// Statsd configuration
+	Statsd struct {
+		// Network is one of udp, tcp, unix, unixgram
+		Network  string `toml:"network"`
+		Address  string `toml:"address"`
+		Prefix   string `toml:"prefix"`
+		MTU      int    `toml:"mtu"`
+		Interval int    `toml:"interval"`
+		// DogStatsd enables the DogStatsD tags
+		DogStatsd bool `toml:"dogstatsd"`
+	}
+
+	// Influx configuration
+	Influx struct {
+		// Transport is one of http, udp
+		Transport string `toml:"transport"`
+		// Address is the UDP address
+		Address string `toml:"address"`
+		// URL is the HTTP url of the server
+		URL string `toml:"url"`
+		// Version is the HTTP API version, 1 or 2
+		Version         int    `toml:"version"`
+		Database        string `toml:"database"`
+		RetentionPolicy string `toml:"retentionpolicy"`
+		Username        string `toml:"username"`
+		Password        string `toml:"password"`
+		Org             string `toml:"org"`
+		Bucket          string `toml:"bucket"`
+		Token           string `toml:"token"`
+		// Precision is one of ns, us, ms, s
+		Precision string `toml:"precision"`
+		Batch     int    `toml:"batch"`
+		Interval  int    `toml:"interval"`
+	}
+
+	// Metrics configuration
+	Metrics struct {
+		// Sinks are the backends of the metrics api, any of graphite, prometheus, statsd, influx, otlp
+		Sinks []string `toml:"sinks"`
+		// Prefix is the template of the prefix of the graphite and statsd metric names, e.g. logtrics.{host}
+		Prefix string `toml:"prefix"`
+	}
+
+	// Cardinality configuration
+	Cardinality struct {
+		// MaxSeries is the maximum number of distinct series of the application, unlimited if 0
+		MaxSeries int `toml:"maxseries"`
+		// MaxLogtricSeries is the maximum number of distinct series of a logtric, unlimited if 0
+		MaxLogtricSeries int `toml:"maxlogtricseries"`
+		// Overflow is the name of the metric recording the values of the rejected series
+		Overflow string `toml:"overflow"`
+		// Expiry is the number of secs after which the series of the metrics api not used are forgotten, never if 0
+		Expiry int `toml:"expiry"`
+	}
+
+	// Store configuration
+	Store struct {
+		// Path is the directory of the snapshots and journals of the stores of the scripts, the stores are memory only if empty
+		Path string `toml:"path"`
+		// Interval is the interval of the snapshots in secs
+		Interval int `toml:"interval"`
+	}
+
+	// Notify configuration
+	Notify struct {
+		// QueueSize is the maximum number of queued notifications, the notifications are dropped when the queue is full
+		QueueSize int `toml:"queuesize"`
+		// Workers is the number of notifications sent concurrently
+		Workers int `toml:"workers"`
+		// Timeout is the timeout of a request in secs
+		Timeout int `toml:"timeout"`
+		// Retries is the number of retries of the failed requests, the default if nil and no retries if 0
+		Retries *int `toml:"retries"`
+	}
+
+	// Alert configuration
+	Alert struct {
+		// Alertmanager is the url of the default Alertmanager of the alert rules
+		Alertmanager string `toml:"alertmanager"`
+		// Interval is the default evaluation interval of the alert rules in secs
+		Interval int `toml:"interval"`
+		// RepeatInterval is the default interval of the notifications of the firing alerts in secs
+		RepeatInterval int `toml:"repeatinterval"`
+	}
+
+	// OTLP configuration
+	OTLP struct {
+		// Protocol is one of grpc, http
+		Protocol string `toml:"protocol"`
+		// Endpoint is the host:port of the gRPC receiver or the url of the HTTP receiver
+		Endpoint string            `toml:"endpoint"`
+		Insecure bool              `toml:"insecure"`
+		Headers  map[string]string `toml:"headers"`
+		Interval int               `toml:"interval"`
+		Timeout  int               `toml:"timeout"`
+		Retries  int               `toml:"retries"`
+		// ServiceName is the service.name resource attribute
+		ServiceName string `toml:"servicename"`
+		// Attributes are the additional resource attributes
+		Attributes map[string]string `toml:"attributes"`
+	}
+
 	// Graphite configuration
 	Graphite struct {
 		Host     string `toml:"host"`
 		Port     int    `toml:"port"`
 		Interval int    `toml:"interval"`
 		Debug    bool   `toml:"debug"`
+		// EventTime enables the aggregation of metrics in intervals of the event time
+		EventTime bool `toml:"eventtime"`
+		// Lateness is the number of intervals for which the event time aggregations are kept for late events
+		Lateness int `toml:"lateness"`
+		// Tagged enables the graphite tags (graphite 1.1+) for the labels of the metrics api
+		Tagged bool `toml:"tagged"`
+		// Expiry is the number of intervals after which the metrics not updated are removed, never if 0
+		Expiry int `toml:"expiry"`
+		// Delta enables the reset of the counters, meters, timers and histograms after each flush
+		Delta bool `toml:"delta"`
+		// Transport is the protocol used to send the metrics, one of tcp, udp or pickle
+		Transport string `toml:"transport"`
+		// QueueSize is the maximum number of datapoints buffered while graphite is unreachable
+		QueueSize int `toml:"queuesize"`
+		// Spool is the directory where the datapoints exceeding the queue size are stored, disabled if empty
+		Spool string `toml:"spool"`
+		// Percentiles are the percentiles of the timers and histograms, in (0, 1]
+		Percentiles []float64 `toml:"percentiles"`
+		// TimerUnit is the unit of the values of the lua timers, e.g. ns, us, ms, s
+		TimerUnit string `toml:"timerunit"`
+		// OutputUnit is the unit of the timer values sent to graphite
+		OutputUnit string `toml:"outputunit"`
+		// Reservoir is the sample of the timers and histograms, one of uniform, expdecay or hdr
+		Reservoir string `toml:"reservoir"`
+		// ReservoirSize is the number of values of the uniform and expdecay reservoirs
+		ReservoirSize int `toml:"reservoirsize"`
 	}
 )
 
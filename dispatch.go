@@ -0,0 +1,141 @@
+package logtrics
+
+type (
+	// Dispatcher selects the candidate logtrics for a line in a single pass.
+	// The anchors of all the logtrics are matched together using an Aho-Corasick automaton,
+	// only the logtrics whose anchor is found in the line (or which are not anchored) are returned
+	Dispatcher struct {
+		logtrics []*Logtric
+		anchored []bool
+		matcher  *matcher
+		// owners maps the pattern index to the logtric indexes
+		owners [][]int
+	}
+
+	// matcher is the Aho-Corasick automaton for multiple pattern matching
+	matcher struct {
+		next    []map[byte]int
+		fail    []int
+		outputs [][]int
+	}
+)
+
+// NewDispatcher returns a new Dispatcher for the logtrics
+func NewDispatcher(logtrics []*Logtric) *Dispatcher {
+	d := &Dispatcher{
+		logtrics: logtrics,
+		anchored: make([]bool, len(logtrics)),
+	}
+	index := make(map[string]int)
+	var patterns []string
+	for i, l := range logtrics {
+		anchors := l.anchors()
+		if len(anchors) == 0 {
+			continue
+		}
+		d.anchored[i] = true
+		for _, a := range anchors {
+			p, ok := index[a]
+			if !ok {
+				p = len(patterns)
+				index[a] = p
+				patterns = append(patterns, a)
+				d.owners = append(d.owners, nil)
+			}
+			d.owners[p] = append(d.owners[p], i)
+		}
+	}
+	if len(patterns) > 0 {
+		d.matcher = newMatcher(patterns)
+	}
+	return d
+}
+
+// Candidates returns the logtrics which can match the line, in the order of declaration
+func (d *Dispatcher) Candidates(line string) []*Logtric {
+	if d.matcher == nil {
+		return d.logtrics
+	}
+	found := make([]bool, len(d.logtrics))
+	d.matcher.match(line, func(p int) {
+		for _, i := range d.owners[p] {
+			found[i] = true
+		}
+	})
+	candidates := make([]*Logtric, 0, len(d.logtrics))
+	for i, l := range d.logtrics {
+		if found[i] || !d.anchored[i] {
+			candidates = append(candidates, l)
+		}
+	}
+	return candidates
+}
+
+func newMatcher(patterns []string) *matcher {
+	m := &matcher{}
+	m.add()
+	for p, pattern := range patterns {
+		s := 0
+		for i := 0; i < len(pattern); i++ {
+			n, ok := m.next[s][pattern[i]]
+			if !ok {
+				n = m.add()
+				m.next[s][pattern[i]] = n
+			}
+			s = n
+		}
+		m.outputs[s] = append(m.outputs[s], p)
+	}
+
+	// breadth first traversal to compute the failure links
+	queue := make([]int, 0, len(m.next))
+	for _, n := range m.next[0] {
+		queue = append(queue, n)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for c, n := range m.next[s] {
+			queue = append(queue, n)
+			f := m.fail[s]
+			for f != 0 {
+				if _, ok := m.next[f][c]; ok {
+					break
+				}
+				f = m.fail[f]
+			}
+			if t, ok := m.next[f][c]; ok && t != n {
+				m.fail[n] = t
+			}
+			m.outputs[n] = append(m.outputs[n], m.outputs[m.fail[n]]...)
+		}
+	}
+	return m
+}
+
+func (m *matcher) add() int {
+	m.next = append(m.next, make(map[byte]int))
+	m.fail = append(m.fail, 0)
+	m.outputs = append(m.outputs, nil)
+	return len(m.next) - 1
+}
+
+// match calls fn with the index of every pattern found in s
+func (m *matcher) match(s string, fn func(p int)) {
+	state := 0
+	for i := 0; i < len(s); i++ {
+		for {
+			if n, ok := m.next[state][s[i]]; ok {
+				state = n
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = m.fail[state]
+		}
+		for _, p := range m.outputs[state] {
+			fn(p)
+		}
+	}
+}
@@ -1,5 +1,35 @@
 -- script local variables can be defined here
-local prefix = "logtrics.example.metrics"
+
+-- optional --
+-- windowed aggregation of the values per group. emit is called with the result of each group when a window closes --
+-- local latency = aggregate.window {
+	-- name = "latency",
+	-- size = "1m",
+	-- slide = "10s",
+	-- functions = { "count", "avg", "p99", "distinct" },
+	-- emit = function(result) info("%s %v", result.group.first, result.count) end,
+	-- metrics = "logtrics.example.latency",
+-- }
+
+-- optional --
+-- approximate distinct count and top-K items per period with bounded memory --
+-- local users = sketch.distinct { period = "1m", metrics = "logtrics.example.users" }
+-- local words = sketch.topk { period = "1m", k = 10, emit = function(result) info("top words %v", result.items) end }
+
+-- optional --
+-- alert rule firing when there are more than 50 observations of a service in 5m, see the README for the options --
+-- local errors = alert.rule {
+	-- name = "ServiceErrors",
+	-- window = "5m",
+	-- threshold = 50,
+	-- group_by = { "service" },
+	-- annotations = { summary = "{{ .service }} logged {{ .count }} errors" },
+	-- webhook = "http://127.0.0.1:8080/hook",
+-- }
+
+-- optional --
+-- functions called at an interval (seconds or duration string) or a cron expression --
+-- schedule("@hourly", function() info("still running") end)
 
 -- logtrics instance to configure log parsing logic --
 -- multiple logtrics instances can be configured in same script --
@@ -8,13 +38,43 @@ logtrics {
 	-- mainly used for logging purpose. But its better to name logtrics instances ---
 	name = "logtrics-example",
 
+	-- optional --
+	-- prefix of the graphite and statsd metric names, appended to metrics.prefix of the configuration
+	-- variables: {host}, {script}, {logtric}, {reader}, {env:NAME}
+	prefix = "{script}.{logtric}",
+
 	-- optional --
 	-- to override default graphite configuration
 	-- graphite =  {
 		-- host = "127.0.0.1",
 		-- port = 2003,
 		-- interval = 2,
-		-- debug = true
+		-- debug = true,
+		-- eventtime = true,
+		-- lateness = 10,
+		-- expiry = 10,
+		-- delta = true,
+	-- },
+
+	-- optional --
+	-- to override default statsd configuration
+	-- statsd = {
+		-- address = "127.0.0.1:8125",
+		-- prefix = "logtrics.",
+		-- dogstatsd = true,
+	-- },
+
+	-- optional --
+	-- functions called with the apis of this logtrics instance, every interval or at the times of a cron expression --
+	-- scheduler = {
+		-- { every = "30s", fn = function() graphite().gauge("alive").update(1) end },
+		-- { cron = "0 9-17 * * mon-fri", fn = function() info("working hours") end },
+	-- },
+
+	-- optional --
+	-- to override the maximum number of distinct metric series of this logtrics instance
+	-- cardinality = {
+		-- maxlogtricseries = 500,
 	-- },
 
 	-- supports RE2 (https://en.wikipedia.org/wiki/RE2_(software)) regex for matching and substring extraction ---
@@ -23,8 +83,90 @@ logtrics {
 	parser = {
 		type = "re2",
 		expression = 'hello "(?P<first>[a-zA-z0-9]+)"',
+
+		-- optional --
+		-- declares the types of the extracted fields. Undeclared fields are passed as strings --
+		-- types are string, int, float, bool, duration, ip and timestamp (layout: rfc3339, unix, unix_ms or go layout) --
+		-- fields = {
+			-- latency = "int",
+			-- took = "duration",
+			-- client = "ip",
+			-- time = { type = "timestamp", layout = "rfc3339" },
+		-- },
+
+		-- optional --
+		-- what to do when a field conversion fails. Choices are "drop" (default) and "error" --
+		-- on_error = "drop",
 	},
 
+	-- custom parsing can be implemented in lua. The function returns the fields table or nil for no match --
+	-- parser = function(line)
+		-- local word = string.match(line, '^hello "(%w+)"')
+		-- if word == nil then
+			-- return nil
+		-- end
+		-- return { first = word }
+	-- end,
+	-- or
+	-- parser = { type = "lua", fn = function(line) ... end, fields = { ... } },
+
+	-- security appliance logs in ArcSight CEF and IBM LEEF formats can be parsed with "cef" and "leef" parsers --
+	-- header fields are passed as vendor, product, device_version, signature_id, name (cef) and severity --
+	-- parser = { type = "cef" },
+
+	-- multiple parsers can be chained --
+	-- "first" tries the parsers in order, the first match wins. The name of the matching parser is passed as `_parser` field --
+	-- parser = {
+		-- type = "first",
+		-- parsers = {
+			-- { name = "v2", type = "re2", expression = 'hello "(?P<first>\\w+)" (?P<second>\\w+)' },
+			-- { name = "v1", type = "re2", expression = 'hello "(?P<first>\\w+)"' },
+		-- },
+	-- },
+	-- "pipeline" runs the parsers one after another. Each stage parses the `input` field (the line by default) --
+	-- parser = {
+		-- type = "pipeline",
+		-- parsers = {
+			-- { type = "re2", expression = '^(?P<host>\\S+) (?P<message>.*)$' },
+			-- { type = "re2", input = "message", expression = 'hello "(?P<first>\\w+)"' },
+		-- },
+	-- },
+	-- "json" parses a JSON object, the keys of the nested objects are joined with a dot. The stages can declare typed fields --
+	-- parser = {
+		-- type = "pipeline",
+		-- parsers = {
+			-- { type = "re2", expression = '^(?P<host>\\S+) (?P<message>.*)$' },
+			-- { type = "json", input = "message", fields = { ["http.status"] = "int" } },
+		-- },
+	-- },
+
+	-- optional --
+	-- filters evaluated before running the parser and the handler --
+	-- filter = {
+		-- contains = "hello",                    -- all the strings must be present in the line
+		-- not_contains = { "/health", "/ping" }, -- none of the strings must be present in the line
+		-- prefix = { "<13>", "<14>" },           -- the line must start with one of the prefixes
+		-- source = { "UDP:*", "console" },       -- the source must match one of the glob patterns
+		-- fields = {                             -- predicates on the parsed fields
+			-- first = { "World", "Moon" },       -- one of the values
+			-- second = "there",                  -- equals the value
+			-- third = { ge = 10, lt = 100 },     -- eq, ne, lt, le, gt, ge
+		-- },
+	-- },
+
+	-- optional --
+	-- designates a field as the event time. The time is passed to the handler as `_time` and the received time as `_received` --
+	-- layout can be rfc3339 (default), unix, unix_ms, a strftime format (%Y-%m-%d %H:%M:%S) or a go time layout --
+	-- late (older than max_delay) and future (newer than max_ahead) events can be accepted, dropped or clamped to the received time --
+	-- timestamp = {
+		-- field = "time",
+		-- layout = "rfc3339",
+		-- max_delay = "1h",
+		-- late = "drop",
+		-- max_ahead = "1m",
+		-- future = "clamp",
+	-- },
+
 	-- this callback function will be called for log line match based on the expression. ---
 	-- @event : fields contains all the metainfo ---
 	handler = function(event)
@@ -44,11 +186,67 @@ logtrics {
 
 
 		-- example graphite apis --
-		-- graphite().counter(prefix .. ".counter.inc.value").inc(value)
-		-- graphite().counter(prefix .. ".counter.dec.value").dec(value)
-		-- graphite().timer(prefix .. ".timer.value").update(value)
-		-- graphite().gauge(prefix .. ".gauge.value").update(value)
-		-- graphite().meter(prefix .. ".meter.value").mark(value)
+		-- graphite().counter("counter.inc.value").inc(value)
+		-- graphite().counter("counter.dec.value").dec(value)
+		-- graphite().timer("timer.value").update(value)
+		-- graphite().gauge("gauge.value").update(value)
+		-- graphite().meter("meter.value").mark(value)
+		-- graphite().histogram("histogram.value").update(value)
+		-- graphite().timer("latency", nil, { unit = "ms", percentiles = { 0.5, 0.99 }, reservoir = "hdr" }).update(value)
+		-- graphite tags (graphite 1.1+) and path node sanitization --
+		-- graphite().counter("tagged", { first = event.first }).inc(value)
+		-- graphite().counter("" .. graphite().node(event.first) .. ".count").inc(value)
+
+
+		-- example prometheus apis. labels and options (help, buckets, quantiles) are optional --
+		-- prometheus().counter("logtrics_example_total", { first = event.first }, { help = "example counter" }).inc(value)
+		-- prometheus().gauge("logtrics_example_gauge").set(value)
+		-- prometheus().histogram("logtrics_example_histogram", {}, { buckets = { 1, 5, 10 } }).observe(value)
+		-- prometheus().summary("logtrics_example_summary", {}, { quantiles = { 0.5, 0.99 } }).observe(value)
+
+
+		-- example statsd apis. tags are sent in DogStatsD format if enabled --
+		-- statsd().counter("counter", { first = event.first }).inc(value)
+		-- statsd().gauge("gauge").update(value)
+		-- statsd().timer("timer").update(value)
+		-- statsd().histogram("histogram").update(value)
+		-- statsd().set("set").add(event.first)
+
+
+		-- example influx api. point(measurement, fields, tags) is written with the event time --
+		-- influx().point("logtrics_example", { value = value, first = event.first }, { source = event._source })
+
+
+		-- example backend neutral metrics api, recorded in the sinks configured in metrics.sinks --
+		-- metrics.counter("logtrics.example.count", { first = event.first }).inc()
+		-- metrics.gauge("logtrics.example.value").set(value)
+		-- metrics.histogram("logtrics.example.size").observe(value)
+		-- metrics.timer("logtrics.example.latency").update("15ms")
+		-- metrics.meter("logtrics.example.rate").mark()
+
+
+		-- example aggregation api, see aggregate.window above --
+		-- latency.add({ first = event.first }, value, event._source)
+
+
+		-- example store apis. The store is persisted in store.path of the configuration --
+		-- store.set("last_seen", event._time)
+		-- store.incr("count." .. event.first)
+		-- local seen = store.get("last_seen", 0)
+
+
+		-- example notify api. The payload table is sent as json, opts are optional --
+		-- notify.webhook("http://127.0.0.1:8080/hook", { text = "found " .. event.first })
+		-- notify.webhook("http://127.0.0.1:8080/hook", event, { template = '{"text": {{ json .first }}}', headers = { Authorization = "Bearer token" } })
+
+
+		-- example alert api, see alert.rule above --
+		-- errors.observe({ service = event.first })
+
+
+		-- example sketch apis, see sketch.distinct and sketch.topk above --
+		-- users.add(event._source)
+		-- words.add(event.first)
 		end,
 }
 
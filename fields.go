@@ -0,0 +1,242 @@
+package logtrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// PolicyDrop drops the event when a field conversion fails
+	PolicyDrop = "drop"
+
+	// PolicyError reports an error when a field conversion fails
+	PolicyError = "error"
+)
+
+type (
+	// Fields represents the typed fields declared in the parser table
+	// It converts the parsed sub strings into typed lua values
+	Fields struct {
+		Policy string
+		types  map[string]fieldType
+	}
+
+	fieldType struct {
+		kind   string
+		layout string
+	}
+)
+
+// NewFields returns a new Fields instance from the `fields` and `on_error` keys of the parser table
+// The fields declared by the parsers of a chain are merged, the on_error policy is the one of the chain
+//
+//	fields = { latency = "int", ts = { type = "timestamp", layout = "rfc3339" } }
+//	on_error = "drop" -- or "error"
+func NewFields(table *lua.LTable) (*Fields, error) {
+	f, err := newFields(table)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.merge(table); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// newFields returns the fields declared in the parser table
+func newFields(table *lua.LTable) (*Fields, error) {
+	f := &Fields{
+		Policy: PolicyDrop,
+		types:  make(map[string]fieldType),
+	}
+	switch p := table.RawGet(lua.LString("on_error")); p {
+	case lua.LNil:
+	case lua.LString(PolicyDrop), lua.LString(PolicyError):
+		f.Policy = p.String()
+	default:
+		return nil, fmt.Errorf("invalid on_error policy [%s]. Choices are %q, %q", p.String(), PolicyDrop, PolicyError)
+	}
+
+	v := table.RawGet(lua.LString("fields"))
+	if v == lua.LNil {
+		return f, nil
+	}
+	fields, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("invalid fields declaration")
+	}
+	var err error
+	fields.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		var t fieldType
+		t, err = newFieldType(v)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid type for field [%s]", k.String())
+			return
+		}
+		f.types[k.String()] = t
+	})
+	return f, err
+}
+
+// merge adds the fields declared by the parsers of the `parsers` list of a chain
+// A field declared with different types and the on_error policy of the parsers of the list are rejected
+func (f *Fields) merge(table *lua.LTable) error {
+	list, ok := table.RawGet(lua.LString("parsers")).(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	for i := 1; i <= list.Len(); i++ {
+		stage, ok := list.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		if stage.RawGet(lua.LString("on_error")) != lua.LNil {
+			return fmt.Errorf("on_error of the parser at index %d is not supported, declare it on the parser chain", i)
+		}
+		nested, err := NewFields(stage)
+		if err != nil {
+			return errors.Wrapf(err, "invalid parser at index %d", i)
+		}
+		for k, t := range nested.types {
+			if declared, ok := f.types[k]; ok && declared != t {
+				return fmt.Errorf("field [%s] declared with different types", k)
+			}
+			f.types[k] = t
+		}
+	}
+	return nil
+}
+
+func newFieldType(v lua.LValue) (fieldType, error) {
+	var t fieldType
+	switch v := v.(type) {
+	case lua.LString:
+		t.kind = string(v)
+	case *lua.LTable:
+		t.kind = v.RawGet(lua.LString("type")).String()
+		if layout := v.RawGet(lua.LString("layout")); layout != lua.LNil {
+			t.layout = layout.String()
+		}
+	default:
+		return t, fmt.Errorf("expected string or table")
+	}
+	switch t.kind {
+	case "string", "int", "float", "bool", "duration", "timestamp", "ip":
+		return t, nil
+	default:
+		return t, fmt.Errorf("unknown type [%s]", t.kind)
+	}
+}
+
+// Convert converts the sub strings to lua values as per the declared field types.
+// Fields without declaration are returned as lua strings, empty declared fields are skipped.
+func (f *Fields) Convert(substrings map[string]string) (map[string]lua.LValue, error) {
+	values := make(map[string]lua.LValue, len(substrings))
+	for k, s := range substrings {
+		t, ok := f.types[k]
+		if !ok {
+			values[k] = lua.LString(s)
+			continue
+		}
+		if s == "" {
+			continue
+		}
+		v, err := t.convert(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field [%s]", k)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (t fieldType) convert(s string) (lua.LValue, error) {
+	switch t.kind {
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(i), nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(f), nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LBool(b), nil
+	case "duration":
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(d.Nanoseconds()), nil
+	case "timestamp":
+		ts, err := parseTimestamp(t.layout, s)
+		if err != nil {
+			return nil, err
+		}
+		return unixSeconds(ts), nil
+	case "ip":
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", s)
+		}
+		return lua.LString(ip.String()), nil
+	default:
+		return lua.LString(s), nil
+	}
+}
+
+// parseTimestamp parses the timestamp as per the layout.
+// layout can be "rfc3339", "unix", "unix_ms", a strftime format or a go time layout. Defaults to "rfc3339"
+func parseTimestamp(layout, s string) (time.Time, error) {
+	if strings.Contains(layout, "%") {
+		return time.Parse(strftime(layout), s)
+	}
+	switch strings.ToLower(layout) {
+	case "", "rfc3339":
+		return time.Parse(time.RFC3339Nano, s)
+	case "unix", "epoch":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	case "unix_ms", "epoch_ms":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(time.Millisecond))), nil
+	default:
+		return time.Parse(layout, s)
+	}
+}
+
+//nolint:gochecknoglobals
+var strftimeReplacer = strings.NewReplacer(
+	"%Y", "2006", "%y", "06", "%m", "01", "%d", "02", "%e", "_2", "%j", "002",
+	"%b", "Jan", "%h", "Jan", "%B", "January", "%a", "Mon", "%A", "Monday",
+	"%H", "15", "%I", "03", "%M", "04", "%S", "05", "%f", "000000", "%p", "PM",
+	"%z", "-0700", "%Z", "MST", "%F", "2006-01-02", "%T", "15:04:05", "%%", "%",
+)
+
+// strftime converts the strftime format to go time layout
+func strftime(format string) string {
+	return strftimeReplacer.Replace(format)
+}
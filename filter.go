@@ -0,0 +1,247 @@
+package logtrics
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// Filter represents the drop/keep clauses configured in the logtrics table
+	// The line clauses are evaluated before parsing and the field predicates after parsing
+	//
+	//	filter = {
+	//		contains = "GET",                      -- all of the strings must be present
+	//		not_contains = { "/health", "/ping" }, -- none of the strings must be present
+	//		prefix = { "<13>", "<14>" },           -- the line must start with one of the prefixes
+	//		source = "UDP:*",                      -- the source must match one of the glob patterns
+	//		fields = { status = { ge = 500 }, method = { "GET", "POST" }, host = "api" },
+	//	}
+	Filter struct {
+		contains    []string
+		notContains []string
+		prefixes    []string
+		sources     []string
+		predicates  []predicate
+	}
+
+	// predicate represents the comparison of a parsed field with the values
+	predicate struct {
+		field  string
+		op     string
+		values []lua.LValue
+	}
+)
+
+// NewFilter returns a new Filter instance from the filter table
+func NewFilter(table *lua.LTable) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "contains":
+			f.contains, err = luaStrings(v)
+		case "not_contains":
+			f.notContains, err = luaStrings(v)
+		case "prefix":
+			f.prefixes, err = luaStrings(v)
+		case "source":
+			if f.sources, err = luaStrings(v); err == nil {
+				for _, p := range f.sources {
+					if _, err = path.Match(p, ""); err != nil {
+						break
+					}
+				}
+			}
+		case "fields":
+			f.predicates, err = newPredicates(v)
+		default:
+			err = fmt.Errorf("invalid key %s", k.String())
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "invalid filter [%s]", k.String())
+		}
+	})
+	return f, err
+}
+
+func newPredicates(v lua.LValue) ([]predicate, error) {
+	table, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("expected table")
+	}
+	var (
+		predicates []predicate
+		err        error
+	)
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		field := k.String()
+		t, ok := v.(*lua.LTable)
+		switch {
+		case !ok:
+			predicates = append(predicates, predicate{field: field, op: "eq", values: []lua.LValue{v}})
+		case t.Len() > 0:
+			p := predicate{field: field, op: "in"}
+			for i := 1; i <= t.Len(); i++ {
+				p.values = append(p.values, t.RawGetInt(i))
+			}
+			predicates = append(predicates, p)
+		default:
+			t.ForEach(func(op, v lua.LValue) {
+				switch op.String() {
+				case "eq", "ne", "lt", "le", "gt", "ge":
+					predicates = append(predicates, predicate{field: field, op: op.String(), values: []lua.LValue{v}})
+				default:
+					err = fmt.Errorf("invalid operator %s for field %s", op.String(), field)
+				}
+			})
+		}
+	})
+	return predicates, err
+}
+
+// Accept returns true if the line and the source satisfy the line clauses
+func (f *Filter) Accept(line, source string) bool {
+	for _, s := range f.contains {
+		if !strings.Contains(line, s) {
+			return false
+		}
+	}
+	for _, s := range f.notContains {
+		if strings.Contains(line, s) {
+			return false
+		}
+	}
+	if len(f.prefixes) > 0 && !hasPrefix(line, f.prefixes) {
+		return false
+	}
+	if len(f.sources) > 0 && !matchSource(source, f.sources) {
+		return false
+	}
+	return true
+}
+
+func hasPrefix(line string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(line, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSource(source string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the parsed fields satisfy all the field predicates
+func (f *Filter) Match(values map[string]lua.LValue) bool {
+	for _, p := range f.predicates {
+		v, ok := values[p.field]
+		if !ok || !p.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Anchors returns the strings of which at least one must be present in the accepted lines.
+// The longest `contains` string or the prefixes
+func (f *Filter) Anchors() []string {
+	var anchor string
+	for _, s := range f.contains {
+		if len(s) > len(anchor) {
+			anchor = s
+		}
+	}
+	if anchor != "" {
+		return []string{anchor}
+	}
+	for _, p := range f.prefixes {
+		if p == "" {
+			return nil
+		}
+	}
+	return f.prefixes
+}
+
+func (p predicate) match(v lua.LValue) bool {
+	switch p.op {
+	case "in":
+		for _, value := range p.values {
+			if compare(v, value) == 0 {
+				return true
+			}
+		}
+		return false
+	case "eq":
+		return compare(v, p.values[0]) == 0
+	case "ne":
+		return compare(v, p.values[0]) != 0
+	case "lt":
+		return compare(v, p.values[0]) < 0
+	case "le":
+		return compare(v, p.values[0]) <= 0
+	case "gt":
+		return compare(v, p.values[0]) > 0
+	case "ge":
+		return compare(v, p.values[0]) >= 0
+	}
+	return false
+}
+
+// compare compares the lua values numerically if both can be converted to numbers, as strings otherwise
+func compare(a, b lua.LValue) int {
+	x, xerr := luaNumber(a)
+	y, yerr := luaNumber(b)
+	if xerr == nil && yerr == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+func luaNumber(v lua.LValue) (float64, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return strconv.ParseFloat(string(v), 64)
+	}
+	return 0, fmt.Errorf("not a number")
+}
+
+// luaStrings converts a string or a list of strings to slice
+func luaStrings(v lua.LValue) ([]string, error) {
+	switch v := v.(type) {
+	case lua.LString:
+		return []string{string(v)}, nil
+	case *lua.LTable:
+		s := make([]string, 0, v.Len())
+		for i := 1; i <= v.Len(); i++ {
+			s = append(s, v.RawGetInt(i).String())
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("expected string or list of strings")
+}
@@ -0,0 +1,365 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+)
+
+const (
+	// minBackoff is the delay before the first reconnection attempt
+	minBackoff = time.Second
+	// maxBackoff is the maximum delay between the reconnection attempts
+	maxBackoff = time.Minute
+	// defaultQueueSize is the number of datapoints buffered when config.Graphite.QueueSize is not set
+	defaultQueueSize = 100000
+	// udpPacketSize is the maximum payload of the udp datagrams
+	udpPacketSize = 1400
+	// pickleBatchSize is the maximum number of datapoints of a pickle message
+	pickleBatchSize = 500
+)
+
+type (
+	// client sends the datapoints to graphite over a persistent connection
+	// The datapoints are queued until they are sent. When graphite is unreachable the client reconnects
+	// with an exponential backoff and the queue keeps the datapoints with their original timestamps.
+	// When the queue is full, the oldest datapoints are moved to the spool file or dropped
+	client struct {
+		transport string
+		address   string
+		timeout   time.Duration
+		size      int
+		spool     string
+		logger    zerolog.Logger
+
+		mu      sync.Mutex
+		conn    net.Conn
+		queue   []string
+		backoff time.Duration
+		retry   time.Time
+		dropped int
+	}
+)
+
+// newClient returns a new client instance for the graphite configuration
+func newClient(conf *config.Graphite, address string, timeout time.Duration, logger zerolog.Logger) (*client, error) {
+	c := &client{
+		transport: conf.Transport,
+		address:   address,
+		timeout:   timeout,
+		size:      conf.QueueSize,
+		logger:    logger,
+	}
+	if c.transport == "" {
+		c.transport = "tcp"
+	}
+	if c.size <= 0 {
+		c.size = defaultQueueSize
+	}
+	switch c.transport {
+	case "tcp", "pickle":
+		if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			return nil, errors.Wrap(err, "graphite connection failed")
+		}
+	case "udp":
+		if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+			return nil, errors.Wrap(err, "graphite connection failed")
+		}
+	default:
+		return nil, fmt.Errorf(`invalid graphite transport %s. Choices are "tcp", "udp", "pickle"`, c.transport)
+	}
+	if conf.Spool != "" {
+		if err := os.MkdirAll(conf.Spool, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create the graphite spool directory")
+		}
+		c.spool = filepath.Join(conf.Spool, fmt.Sprintf("graphite-%s.spool", strings.NewReplacer(":", "-", "/", "-").Replace(address)))
+	}
+	return c, nil
+}
+
+// send queues the plaintext lines and sends the queued datapoints
+// The datapoints not sent are kept for the next call
+func (c *client) send(lines []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enqueue(lines)
+	if len(c.queue) == 0 && !c.spooled() {
+		return nil
+	}
+	if now := time.Now(); now.Before(c.retry) {
+		return fmt.Errorf("graphite unreachable, %d datapoints queued, reconnecting in %s", len(c.queue), c.retry.Sub(now).Round(time.Second))
+	}
+	for {
+		if err := c.drain(); err != nil {
+			c.fail()
+			return errors.Wrapf(err, "%d datapoints queued", len(c.queue))
+		}
+		// the spooled datapoints are replayed once the queue is sent
+		if !c.unspool() {
+			return nil
+		}
+	}
+}
+
+// close sends the queued datapoints and closes the connection
+// The datapoints which can not be sent are written to the spool file
+func (c *client) close() error {
+	err := c.send(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) > 0 && c.spool != "" {
+		if serr := c.write(c.queue); serr != nil {
+			c.logger.Error().Err(serr).Msg("failed to spool graphite datapoints")
+		} else {
+			c.queue = nil
+		}
+	}
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// enqueue appends the lines to the queue. The oldest datapoints exceeding the queue size are spooled or dropped.
+// The caller must hold the lock
+func (c *client) enqueue(lines []string) {
+	c.queue = append(c.queue, lines...)
+	excess := len(c.queue) - c.size
+	if excess <= 0 {
+		return
+	}
+	if c.spool != "" {
+		err := c.write(c.queue[:excess])
+		if err == nil {
+			c.queue = append(c.queue[:0], c.queue[excess:]...)
+			return
+		}
+		c.logger.Error().Err(err).Msg("failed to spool graphite datapoints")
+	}
+	c.dropped += excess
+	c.queue = append(c.queue[:0], c.queue[excess:]...)
+	c.logger.Warn().Int("dropped", excess).Int("total", c.dropped).Msg("graphite queue full, dropping the oldest datapoints")
+}
+
+// drain sends the queued datapoints, the queue keeps the datapoints not sent. The caller must hold the lock
+func (c *client) drain() error {
+	if c.conn == nil || !c.alive() {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+	batch := c.batch()
+	for len(c.queue) > 0 {
+		n, payload, err := batch(c.queue)
+		if err != nil {
+			// invalid datapoints are dropped so they do not block the queue
+			c.logger.Error().Err(err).Msg("invalid graphite datapoint")
+		} else {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+			if _, err := c.conn.Write(payload); err != nil {
+				return err
+			}
+		}
+		c.queue = c.queue[n:]
+	}
+	c.queue = nil
+	c.backoff = 0
+	return nil
+}
+
+// connect opens the connection to graphite. The caller must hold the lock
+func (c *client) connect() error {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	network := "tcp"
+	if c.transport == "udp" {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, c.address, c.timeout)
+	if err != nil {
+		return err
+	}
+	if c.backoff > 0 {
+		c.logger.Info().Str("address", c.address).Msg("graphite reconnected")
+	}
+	c.conn = conn
+	return nil
+}
+
+// alive returns false if the tcp connection was closed by graphite. The caller must hold the lock
+func (c *client) alive() bool {
+	if c.transport == "udp" {
+		return true
+	}
+	// graphite never writes, a read returns EOF or an error when the connection is closed
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.conn.Read(make([]byte, 1))
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// fail closes the connection and schedules the next reconnection attempt. The caller must hold the lock
+func (c *client) fail() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	if c.backoff == 0 {
+		c.backoff = minBackoff
+	} else if c.backoff *= 2; c.backoff > maxBackoff {
+		c.backoff = maxBackoff
+	}
+	c.retry = time.Now().Add(c.backoff)
+}
+
+// batch returns the function encoding the next payload of the transport with the number of datapoints encoded
+func (c *client) batch() func([]string) (int, []byte, error) {
+	switch c.transport {
+	case "pickle":
+		return pickle
+	case "udp":
+		return func(lines []string) (int, []byte, error) {
+			return plaintext(lines, udpPacketSize)
+		}
+	default:
+		return func(lines []string) (int, []byte, error) {
+			return plaintext(lines, 0)
+		}
+	}
+}
+
+// plaintext returns the lines in plaintext protocol within the payload size, unlimited if 0
+func plaintext(lines []string, size int) (int, []byte, error) {
+	var b bytes.Buffer
+	n := 0
+	for _, line := range lines {
+		if size > 0 && n > 0 && b.Len()+len(line)+1 > size {
+			break
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+		n++
+	}
+	return n, b.Bytes(), nil
+}
+
+// pickle returns the next batch of datapoints in pickle protocol, a 4 bytes big endian length
+// followed by the pickled list of (path, (timestamp, value)) tuples
+func pickle(lines []string) (int, []byte, error) {
+	if len(lines) > pickleBatchSize {
+		lines = lines[:pickleBatchSize]
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0x80, 0x02, ']', '('}) // PROTO 2, EMPTY_LIST, MARK
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return i + 1, nil, fmt.Errorf("invalid plaintext line %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return i + 1, nil, errors.Wrapf(err, "invalid value of %s", fields[0])
+		}
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || ts > math.MaxInt32 || ts < math.MinInt32 {
+			return i + 1, nil, fmt.Errorf("invalid timestamp of %s", fields[0])
+		}
+		// BINUNICODE path
+		b.WriteByte('X')
+		_ = binary.Write(&b, binary.LittleEndian, uint32(len(fields[0])))
+		b.WriteString(fields[0])
+		// BININT timestamp, BINFLOAT value, TUPLE2, TUPLE2
+		b.WriteByte('J')
+		_ = binary.Write(&b, binary.LittleEndian, int32(ts))
+		b.WriteByte('G')
+		_ = binary.Write(&b, binary.BigEndian, value)
+		b.Write([]byte{0x86, 0x86})
+	}
+	b.Write([]byte{'e', '.'}) // APPENDS, STOP
+	payload := make([]byte, 4, 4+b.Len())
+	binary.BigEndian.PutUint32(payload, uint32(b.Len()))
+	return len(lines), append(payload, b.Bytes()...), nil
+}
+
+// spooled returns true if the spool file has datapoints. The caller must hold the lock
+func (c *client) spooled() bool {
+	if c.spool == "" {
+		return false
+	}
+	info, err := os.Stat(c.spool)
+	return err == nil && info.Size() > 0
+}
+
+// write appends the lines to the spool file. The caller must hold the lock
+func (c *client) write(lines []string) error {
+	f, err := os.OpenFile(c.spool, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		_, _ = w.WriteString(line + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// unspool moves the oldest spooled datapoints to the queue, within the queue size.
+// It returns false if the spool file is empty. The caller must hold the lock
+func (c *client) unspool() bool {
+	if !c.spooled() {
+		return false
+	}
+	data, err := ioutil.ReadFile(c.spool)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to read the graphite spool")
+		return false
+	}
+	var rest bytes.Buffer
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if len(c.queue) < c.size {
+				c.queue = append(c.queue, line)
+			} else {
+				rest.WriteString(line + "\n")
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := ioutil.WriteFile(c.spool, rest.Bytes(), 0644); err != nil {
+		// the spooled datapoints are kept in the file only, to not replay them twice
+		c.logger.Error().Err(err).Msg("failed to rewrite the graphite spool")
+		c.queue = nil
+		return false
+	}
+	c.logger.Info().Int("datapoints", len(c.queue)).Msg("replaying spooled graphite datapoints")
+	return len(c.queue) > 0
+}
@@ -2,75 +2,139 @@
 package graphite
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"strings"
+	"sync"
 	"time"
 
-	graphite "github.com/cyberdelia/go-metrics-graphite"
-	"github.com/pkg/errors"
 	goMetrics "github.com/rcrowley/go-metrics"
 	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/cardinality"
 	"github.com/smitajit/logtrics/config"
 	lua "github.com/yuin/gopher-lua"
 )
 
 type (
 	// Graphite represents the graphite module of the application
-	// It store the graphite registry configs and provide method for metrics operations
+	// It records the metrics in the target shared by the graphite instances with the same configuration,
+	// with its own clock and limiter
 	Graphite struct {
+		*target
+		// clock returns the time used for the event time aggregation
+		clock func() time.Time
+		// limiter limits the number of distinct series
+		limiter *cardinality.Limiter
+		// prefix returns the metric name with the prefix, for the lua apis
+		prefix func(name string) string
+	}
+
+	// target stores the metrics of a graphite configuration and publishes them in regular interval
+	target struct {
 		registry goMetrics.Registry
 		logger   zerolog.Logger
 		conf     *config.Configuration
+		address  string
+		interval time.Duration
+		// client sends the datapoints to graphite
+		client *client
+		// done stops the publishing of the metrics
+		done    chan struct{}
+		stopped chan struct{}
+
+		mu sync.Mutex
+		// buckets are the event time aggregations per interval start time (unix seconds)
+		buckets map[int64]*bucket
+		// discard collects the metrics of events older than the lateness
+		discard goMetrics.Registry
+		// updated is the last update time of the series, used for the expiry
+		updated map[string]time.Time
+		// limiters are the limiters of the graphite instances, the expired series are removed from them
+		limiters map[*cardinality.Limiter]struct{}
+		// defaults are the options of the configuration
+		defaults *options
+		// options are the options of the timers and histograms created with the lua options
+		options map[string]*options
+	}
+
+	// bucket is the registry of the metrics of an event time interval
+	bucket struct {
+		registry goMetrics.Registry
+		dirty    bool
 	}
 
 	// Counter represents counter metrics
+	// The metrics of the lua apis are resolved on each update, so a stored reference records in the interval of the event time
 	Counter struct {
-		name    string
-		counter goMetrics.Counter
+		graphite *Graphite
+		name     string
 	}
 
 	// Timer represents timer metrics
 	Timer struct {
-		name  string
-		timer goMetrics.Timer
+		graphite *Graphite
+		name     string
+		// constructor creates the timer with the reservoir of the options
+		constructor func() goMetrics.Timer
+		// unit is the unit of the lua values
+		unit time.Duration
+	}
+
+	// Histogram represents histogram metrics
+	Histogram struct {
+		graphite *Graphite
+		name     string
+		// constructor creates the histogram with the reservoir of the options
+		constructor func() goMetrics.Histogram
 	}
 
 	// Meter represents the meter metrics
 	Meter struct {
-		Name  string
-		meter goMetrics.Meter
+		graphite *Graphite
+		Name     string
 	}
 
 	// Gauge represents gauge metrics
 	Gauge struct {
-		name  string
-		gauge goMetrics.Gauge
+		graphite *Graphite
+		name     string
 	}
 )
 
-// NewGraphite returns a new graphite instance
+// newTarget returns a new target instance
 // It starts the thread which published the metrics in regular interval (config.Graphite.Interval)
-func NewGraphite(conf *config.Configuration, state *lua.LState, logger zerolog.Logger) (*Graphite, error) {
-	var (
-		registry = goMetrics.NewRegistry()
-		interval = time.Second * time.Duration(conf.Graphite.Interval)
-		address  = fmt.Sprintf("%s:%d", conf.Graphite.Host, conf.Graphite.Port)
-	)
-
-	addr, err := net.ResolveTCPAddr("tcp", address)
+// When config.Graphite.EventTime is enabled the metrics are aggregated per interval of the event time
+// and published with the interval time
+func newTarget(conf *config.Configuration, logger zerolog.Logger) (*target, error) {
+	if conf.Graphite.Interval <= 0 {
+		return nil, fmt.Errorf("invalid graphite interval %d", conf.Graphite.Interval)
+	}
+	t := &target{
+		conf:     conf,
+		logger:   logger,
+		registry: goMetrics.NewRegistry(),
+		address:  fmt.Sprintf("%s:%d", conf.Graphite.Host, conf.Graphite.Port),
+		interval: time.Second * time.Duration(conf.Graphite.Interval),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		buckets:  make(map[int64]*bucket),
+		discard:  goMetrics.NewRegistry(),
+		updated:  make(map[string]time.Time),
+		limiters: make(map[*cardinality.Limiter]struct{}),
+		options:  make(map[string]*options),
+	}
+	defaults, err := newOptions(conf.Graphite)
 	if err != nil {
-		return nil, errors.Wrap(err, "graphite connection failed")
+		return nil, err
 	}
-	fmt.Println(addr)
-
-	c := graphite.Config{
-		Addr:          addr,
-		Registry:      registry,
-		FlushInterval: time.Duration(conf.Graphite.Interval),
-		DurationUnit:  time.Second,
-		Percentiles:   []float64{0.5, 0.75, 0.95, 0.99, 0.999},
+	t.defaults = defaults
+	client, err := newClient(conf.Graphite, t.address, t.interval, logger)
+	if err != nil {
+		return nil, err
 	}
+	t.client = client
 
 	if conf.Graphite.Debug {
 		logger.Debug().
@@ -78,32 +142,222 @@ func NewGraphite(conf *config.Configuration, state *lua.LState, logger zerolog.L
 			Int("graphite.port", conf.Graphite.Port).
 			Int("graphite.interval", conf.Graphite.Interval).
 			Bool("graphite.debug", conf.Graphite.Debug).
+			Bool("graphite.eventtime", conf.Graphite.EventTime).
+			Str("graphite.transport", client.transport).
+			Int("graphite.queuesize", client.size).
+			Str("graphite.spool", conf.Graphite.Spool).
 			Msg("graphite configuration")
-		go goMetrics.Log(registry, interval, log.New(logger, "metrics", log.Lmicroseconds))
+		go goMetrics.Log(t.registry, t.interval, log.New(logger, "metrics", log.Lmicroseconds))
 	}
-	go func() {
-		for range time.Tick(interval) {
-			if err := graphite.Once(c); err != nil {
-				logger.Error().Err(err).Msg("failed to send graphite metrics")
+	go t.run()
+	return t, nil
+}
+
+// run publishes the metrics every interval until the target is closed
+func (t *target) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if err := t.flush(now); err != nil {
+				t.logger.Error().Err(err).Msg("failed to send graphite metrics")
 			}
 		}
-	}()
-	g := &Graphite{
-		conf:     conf,
-		logger:   logger,
-		registry: registry,
 	}
+}
+
+// close stops the publishing, sends the metrics a last time and closes the connection
+// In event time mode, all the updated intervals are sent
+func (t *target) close() error {
+	close(t.done)
+	<-t.stopped
+	if err := t.flush(time.Now()); err != nil {
+		t.logger.Error().Err(err).Msg("failed to send graphite metrics")
+	}
+	return t.client.close()
+}
+
+// Registry returns the registry for the current time of the clock
+// In event time mode, the registry of the interval is returned
+func (g *Graphite) Registry() goMetrics.Registry {
+	if !g.conf.Graphite.EventTime {
+		return g.registry
+	}
+	start := g.clock().Truncate(g.interval).Unix()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.buckets[start]
+	if !ok {
+		if start < g.oldest(time.Now()) {
+			g.logger.Debug().Int64("interval", start).Msg("graphite: event older than lateness, discarding metrics")
+			return g.discard
+		}
+		b = &bucket{registry: goMetrics.NewRegistry()}
+		g.buckets[start] = b
+	}
+	b.dirty = true
+	return b.registry
+}
+
+// oldest returns the start time of the oldest interval kept for late events
+func (t *target) oldest(now time.Time) int64 {
+	lateness := t.conf.Graphite.Lateness
+	if lateness <= 0 {
+		lateness = 1
+	}
+	return now.Truncate(t.interval).Add(-time.Duration(lateness) * t.interval).Unix()
+}
+
+// flush sends the metrics to graphite
+// In event time mode, the intervals updated since the last flush are sent with the interval time
+// and the intervals older than the lateness are evicted. Otherwise the metrics not updated for the expiry are removed
+func (t *target) flush(now time.Time) error {
+	if !t.conf.Graphite.EventTime {
+		t.expire(now)
+		return t.send(func(w io.Writer) {
+			t.write(w, t.registry, now.Unix())
+		})
+	}
+
+	dirty := make(map[int64]goMetrics.Registry)
+	var evicted []goMetrics.Registry
+	oldest := t.oldest(now)
+	t.mu.Lock()
+	for start, b := range t.buckets {
+		if b.dirty {
+			dirty[start] = b.registry
+			b.dirty = false
+		}
+		if start < oldest {
+			evicted = append(evicted, b.registry)
+			delete(t.buckets, start)
+		}
+	}
+	t.mu.Unlock()
+	t.discard.UnregisterAll()
+
+	err := t.send(func(w io.Writer) {
+		for start, registry := range dirty {
+			t.write(w, registry, start)
+		}
+	})
+	// the metrics of the evicted intervals are unregistered once written, which stops the meters
+	for _, registry := range evicted {
+		registry.UnregisterAll()
+	}
+	return err
+}
+
+// expiring returns true if the metrics not updated for config.Graphite.Expiry intervals are removed
+// The event time intervals are evicted after the lateness instead
+func (t *target) expiring() bool {
+	return t.conf.Graphite.Expiry > 0 && !t.conf.Graphite.EventTime
+}
+
+// expire removes the metrics not updated for config.Graphite.Expiry intervals
+// The series are removed under the lock of metric, so an update never records in a removed metric
+func (t *target) expire(now time.Time) {
+	if !t.expiring() {
+		return
+	}
+	ttl := time.Duration(t.conf.Graphite.Expiry) * t.interval
+	var (
+		expired  []string
+		limiters []*cardinality.Limiter
+	)
+	t.mu.Lock()
+	for series, updated := range t.updated {
+		if now.Sub(updated) > ttl {
+			expired = append(expired, series)
+			delete(t.updated, series)
+			delete(t.options, series)
+			t.registry.Unregister(series)
+		}
+	}
+	for l := range t.limiters {
+		limiters = append(limiters, l)
+	}
+	t.mu.Unlock()
+	for _, series := range expired {
+		for _, l := range limiters {
+			l.Forget("graphite:" + series)
+		}
+	}
+	if len(expired) > 0 {
+		t.logger.Debug().Int("series", len(expired)).Msg("graphite: removed expired metrics")
+	}
+}
+
+// option returns the options of the series
+func (t *target) option(series string) *options {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o, ok := t.options[series]; ok {
+		return o
+	}
+	return t.defaults
+}
+
+// setOption records the options of the series, the options of the first call are kept
+func (t *target) setOption(series string, o *options) {
+	if o == t.defaults {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.options[series]; !ok {
+		t.options[series] = o
+	}
+}
 
-	return g, nil
+// send queues the metrics written by fn and sends the queued metrics to graphite
+func (t *target) send(fn func(w io.Writer)) error {
+	var b bytes.Buffer
+	fn(&b)
+	var lines []string
+	if b.Len() > 0 {
+		lines = strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	}
+	return t.client.send(lines)
+}
+
+// SetPrefix sets the function returning the metric names of the lua apis with the prefix
+func (g *Graphite) SetPrefix(prefix func(name string) string) {
+	g.prefix = prefix
+}
+
+// name returns the metric name with the prefix
+func (g *Graphite) name(name string) string {
+	if g.prefix == nil {
+		return name
+	}
+	return g.prefix(name)
+}
+
+// LAPINode is the lua binding for node function on the graphite instance
+// It returns the value usable as a single node of the metric path
+//
+//	graphite().counter("requests." .. graphite().node(event.host) .. ".count")
+func (g *Graphite) LAPINode(state *lua.LState) int {
+	state.Push(lua.LString(SanitizeNode(state.ToString(1))))
+	return 1
 }
 
 // LAPICounter is lua binding for counter function on the graphite instance
+// The optional second argument is the tags table
+//
+//	graphite().counter("requests", { method = "GET", status = "200" }).inc(1) -- requests.count;method=GET;status=200
 func (g *Graphite) LAPICounter(state *lua.LState) int {
 	metricname := state.ToString(1)
 	if metricname == "" {
 		state.RaiseError("graphite: invalid counter name")
 	}
-	c := g.counter(metricname)
+	c := g.counter(Series(g.name(metricname), luaTags(state, 2)))
 	table := state.NewTable()
 	state.SetField(table, "inc", state.NewFunction(c.LAPIInc))
 	state.SetField(table, "dec", state.NewFunction(c.LAPIDec))
@@ -117,7 +371,7 @@ func (g *Graphite) LAPIGauge(state *lua.LState) int {
 	if metricname == "" {
 		state.RaiseError("graphite: invalid gauge name")
 	}
-	m := g.gauge(metricname)
+	m := g.gauge(Series(g.name(metricname), luaTags(state, 2)))
 	table := state.NewTable()
 	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
 	state.Push(table)
@@ -125,12 +379,32 @@ func (g *Graphite) LAPIGauge(state *lua.LState) int {
 }
 
 // LAPITimer is the lua binding for timer function call on the graphite instance
+// The optional third argument is the options table, the percentiles, the units and the reservoir
+// of the configuration are used otherwise
+//
+//	graphite().timer("latency", nil, { unit = "ms", outputunit = "ms", percentiles = { 0.5, 0.99 }, reservoir = "hdr" }).update(12.5)
 func (g *Graphite) LAPITimer(state *lua.LState) int {
 	metricname := state.ToString(1)
 	if metricname == "" {
 		state.RaiseError("graphite: invalid timer name")
 	}
-	m := g.timer(metricname)
+	m := g.timer(Series(g.name(metricname), luaTags(state, 2)), luaOptions(state, 3, g.defaults))
+	table := state.NewTable()
+	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
+	state.Push(table)
+	return 1
+}
+
+// LAPIHistogram is the lua binding for histogram function call on the graphite instance
+// The optional third argument is the options table, the percentiles and the reservoir are used
+//
+//	graphite().histogram("response.size", nil, { percentiles = { 0.5, 0.9 }, reservoir = "uniform" }).update(event.size)
+func (g *Graphite) LAPIHistogram(state *lua.LState) int {
+	metricname := state.ToString(1)
+	if metricname == "" {
+		state.RaiseError("graphite: invalid histogram name")
+	}
+	m := g.histogram(Series(g.name(metricname), luaTags(state, 2)), luaOptions(state, 3, g.defaults))
 	table := state.NewTable()
 	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
 	state.Push(table)
@@ -143,76 +417,141 @@ func (g *Graphite) LAPIMeter(state *lua.LState) int {
 	if metricname == "" {
 		state.RaiseError("graphite: invalid meter name")
 	}
-	m := g.meter(metricname)
+	m := g.meter(Series(g.name(metricname), luaTags(state, 2)))
 	table := state.NewTable()
 	state.SetField(table, "mark", state.NewFunction(m.LAPIMark))
 	state.Push(table)
 	return 1
 }
 
-// timer return the timer instance for the metrics name
-func (g *Graphite) timer(name string) *Timer {
-	return &Timer{
-		name:  name,
-		timer: goMetrics.GetOrRegisterTimer(name, g.registry),
+// limit returns the series when it is accepted by the limiter, the overflow series of the kind otherwise
+func (g *Graphite) limit(series, kind string) string {
+	if g.limiter.Allow("graphite:" + series) {
+		return series
 	}
+	return SanitizeName(g.limiter.Overflow()) + "." + kind
+}
+
+// get returns the metric of the series, registered with the constructor if not present
+// The overflow series is used when the series is rejected by the limiter
+func (g *Graphite) get(series, kind string, constructor interface{}) (string, interface{}) {
+	series = g.limit(series, kind)
+	return series, g.metric(series, constructor)
+}
+
+// metric returns the metric of the series in the registry of the current clock time,
+// registered with the constructor if not present
+// With the expiry, the update time of the series is recorded and an expired series gets a new metric
+func (g *Graphite) metric(series string, constructor interface{}) interface{} {
+	if !g.expiring() {
+		return g.Registry().GetOrRegister(series, constructor)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.updated[series] = time.Now()
+	return g.registry.GetOrRegister(series, constructor)
+}
+
+// timer return the timer instance for the metrics name, created with the reservoir of the options
+func (g *Graphite) timer(name string, o *options) *Timer {
+	name, _ = g.get(name, "timer", o.timer)
+	g.setOption(name, o)
+	return &Timer{graphite: g, name: name, constructor: o.timer, unit: o.unit}
+}
+
+// histogram returns the histogram instance for the metrics name, created with the reservoir of the options
+func (g *Graphite) histogram(name string, o *options) *Histogram {
+	name, _ = g.get(name, "histogram", o.histogram)
+	g.setOption(name, o)
+	return &Histogram{graphite: g, name: name, constructor: o.histogram}
 }
 
 // gauge returns the gauge for the metric name
 func (g *Graphite) gauge(name string) *Gauge {
-	return &Gauge{
-		name:  name,
-		gauge: goMetrics.GetOrRegisterGauge(name, g.registry),
-	}
+	name, _ = g.get(name, "gauge", goMetrics.NewGauge)
+	return &Gauge{graphite: g, name: name}
 }
 
 // counter returns the counter for the metrics name
 func (g *Graphite) counter(name string) *Counter {
-	return &Counter{
-		name:    name,
-		counter: goMetrics.GetOrRegisterCounter(name, g.registry),
-	}
+	name, _ = g.get(name, "counter", goMetrics.NewCounter)
+	return &Counter{graphite: g, name: name}
 }
 
 // counter returns the counter for the metrics name
 func (g *Graphite) meter(name string) *Meter {
-	return &Meter{
-		Name:  name,
-		meter: goMetrics.GetOrRegisterMeter(name, g.registry),
-	}
+	name, _ = g.get(name, "meter", goMetrics.NewMeter)
+	return &Meter{graphite: g, Name: name}
+}
+
+// Counter returns the counter of the series
+func (g *Graphite) Counter(series string) goMetrics.Counter {
+	_, metric := g.get(series, "counter", goMetrics.NewCounter)
+	return metric.(goMetrics.Counter)
+}
+
+// GaugeFloat64 returns the float gauge of the series
+func (g *Graphite) GaugeFloat64(series string) goMetrics.GaugeFloat64 {
+	_, metric := g.get(series, "gauge", goMetrics.NewGaugeFloat64)
+	return metric.(goMetrics.GaugeFloat64)
+}
+
+// Histogram returns the histogram of the series
+func (g *Graphite) Histogram(series string) goMetrics.Histogram {
+	_, metric := g.get(series, "histogram", g.defaults.histogram)
+	return metric.(goMetrics.Histogram)
+}
+
+// Timer returns the timer of the series
+func (g *Graphite) Timer(series string) goMetrics.Timer {
+	_, metric := g.get(series, "timer", g.defaults.timer)
+	return metric.(goMetrics.Timer)
+}
+
+// Meter returns the meter of the series
+func (g *Graphite) Meter(series string) goMetrics.Meter {
+	_, metric := g.get(series, "meter", goMetrics.NewMeter)
+	return metric.(goMetrics.Meter)
 }
 
 // LAPIUpdate is lua binding for update function call on the timer instance
+// The value is in the unit of the timer, nanoseconds by default
 func (t *Timer) LAPIUpdate(state *lua.LState) int {
-	i := state.ToInt64(1)
-	t.timer.Update(time.Duration(i))
+	v := float64(state.ToNumber(1))
+	t.graphite.metric(t.name, t.constructor).(goMetrics.Timer).Update(time.Duration(v * float64(t.unit)))
 	return 1
 }
 
+// LAPIUpdate is lua binding for update function call on the histogram instance
+func (h *Histogram) LAPIUpdate(state *lua.LState) int {
+	h.graphite.metric(h.name, h.constructor).(goMetrics.Histogram).Update(state.ToInt64(1))
+	return 0
+}
+
 // LAPIUpdate is lua binding for update function call on the gauge instance
 func (g *Gauge) LAPIUpdate(state *lua.LState) int {
 	i := state.ToInt64(1)
-	g.gauge.Update(i)
+	g.graphite.metric(g.name, goMetrics.NewGauge).(goMetrics.Gauge).Update(i)
 	return 1
 }
 
 // LAPIMark is the lua binding for mark function call on the meter instance
 func (g *Meter) LAPIMark(state *lua.LState) int {
 	i := state.ToInt64(1)
-	g.meter.Mark(i)
+	g.graphite.metric(g.Name, goMetrics.NewMeter).(goMetrics.Meter).Mark(i)
 	return 1
 }
 
 // LAPIInc is the lua binding for inc function call
 func (c *Counter) LAPIInc(state *lua.LState) int {
 	i := state.ToInt64(1)
-	c.counter.Inc(i)
+	c.graphite.metric(c.name, goMetrics.NewCounter).(goMetrics.Counter).Inc(i)
 	return 0
 }
 
 // LAPIDec is the lua call back for dec function call
 func (c *Counter) LAPIDec(state *lua.LState) int {
 	i := state.ToInt64(1)
-	c.counter.Dec(i)
+	c.graphite.metric(c.name, goMetrics.NewCounter).(goMetrics.Counter).Dec(i)
 	return 0
 }
@@ -0,0 +1,78 @@
+package graphite
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/cardinality"
+	"github.com/smitajit/logtrics/config"
+)
+
+type (
+	// Manager shares a target, its registry and its connection, between the graphite instances with the same configuration
+	// The metrics with the same name are aggregated across the graphite instances of a target
+	Manager struct {
+		logger zerolog.Logger
+
+		mu      sync.Mutex
+		targets map[string]*target
+		closed  bool
+	}
+)
+
+// NewManager returns a new Manager instance
+func NewManager(logger zerolog.Logger) *Manager {
+	return &Manager{
+		logger:  logger,
+		targets: make(map[string]*target),
+	}
+}
+
+// Graphite returns a new graphite instance recording the metrics in the target of config.Graphite
+// The target is created on the first call for the configuration.
+// In event time mode the metrics are aggregated per interval of the time returned by the clock,
+// the series rejected by the limiter are recorded in the overflow series
+func (m *Manager) Graphite(conf *config.Configuration, limiter *cardinality.Limiter, clock func() time.Time) (*Graphite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, fmt.Errorf("graphite is closed")
+	}
+	// the configurations are compared by their values
+	key := fmt.Sprintf("%+v", *conf.Graphite)
+	t, ok := m.targets[key]
+	if !ok {
+		var err error
+		t, err = newTarget(conf, m.logger)
+		if err != nil {
+			return nil, err
+		}
+		m.targets[key] = t
+	}
+	if limiter != nil {
+		t.mu.Lock()
+		t.limiters[limiter] = struct{}{}
+		t.mu.Unlock()
+	}
+	return &Graphite{target: t, clock: clock, limiter: limiter}, nil
+}
+
+// Close sends the metrics of the targets a last time and closes their connections
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var err error
+	for _, t := range m.targets {
+		if terr := t.close(); terr != nil {
+			m.logger.Error().Err(terr).Str("address", t.address).Msg("failed to send the last graphite metrics")
+			err = terr
+		}
+	}
+	return err
+}
@@ -0,0 +1,376 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	goMetrics "github.com/rcrowley/go-metrics"
+	"github.com/smitajit/logtrics/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultReservoirSize is the size of the uniform and exponentially decaying reservoirs
+	defaultReservoirSize = 1028
+	// hdrMax is the highest value tracked by the hdr reservoirs, an hour for the timers in nanoseconds
+	hdrMax = int64(time.Hour)
+	// hdrSigfigs is the number of significant figures of the values of the hdr reservoirs
+	hdrSigfigs = 2
+)
+
+//nolint:gochecknoglobals
+var defaultPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+type (
+	// options are the aggregation options of the timers and histograms
+	options struct {
+		percentiles []float64
+		// unit is the unit of the values of the lua timers
+		unit time.Duration
+		// output is the unit of the timer values sent to graphite
+		output        time.Duration
+		reservoir     string
+		reservoirSize int
+	}
+
+	// hdrSample is a sample recording all the values in a hdr histogram
+	// It implements the go-metrics Sample interface, Values is not supported
+	hdrSample struct {
+		mu        sync.Mutex
+		histogram *hdrhistogram.Histogram
+		sum       int64
+	}
+
+	// hdrHistogram is a go-metrics Histogram of a hdrSample
+	// The go-metrics histograms only support the snapshots of the sampling reservoirs
+	hdrHistogram struct {
+		*hdrSample
+	}
+
+	// hdrTimer is a go-metrics Timer recording the durations in a hdrHistogram
+	hdrTimer struct {
+		*hdrHistogram
+		meter goMetrics.Meter
+	}
+)
+
+// newOptions returns the options of the graphite configuration
+func newOptions(conf *config.Graphite) (*options, error) {
+	o := &options{
+		percentiles:   conf.Percentiles,
+		reservoir:     conf.Reservoir,
+		reservoirSize: conf.ReservoirSize,
+		unit:          time.Nanosecond,
+		output:        time.Second,
+	}
+	if len(o.percentiles) == 0 {
+		o.percentiles = defaultPercentiles
+	}
+	if o.reservoir == "" {
+		o.reservoir = "expdecay"
+	}
+	if o.reservoirSize <= 0 {
+		o.reservoirSize = defaultReservoirSize
+	}
+	var err error
+	if conf.TimerUnit != "" {
+		if o.unit, err = parseUnit(conf.TimerUnit); err != nil {
+			return nil, err
+		}
+	}
+	if conf.OutputUnit != "" {
+		if o.output, err = parseUnit(conf.OutputUnit); err != nil {
+			return nil, err
+		}
+	}
+	return o, o.validate()
+}
+
+// validate returns an error if the reservoir or the percentiles are invalid
+func (o *options) validate() error {
+	switch o.reservoir {
+	case "uniform", "expdecay", "hdr":
+	default:
+		return fmt.Errorf(`invalid reservoir %s. Choices are "uniform", "expdecay", "hdr"`, o.reservoir)
+	}
+	for _, p := range o.percentiles {
+		if p <= 0 || p > 1 {
+			return fmt.Errorf("invalid percentile %v, must be in (0, 1]", p)
+		}
+	}
+	return nil
+}
+
+// parseUnit returns the duration of the unit. e.g. ns, us, ms, s
+func parseUnit(unit string) (time.Duration, error) {
+	d, err := time.ParseDuration("1" + unit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unit %s", unit)
+	}
+	return d, nil
+}
+
+// sample returns a new sampling reservoir, uniform or exponentially decaying
+func (o *options) sample() goMetrics.Sample {
+	if o.reservoir == "uniform" {
+		return goMetrics.NewUniformSample(o.reservoirSize)
+	}
+	return goMetrics.NewExpDecaySample(o.reservoirSize, 0.015)
+}
+
+// timer returns a new timer with the reservoir
+func (o *options) timer() goMetrics.Timer {
+	if o.reservoir == "hdr" {
+		return &hdrTimer{hdrHistogram: newHdrHistogram(), meter: goMetrics.NewMeter()}
+	}
+	return goMetrics.NewCustomTimer(goMetrics.NewHistogram(o.sample()), goMetrics.NewMeter())
+}
+
+// histogram returns a new histogram with the reservoir
+func (o *options) histogram() goMetrics.Histogram {
+	if o.reservoir == "hdr" {
+		return newHdrHistogram()
+	}
+	return goMetrics.NewHistogram(o.sample())
+}
+
+// luaOptions returns the options overridden by the options table argument of the timer and histogram functions
+//
+//	graphite().timer("latency", nil, { unit = "ms", outputunit = "ms", percentiles = { 0.5, 0.99 }, reservoir = "hdr" })
+func luaOptions(state *lua.LState, n int, defaults *options) *options {
+	t := state.OptTable(n, nil)
+	if t == nil {
+		return defaults
+	}
+	o := *defaults
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "unit":
+			o.unit, err = parseUnit(v.String())
+		case "outputunit":
+			o.output, err = parseUnit(v.String())
+		case "reservoir":
+			o.reservoir = v.String()
+		case "reservoirsize":
+			o.reservoirSize = int(lua.LVAsNumber(v))
+			if o.reservoirSize <= 0 {
+				err = fmt.Errorf("invalid reservoir size %s", v.String())
+			}
+		case "percentiles":
+			o.percentiles, err = luaPercentiles(v)
+		default:
+			err = fmt.Errorf("invalid option %s", k.String())
+		}
+	})
+	if err == nil {
+		err = o.validate()
+	}
+	if err != nil {
+		state.RaiseError("graphite: %s", err.Error())
+	}
+	return &o
+}
+
+// luaPercentiles returns the percentiles of the lua table
+func luaPercentiles(v lua.LValue) ([]float64, error) {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("invalid percentiles %s", v.String())
+	}
+	var (
+		percentiles []float64
+		err         error
+	)
+	t.ForEach(func(_, v lua.LValue) {
+		n, ok := v.(lua.LNumber)
+		if !ok {
+			err = fmt.Errorf("invalid percentile %s", v.String())
+			return
+		}
+		percentiles = append(percentiles, float64(n))
+	})
+	return percentiles, err
+}
+
+// Clear clears the sample
+func (s *hdrSample) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.histogram.Reset()
+	s.sum = 0
+}
+
+// Count returns the number of recorded values
+func (s *hdrSample) Count() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.histogram.TotalCount()
+}
+
+// Max returns the maximum value
+func (s *hdrSample) Max() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.histogram.TotalCount() == 0 {
+		return 0
+	}
+	return s.histogram.Max()
+}
+
+// Mean returns the mean of the values
+func (s *hdrSample) Mean() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.histogram.Mean()
+}
+
+// Min returns the minimum value
+func (s *hdrSample) Min() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.histogram.TotalCount() == 0 {
+		return 0
+	}
+	return s.histogram.Min()
+}
+
+// Percentile returns the value at the percentile, p is in [0, 1]
+func (s *hdrSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns the values at the percentiles, the percentiles are in [0, 1]
+func (s *hdrSample) Percentiles(ps []float64) []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]float64, len(ps))
+	if s.histogram.TotalCount() == 0 {
+		return values
+	}
+	for i, p := range ps {
+		values[i] = float64(s.histogram.ValueAtQuantile(p * 100))
+	}
+	return values
+}
+
+// Size returns the number of recorded values
+func (s *hdrSample) Size() int {
+	return int(s.Count())
+}
+
+// Snapshot returns a read only copy of the sample
+func (s *hdrSample) Snapshot() goMetrics.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &hdrSample{histogram: hdrhistogram.Import(s.histogram.Export()), sum: s.sum}
+}
+
+// StdDev returns the standard deviation of the values
+func (s *hdrSample) StdDev() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.histogram.StdDev()
+}
+
+// Sum returns the sum of the values
+func (s *hdrSample) Sum() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sum
+}
+
+// Update records the value, the values out of the tracked range are recorded as the nearest bound
+func (s *hdrSample) Update(v int64) {
+	if v < 0 {
+		v = 0
+	} else if v > hdrMax {
+		v = hdrMax
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.histogram.RecordValue(v)
+	if s.sum < math.MaxInt64-v {
+		s.sum += v
+	}
+}
+
+// Values is not supported, the hdr histogram does not keep the values
+func (s *hdrSample) Values() []int64 {
+	return nil
+}
+
+// Variance returns the variance of the values
+func (s *hdrSample) Variance() float64 {
+	sd := s.StdDev()
+	return sd * sd
+}
+
+// newHdrHistogram returns a new hdrHistogram instance
+func newHdrHistogram() *hdrHistogram {
+	return &hdrHistogram{hdrSample: &hdrSample{histogram: hdrhistogram.New(1, hdrMax, hdrSigfigs)}}
+}
+
+// Sample returns the sample of the histogram
+func (h *hdrHistogram) Sample() goMetrics.Sample {
+	return h.hdrSample
+}
+
+// Snapshot returns a read only copy of the histogram
+func (h *hdrHistogram) Snapshot() goMetrics.Histogram {
+	return &hdrHistogram{hdrSample: h.hdrSample.Snapshot().(*hdrSample)}
+}
+
+// Rate1 returns the one-minute moving average rate of events per second
+func (t *hdrTimer) Rate1() float64 {
+	return t.meter.Rate1()
+}
+
+// Rate5 returns the five-minute moving average rate of events per second
+func (t *hdrTimer) Rate5() float64 {
+	return t.meter.Rate5()
+}
+
+// Rate15 returns the fifteen-minute moving average rate of events per second
+func (t *hdrTimer) Rate15() float64 {
+	return t.meter.Rate15()
+}
+
+// RateMean returns the mean rate of events per second
+func (t *hdrTimer) RateMean() float64 {
+	return t.meter.RateMean()
+}
+
+// Snapshot returns a read only copy of the timer
+func (t *hdrTimer) Snapshot() goMetrics.Timer {
+	return &hdrTimer{hdrHistogram: t.hdrHistogram.Snapshot().(*hdrHistogram), meter: t.meter.Snapshot()}
+}
+
+// Stop stops the meter
+func (t *hdrTimer) Stop() {
+	t.meter.Stop()
+}
+
+// Time records the duration of the execution of the function
+func (t *hdrTimer) Time(f func()) {
+	ts := time.Now()
+	f()
+	t.Update(time.Since(ts))
+}
+
+// Update records the duration
+func (t *hdrTimer) Update(d time.Duration) {
+	t.hdrHistogram.Update(int64(d))
+	t.meter.Mark(1)
+}
+
+// UpdateSince records the duration since the time
+func (t *hdrTimer) UpdateSince(ts time.Time) {
+	t.Update(time.Since(ts))
+}
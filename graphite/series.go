@@ -0,0 +1,85 @@
+package graphite
+
+import (
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+//nolint:gochecknoglobals
+var (
+	// nameReplacer replaces the whitespaces and the characters reserved by the tagged series in the metric names
+	nameReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_", "\r", "_", ";", "_", "=", "_", "!", "_", "^", "_", "~", "_")
+
+	// tagReplacer replaces the whitespaces and the characters not allowed in the tag names
+	tagReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_", "\r", "_", ";", "_", "=", "_", "!", "_", "^", "_")
+
+	// valueReplacer replaces the whitespaces and the characters not allowed in the tag values
+	valueReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_", "\r", "_", ";", "_")
+)
+
+// Series returns the series of the metric name with the tags in graphite tagged format (graphite 1.1+)
+//
+//	requests {status = "200", method = "GET"} => requests;method=GET;status=200
+//
+// The name and the tags are sanitized for the plaintext protocol, tags with empty values are ignored
+func Series(name string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(SanitizeName(name))
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := valueReplacer.Replace(tags[k])
+		if strings.HasPrefix(v, "~") {
+			v = "_" + v[1:]
+		}
+		b.WriteString(";" + tagReplacer.Replace(k) + "=" + v)
+	}
+	return b.String()
+}
+
+// SanitizeName returns the metric path without the whitespaces, the reserved characters and the empty nodes
+//
+//	"api..requests " => "api.requests_"
+func SanitizeName(name string) string {
+	nodes := strings.Split(nameReplacer.Replace(name), ".")
+	valid := nodes[:0]
+	for _, n := range nodes {
+		if n != "" {
+			valid = append(valid, n)
+		}
+	}
+	return strings.Join(valid, ".")
+}
+
+// SanitizeNode returns the value usable as a single node of the metric path, the dots are replaced with _
+func SanitizeNode(value string) string {
+	return strings.Replace(nameReplacer.Replace(value), ".", "_", -1)
+}
+
+// split returns the metric name and the tags of the series
+func split(series string) (name, tags string) {
+	if i := strings.IndexByte(series, ';'); i >= 0 {
+		return series[:i], series[i:]
+	}
+	return series, ""
+}
+
+// luaTags returns the tags table argument of the metric functions
+func luaTags(state *lua.LState, n int) map[string]string {
+	t := state.OptTable(n, nil)
+	if t == nil {
+		return nil
+	}
+	tags := make(map[string]string)
+	t.ForEach(func(k, v lua.LValue) {
+		tags[k.String()] = v.String()
+	})
+	return tags
+}
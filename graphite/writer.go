@@ -0,0 +1,93 @@
+package graphite
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	goMetrics "github.com/rcrowley/go-metrics"
+)
+
+// write writes the metrics of the registry in graphite plaintext protocol with the timestamp
+// The percentiles and the timer unit are the options of the series
+func (t *target) write(w io.Writer, registry goMetrics.Registry, ts int64) {
+	flushSeconds := t.interval.Seconds()
+	delta := t.conf.Graphite.Delta && !t.conf.Graphite.EventTime
+	registry.Each(func(series string, i interface{}) {
+		// the suffix of the aggregations is added to the name before the tags
+		name, tags := split(series)
+		switch metric := i.(type) {
+		case goMetrics.Counter:
+			count := metric.Count()
+			if delta {
+				// the written count is subtracted, so the updates during the flush are kept for the next interval
+				metric.Dec(count)
+			}
+			fmt.Fprintf(w, "%s.count%s %d %d\n", name, tags, count, ts)
+			fmt.Fprintf(w, "%s.count_ps%s %.2f %d\n", name, tags, float64(count)/flushSeconds, ts)
+		case goMetrics.Gauge:
+			fmt.Fprintf(w, "%s.value%s %d %d\n", name, tags, metric.Value(), ts)
+		case goMetrics.GaugeFloat64:
+			fmt.Fprintf(w, "%s.value%s %f %d\n", name, tags, metric.Value(), ts)
+		case goMetrics.Histogram:
+			if delta {
+				// the metric is replaced before the snapshot, so the updates during the flush are recorded in the next interval
+				registry.Unregister(series)
+			}
+			h := metric.Snapshot()
+			percentiles := t.option(series).percentiles
+			ps := h.Percentiles(percentiles)
+			fmt.Fprintf(w, "%s.count%s %d %d\n", name, tags, h.Count(), ts)
+			fmt.Fprintf(w, "%s.min%s %d %d\n", name, tags, h.Min(), ts)
+			fmt.Fprintf(w, "%s.max%s %d %d\n", name, tags, h.Max(), ts)
+			fmt.Fprintf(w, "%s.mean%s %.2f %d\n", name, tags, h.Mean(), ts)
+			fmt.Fprintf(w, "%s.std-dev%s %.2f %d\n", name, tags, h.StdDev(), ts)
+			for i, p := range percentiles {
+				fmt.Fprintf(w, "%s.%s-percentile%s %.2f %d\n", name, percentileKey(p), tags, ps[i], ts)
+			}
+		case goMetrics.Meter:
+			if delta {
+				// the metric is replaced before the snapshot, so the updates during the flush are recorded in the next interval
+				registry.Unregister(series)
+			}
+			m := metric.Snapshot()
+			fmt.Fprintf(w, "%s.count%s %d %d\n", name, tags, m.Count(), ts)
+			fmt.Fprintf(w, "%s.one-minute%s %.2f %d\n", name, tags, m.Rate1(), ts)
+			fmt.Fprintf(w, "%s.five-minute%s %.2f %d\n", name, tags, m.Rate5(), ts)
+			fmt.Fprintf(w, "%s.fifteen-minute%s %.2f %d\n", name, tags, m.Rate15(), ts)
+			fmt.Fprintf(w, "%s.mean%s %.2f %d\n", name, tags, m.RateMean(), ts)
+		case goMetrics.Timer:
+			if delta {
+				// the metric is replaced before the snapshot, so the updates during the flush are recorded in the next interval
+				registry.Unregister(series)
+			}
+			s := metric.Snapshot()
+			o := t.option(series)
+			du := float64(o.output)
+			percentiles := o.percentiles
+			ps := s.Percentiles(percentiles)
+			count := s.Count()
+			fmt.Fprintf(w, "%s.count%s %d %d\n", name, tags, count, ts)
+			fmt.Fprintf(w, "%s.count_ps%s %.2f %d\n", name, tags, float64(count)/flushSeconds, ts)
+			fmt.Fprintf(w, "%s.min%s %.2f %d\n", name, tags, float64(s.Min())/du, ts)
+			fmt.Fprintf(w, "%s.max%s %.2f %d\n", name, tags, float64(s.Max())/du, ts)
+			fmt.Fprintf(w, "%s.mean%s %.2f %d\n", name, tags, s.Mean()/du, ts)
+			fmt.Fprintf(w, "%s.std-dev%s %.2f %d\n", name, tags, s.StdDev()/du, ts)
+			for i, p := range percentiles {
+				fmt.Fprintf(w, "%s.%s-percentile%s %.2f %d\n", name, percentileKey(p), tags, ps[i]/du, ts)
+			}
+			fmt.Fprintf(w, "%s.one-minute%s %.2f %d\n", name, tags, s.Rate1(), ts)
+			fmt.Fprintf(w, "%s.five-minute%s %.2f %d\n", name, tags, s.Rate5(), ts)
+			fmt.Fprintf(w, "%s.fifteen-minute%s %.2f %d\n", name, tags, s.Rate15(), ts)
+			fmt.Fprintf(w, "%s.mean-rate%s %.2f %d\n", name, tags, s.RateMean(), ts)
+		default:
+			t.logger.Warn().Msgf("unable to record metric of type %T", i)
+		}
+	})
+}
+
+// percentileKey returns the graphite key of the percentile. e.g. 0.999 => 999
+func percentileKey(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p*100.0, 'f', -1, 64), ".", "", 1)
+}
@@ -0,0 +1,447 @@
+// Package influx is responsible for writing metrics to InfluxDB in line protocol
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultBatch is the default number of points sent in a single write
+	defaultBatch = 1000
+
+	// packetSize is the maximum size of the UDP packets
+	packetSize = 1432
+
+	// maxBatches is the number of batches kept while the writes fail, the oldest points exceeding it are dropped
+	maxBatches = 100
+)
+
+type (
+	// Manager shares a writer, its buffer and its thread, between the influx instances with the same configuration
+	Manager struct {
+		logger zerolog.Logger
+
+		mu      sync.Mutex
+		writers map[string]*writer
+		closed  bool
+	}
+
+	// Influx represents the InfluxDB module of the application
+	// It batches the points and writes them over UDP or HTTP in regular interval (config.Influx.Interval)
+	// or when the batch is full (config.Influx.Batch)
+	Influx struct {
+		writer *writer
+		// clock returns the time of the points
+		clock func() time.Time
+	}
+
+	// writer buffers the lines of an InfluxDB and writes them from its own thread
+	// The buffer holds up to maxBatches batches, the lines of the failed writes are kept for the next write
+	writer struct {
+		conf    *config.Influx
+		logger  zerolog.Logger
+		client  *http.Client
+		full    chan struct{}
+		done    chan struct{}
+		stopped chan struct{}
+
+		mu    sync.Mutex
+		lines []string
+		// dropped is the number of the oldest lines dropped from the full buffer since the last flush
+		dropped int
+	}
+
+	// Point represents the InfluxDB data point
+	Point struct {
+		Measurement string
+		Tags        map[string]string
+		Fields      map[string]interface{}
+		Time        time.Time
+	}
+)
+
+// NewManager returns a new Manager instance
+func NewManager(logger zerolog.Logger) *Manager {
+	return &Manager{
+		logger:  logger,
+		writers: make(map[string]*writer),
+	}
+}
+
+// Influx returns a new Influx instance writing the points to the writer of config.Influx
+// The writer and its thread are created on the first call for the configuration
+func (m *Manager) Influx(conf *config.Configuration, clock func() time.Time) (*Influx, error) {
+	c := conf.Influx
+	if c == nil {
+		return nil, fmt.Errorf("invalid influx configuration")
+	}
+	switch c.Transport {
+	case "udp":
+		if c.Address == "" {
+			return nil, fmt.Errorf("influx udp address not configured")
+		}
+	case "", "http":
+		if _, err := url.Parse(c.URL); err != nil || c.URL == "" {
+			return nil, fmt.Errorf("invalid influx url %q", c.URL)
+		}
+	default:
+		return nil, fmt.Errorf("invalid influx transport %s", c.Transport)
+	}
+	switch c.Precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		return nil, fmt.Errorf("invalid influx precision %s", c.Precision)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, fmt.Errorf("influx is closed")
+	}
+	// the configurations are compared by their values
+	key := fmt.Sprintf("%+v", *c)
+	w, ok := m.writers[key]
+	if !ok {
+		w = newWriter(c, m.logger)
+		m.writers[key] = w
+	}
+	return &Influx{writer: w, clock: clock}, nil
+}
+
+// Close stops the writers and writes the buffered points a last time
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var err error
+	for _, w := range m.writers {
+		if werr := w.close(); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// newWriter returns a new writer and starts its thread
+func newWriter(conf *config.Influx, logger zerolog.Logger) *writer {
+	w := &writer{
+		conf:    conf,
+		logger:  logger,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	interval := time.Second
+	if conf.Interval > 0 {
+		interval = time.Second * time.Duration(conf.Interval)
+	}
+	go w.run(interval)
+	return w
+}
+
+// run writes the buffered points every interval and when the batch is full, until the writer is closed
+// After a failed write, the points are only written on the next interval
+func (w *writer) run(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failed bool
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.full:
+			if failed {
+				continue
+			}
+		}
+		err := w.flush()
+		if failed = err != nil; failed {
+			w.logger.Error().Err(err).Msg("failed to write influx points")
+		}
+	}
+}
+
+// close stops the thread and writes the buffered points
+func (w *writer) close() error {
+	close(w.done)
+	<-w.stopped
+	err := w.flush()
+	if err != nil {
+		w.mu.Lock()
+		dropped := len(w.lines) + w.dropped
+		w.lines, w.dropped = nil, 0
+		w.mu.Unlock()
+		w.logger.Error().Err(err).Int("points", dropped).Msg("failed to write the last influx points, points dropped")
+	}
+	return err
+}
+
+// Write adds the point to the batch
+func (i *Influx) Write(p Point) error {
+	w := i.writer
+	line, err := p.line(w.precision())
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	if len(w.lines) >= maxBatches*w.batch() {
+		w.lines = w.lines[1:]
+		w.dropped++
+	}
+	w.lines = append(w.lines, line)
+	full := len(w.lines) >= w.batch()
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (w *writer) batch() int {
+	if w.conf.Batch > 0 {
+		return w.conf.Batch
+	}
+	return defaultBatch
+}
+
+func (w *writer) precision() time.Duration {
+	switch w.conf.Precision {
+	case "s":
+		return time.Second
+	case "ms":
+		return time.Millisecond
+	case "us":
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+// flush writes the buffered points in batches
+// On failure, the unsent points are put back in front of the buffer and the oldest points exceeding maxBatches are dropped
+func (w *writer) flush() error {
+	w.mu.Lock()
+	lines, dropped := w.lines, w.dropped
+	w.lines, w.dropped = nil, 0
+	w.mu.Unlock()
+	if dropped > 0 {
+		w.logger.Warn().Int("points", dropped).Msg("influx buffer is full, oldest points dropped")
+	}
+	for len(lines) > 0 {
+		n := w.batch()
+		if n > len(lines) {
+			n = len(lines)
+		}
+		var err error
+		if w.conf.Transport == "udp" {
+			err = w.writeUDP(lines[:n])
+		} else {
+			err = w.writeHTTP(lines[:n])
+		}
+		if err != nil {
+			w.requeue(lines)
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// requeue puts the unsent lines back in front of the buffer
+func (w *writer) requeue(lines []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(lines, w.lines...)
+	if excess := len(w.lines) - maxBatches*w.batch(); excess > 0 {
+		w.lines = append([]string(nil), w.lines[excess:]...)
+		w.dropped += excess
+	}
+}
+
+func (w *writer) writeUDP(lines []string) error {
+	conn, err := net.Dial("udp", w.conf.Address)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > packetSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+func (w *writer) writeHTTP(lines []string) error {
+	c := w.conf
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if c.Precision != "" {
+		q.Set("precision", c.Precision)
+	}
+	if c.Version == 2 {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", c.Org)
+		q.Set("bucket", c.Bucket)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			q.Set("rp", c.RetentionPolicy)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case c.Version == 2:
+		req.Header.Set("Authorization", "Token "+c.Token)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// line returns the point in line protocol
+func (p Point) line(precision time.Duration) (string, error) {
+	if p.Measurement == "" {
+		return "", fmt.Errorf("measurement not found")
+	}
+	if len(p.Fields) == 0 {
+		return "", fmt.Errorf("fields not found for %s", p.Measurement)
+	}
+	var b strings.Builder
+	b.WriteString(measurementReplacer.Replace(p.Measurement))
+
+	keys := make([]string, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + keyReplacer.Replace(k) + "=" + keyReplacer.Replace(p.Tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(keyReplacer.Replace(k) + "=")
+		switch v := p.Fields[k].(type) {
+		case float64:
+			// NaN and infinities are not valid in line protocol, the server would reject the whole batch
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return "", fmt.Errorf("invalid value %v of field %s", v, k)
+			}
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10) + "i")
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		case string:
+			b.WriteString(`"` + stringReplacer.Replace(v) + `"`)
+		default:
+			return "", fmt.Errorf("invalid type %T of field %s", v, k)
+		}
+	}
+	if !p.Time.IsZero() {
+		b.WriteString(" " + strconv.FormatInt(p.Time.UnixNano()/int64(precision), 10))
+	}
+	return b.String(), nil
+}
+
+//nolint:gochecknoglobals
+var (
+	measurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringReplacer      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// LAPIPoint is the lua binding for point function on the influx instance
+//
+//	influx().point("requests", { latency = 12.5, status = "200" }, { host = "web-1" })
+//
+// numbers are written as floats, booleans as booleans and the rest as strings. The point time is the event time
+func (i *Influx) LAPIPoint(state *lua.LState) int {
+	p := Point{
+		Measurement: state.ToString(1),
+		Fields:      make(map[string]interface{}),
+		Tags:        make(map[string]string),
+		Time:        i.clock(),
+	}
+	state.CheckTable(2).ForEach(func(k, v lua.LValue) {
+		switch v := v.(type) {
+		case lua.LNumber:
+			p.Fields[k.String()] = float64(v)
+		case lua.LBool:
+			p.Fields[k.String()] = bool(v)
+		default:
+			p.Fields[k.String()] = v.String()
+		}
+	})
+	if t := state.OptTable(3, nil); t != nil {
+		t.ForEach(func(k, v lua.LValue) {
+			p.Tags[k.String()] = v.String()
+		})
+	}
+	if err := i.Write(p); err != nil {
+		state.RaiseError("influx: %s", err.Error())
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package logtrics
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// JSON represents the parser of the lines containing a JSON object
+// The nested objects are flattened with dotted keys, the arrays are kept as JSON strings and the null values are skipped
+type JSON struct{}
+
+// FindSubStrings decodes the JSON object of the string
+func (p *JSON) FindSubStrings(s string) (map[string]string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		return nil, false
+	}
+	results := make(map[string]string, len(object))
+	flatten(results, "", object)
+	return results, true
+}
+
+// Anchors returns the opening brace of the object
+func (p *JSON) Anchors() []string {
+	return []string{"{"}
+}
+
+// flatten adds the values of the object to the results, the keys of the nested objects are prefixed with the parent key
+func flatten(results map[string]string, prefix string, object map[string]interface{}) {
+	for k, v := range object {
+		key := prefix + k
+		switch v := v.(type) {
+		case nil:
+		case string:
+			results[key] = v
+		case json.Number:
+			results[key] = v.String()
+		case bool:
+			if v {
+				results[key] = "true"
+			} else {
+				results[key] = "false"
+			}
+		case map[string]interface{}:
+			flatten(results, key+".", v)
+		default:
+			// the arrays are re-encoded, the encoding of decoded values can't fail
+			b, _ := json.Marshal(v)
+			results[key] = string(b)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package logtrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONFindSubStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want map[string]string
+	}{
+		{
+			name: "flat",
+			line: `{"level":"error","status":503,"took":0.25,"cached":false}`,
+			want: map[string]string{"level": "error", "status": "503", "took": "0.25", "cached": "false"},
+		},
+		{
+			name: "large numbers are kept",
+			line: `{"id":12345678901234567890}`,
+			want: map[string]string{"id": "12345678901234567890"},
+		},
+		{
+			name: "nested objects",
+			line: `{"http":{"request":{"method":"GET"},"status":200}}`,
+			want: map[string]string{"http.request.method": "GET", "http.status": "200"},
+		},
+		{
+			name: "arrays and nulls",
+			line: `{"tags":["a","b"],"user":null}`,
+			want: map[string]string{"tags": `["a","b"]`},
+		},
+		{
+			name: "trailing text",
+			line: `{"a":"b"} trailing`,
+			want: map[string]string{"a": "b"},
+		},
+		{
+			name: "not an object",
+			line: `["a"]`,
+		},
+		{
+			name: "invalid",
+			line: `{"a":`,
+		},
+		{
+			name: "null",
+			line: `null`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := (&JSON{}).FindSubStrings(tt.line)
+			if ok != (tt.want != nil) {
+				t.Fatalf("expected match %v, got %v", tt.want != nil, ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/jinzhu/copier"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/cardinality"
 	"github.com/smitajit/logtrics/config"
 	"github.com/smitajit/logtrics/graphite"
+	"github.com/smitajit/logtrics/influx"
+	"github.com/smitajit/logtrics/prometheus"
 	"github.com/smitajit/logtrics/reader"
+	"github.com/smitajit/logtrics/statsd"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -17,32 +23,65 @@ type (
 	// Logtric represents the logtrics instance configured in lua
 	// it stores the lua script states and provides runtime bindings to lua
 	Logtric struct {
-		name     string
-		state    *lua.LState
-		parser   Parser
-		handler  *lua.LFunction
-		conf     *config.Configuration
-		graphite *graphite.Graphite
-		logger   zerolog.Logger
+		name       string
+		script     *Script
+		state      *lua.LState
+		parser     Parser
+		fields     *Fields
+		timestamp  *Timestamp
+		filter     *Filter
+		handler    *lua.LFunction
+		conf       *config.Configuration
+		graphite   *graphite.Graphite
+		prometheus *prometheus.Prometheus
+		statsd     *statsd.Statsd
+		influx     *influx.Influx
+		limiter    *cardinality.Limiter
+		prefix     *Prefix
+		logger     zerolog.Logger
+		// apis are the lua globals of the apis of the logtric, built once and bound when the logtric runs
+		apis map[string]lua.LValue
+		// reader is the reader of the event being handled, for the prefix
+		reader string
+		// eventTime is the time of the event being handled
+		eventTime time.Time
 	}
 )
 
-// NewLogtric returns a new instance of Logtric
-func NewLogtric(script string, conf *config.Configuration, state *lua.LState, table *lua.LTable) (*Logtric, error) {
+// NewLogtric returns a new instance of Logtric of the script
+func NewLogtric(script *Script, state *lua.LState, table *lua.LTable) (*Logtric, error) {
 	name := table.RawGet(lua.LString("name")).String()
 	if name == "" || name == "nil" {
 		name = "?"
 	}
 
+	logger := script.conf.Logger(fmt.Sprintf("%s:[%s]", script.Path, name))
+
 	p := table.RawGet(lua.LString("parser"))
-	parserTable, ok := p.(*lua.LTable)
-	if !ok || parserTable == nil {
-		return nil, fmt.Errorf("parser not found")
-	}
-	parser, err := NewParser(parserTable)
+	parser, err := NewParser(state, p, logger)
 	if err != nil {
 		return nil, err //TODO wrap error may be
 	}
+	fields := &Fields{Policy: PolicyDrop}
+	if parserTable, ok := p.(*lua.LTable); ok {
+		if fields, err = NewFields(parserTable); err != nil {
+			return nil, err
+		}
+	}
+
+	var timestamp *Timestamp
+	if t, ok := table.RawGet(lua.LString("timestamp")).(*lua.LTable); ok {
+		if timestamp, err = NewTimestamp(t); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := &Filter{}
+	if t, ok := table.RawGet(lua.LString("filter")).(*lua.LTable); ok {
+		if filter, err = NewFilter(t); err != nil {
+			return nil, err
+		}
+	}
 
 	h := table.RawGet(lua.LString("handler"))
 	handler, ok := h.(*lua.LFunction)
@@ -50,21 +89,65 @@ func NewLogtric(script string, conf *config.Configuration, state *lua.LState, ta
 		return nil, fmt.Errorf("handler not found")
 	}
 
-	merged, err := mergeConfig(conf, table)
+	var schedules []*schedule
+	if v := table.RawGet(lua.LString("scheduler")); v != lua.LNil {
+		if schedules, err = newSchedules(v); err != nil {
+			return nil, err
+		}
+	}
+
+	merged, err := mergeConfig(script.conf, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var max int
+	if merged.Cardinality != nil {
+		max = merged.Cardinality.MaxLogtricSeries
+	}
+	limiter := cardinality.NewLimiter(fmt.Sprintf("%s:%s", script.Path, name), max, script.limiter.Overflow(),
+		script.limiter, script.prometheus, logger)
+
+	var template, logtricTemplate string
+	if merged.Metrics != nil {
+		template = merged.Metrics.Prefix
+	}
+	if v, ok := table.RawGet(lua.LString("prefix")).(lua.LString); ok {
+		logtricTemplate = string(v)
+	}
+	prefix, err := NewPrefix(prefixVariables(script.Path, name), template, logtricTemplate)
 	if err != nil {
 		return nil, err
 	}
 
 	l := &Logtric{
-		name:    name,
-		state:   state,
-		conf:    merged,
-		handler: handler,
-		parser:  parser,
-		logger:  conf.Logger(fmt.Sprintf("%s:[%s]", script, name)),
+		name:       name,
+		script:     script,
+		state:      state,
+		conf:       merged,
+		handler:    handler,
+		parser:     parser,
+		fields:     fields,
+		timestamp:  timestamp,
+		filter:     filter,
+		prometheus: script.prometheus,
+		limiter:    limiter,
+		prefix:     prefix,
+		logger:     logger,
 	}
 
+	l.apis = l.newApis()
 	l.bindApis()
+	for _, sched := range schedules {
+		fn := sched.fn
+		script.start(sched.schedule, func() {
+			// the apis of the script are bound to the last created or run logtric
+			if script.current != l {
+				l.bindApis()
+			}
+			script.callback(fn)
+		})
+	}
 	return l, nil
 }
 
@@ -81,21 +164,38 @@ func mergeConfig(c *config.Configuration, table *lua.LTable) (*config.Configurat
 			return
 		}
 		switch k {
-		case lua.LString("handler"), lua.LString("parser"), lua.LString("name"), lua.LString("scheduler"):
+		case lua.LString("handler"), lua.LString("parser"), lua.LString("name"), lua.LString("scheduler"),
+			lua.LString("timestamp"), lua.LString("filter"), lua.LString("prefix"):
 			//ignore
 		case lua.LString("graphite"):
 			if merged.Graphite == nil {
 				merged.Graphite = &config.Graphite{}
 			}
 			err = updateGraphiteConfig(merged.Graphite, v)
+		case lua.LString("statsd"):
+			if merged.Statsd == nil {
+				merged.Statsd = &config.Statsd{}
+			}
+			err = updateStatsdConfig(merged.Statsd, v)
+		case lua.LString("influx"):
+			if merged.Influx == nil {
+				merged.Influx = &config.Influx{}
+			}
+			err = updateInfluxConfig(merged.Influx, v)
 		case lua.LString("logging"):
 			if merged.Logging == nil {
 				merged.Logging = &config.Logging{}
 			}
 			err = updateLogConfig(merged.Logging, v)
+		case lua.LString("cardinality"):
+			if merged.Cardinality == nil {
+				merged.Cardinality = &config.Cardinality{}
+			}
+			err = updateCardinalityConfig(merged.Cardinality, v)
 		case lua.LString("expression"):
 			merged.Expression = v.String()
-		case lua.LString("sctriptfile"), lua.LString("scriptdir"), lua.LString("mode"), lua.LString("tcp"), lua.LString("udp"):
+		case lua.LString("sctriptfile"), lua.LString("scriptdir"), lua.LString("mode"), lua.LString("tcp"), lua.LString("udp"),
+			lua.LString("prometheus"), lua.LString("otlp"):
 			err = fmt.Errorf("modification is not supported for [%s]", k.String())
 		default:
 			err = fmt.Errorf("invalid key %s", k.String())
@@ -132,10 +232,168 @@ func updateGraphiteConfig(g *config.Graphite, v lua.LValue) error {
 			if err != nil {
 				return
 			}
+		case lua.LString("eventtime"):
+			g.EventTime, err = strconv.ParseBool(v.String())
+			if err != nil {
+				return
+			}
+		case lua.LString("lateness"):
+			g.Lateness, err = strconv.Atoi(v.String())
+			if err != nil {
+				return
+			}
+		case lua.LString("expiry"):
+			g.Expiry, err = strconv.Atoi(v.String())
+			if err != nil {
+				return
+			}
+		case lua.LString("delta"):
+			g.Delta, err = strconv.ParseBool(v.String())
+			if err != nil {
+				return
+			}
+		case lua.LString("transport"):
+			g.Transport = v.String()
+		case lua.LString("queuesize"):
+			g.QueueSize, err = strconv.Atoi(v.String())
+			if err != nil {
+				return
+			}
+		case lua.LString("spool"):
+			g.Spool = v.String()
+		case lua.LString("percentiles"):
+			t, ok := v.(*lua.LTable)
+			if !ok {
+				err = fmt.Errorf("invalid graphite percentiles")
+				return
+			}
+			g.Percentiles = nil
+			t.ForEach(func(_, p lua.LValue) {
+				if err != nil {
+					return
+				}
+				var f float64
+				if f, err = strconv.ParseFloat(p.String(), 64); err != nil {
+					err = fmt.Errorf("invalid graphite percentile %s", p.String())
+					return
+				}
+				if f <= 0 || f > 1 {
+					err = fmt.Errorf("invalid graphite percentile %v, must be in (0, 1]", f)
+					return
+				}
+				g.Percentiles = append(g.Percentiles, f)
+			})
+		case lua.LString("timerunit"):
+			g.TimerUnit = v.String()
+		case lua.LString("outputunit"):
+			g.OutputUnit = v.String()
+		case lua.LString("reservoir"):
+			g.Reservoir = v.String()
+		case lua.LString("reservoirsize"):
+			g.ReservoirSize, err = strconv.Atoi(v.String())
+			if err != nil {
+				return
+			}
+		}
+	})
+	return err
+}
+func updateStatsdConfig(s *config.Statsd, v lua.LValue) error {
+	table, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("invalid statsd configuration")
+	}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case lua.LString("network"):
+			s.Network = v.String()
+		case lua.LString("address"):
+			s.Address = v.String()
+		case lua.LString("prefix"):
+			s.Prefix = v.String()
+		case lua.LString("mtu"):
+			s.MTU, err = strconv.Atoi(v.String())
+		case lua.LString("interval"):
+			s.Interval, err = strconv.Atoi(v.String())
+		case lua.LString("dogstatsd"):
+			s.DogStatsd, err = strconv.ParseBool(v.String())
+		default:
+			err = fmt.Errorf("invalid statsd config")
 		}
 	})
 	return err
 }
+
+func updateInfluxConfig(i *config.Influx, v lua.LValue) error {
+	table, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("invalid influx configuration")
+	}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case lua.LString("transport"):
+			i.Transport = v.String()
+		case lua.LString("address"):
+			i.Address = v.String()
+		case lua.LString("url"):
+			i.URL = v.String()
+		case lua.LString("version"):
+			i.Version, err = strconv.Atoi(v.String())
+		case lua.LString("database"):
+			i.Database = v.String()
+		case lua.LString("retentionpolicy"):
+			i.RetentionPolicy = v.String()
+		case lua.LString("username"):
+			i.Username = v.String()
+		case lua.LString("password"):
+			i.Password = v.String()
+		case lua.LString("org"):
+			i.Org = v.String()
+		case lua.LString("bucket"):
+			i.Bucket = v.String()
+		case lua.LString("token"):
+			i.Token = v.String()
+		case lua.LString("precision"):
+			i.Precision = v.String()
+		case lua.LString("batch"):
+			i.Batch, err = strconv.Atoi(v.String())
+		case lua.LString("interval"):
+			i.Interval, err = strconv.Atoi(v.String())
+		default:
+			err = fmt.Errorf("invalid influx config")
+		}
+	})
+	return err
+}
+
+func updateCardinalityConfig(c *config.Cardinality, v lua.LValue) error {
+	table, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("invalid cardinality configuration")
+	}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case lua.LString("maxlogtricseries"):
+			c.MaxLogtricSeries, err = strconv.Atoi(v.String())
+		default:
+			err = fmt.Errorf("modification is not supported for [cardinality.%s]", k.String())
+		}
+	})
+	return err
+}
+
 func updateLogConfig(l *config.Logging, v lua.LValue) error {
 	table, ok := v.(*lua.LTable)
 	if !ok {
@@ -159,17 +417,53 @@ func updateLogConfig(l *config.Logging, v lua.LValue) error {
 	return err
 }
 
+// newApis returns the lua apis of the logtric by global name
+func (l *Logtric) newApis() map[string]lua.LValue {
+	return map[string]lua.LValue{
+		// logging apis
+		"fatal": l.state.NewFunction(l.LAPIFatal),
+		"error": l.state.NewFunction(l.LAPIError),
+		"warn":  l.state.NewFunction(l.LAPIWarn),
+		"info":  l.state.NewFunction(l.LAPIInfo),
+		"debug": l.state.NewFunction(l.LAPIDebug),
+		"trace": l.state.NewFunction(l.LAPITrace),
+
+		"graphite":   l.state.NewFunction(l.LAPIGraphite),
+		"prometheus": l.state.NewFunction(l.LAPIPrometheus),
+		"statsd":     l.state.NewFunction(l.LAPIStatsd),
+		"influx":     l.state.NewFunction(l.LAPIInflux),
+		"metrics":    l.script.metrics.WithLimiter(l.limiter).WithPrefix(l.metricName).LTable(l.state),
+	}
+}
+
+// bindApis binds the lua apis to the logtric
+// The globals of the script are shared by its logtrics, they are swapped to the apis of the logtric
 func (l *Logtric) bindApis() {
-	// binding logging apis
-	l.state.SetGlobal("fatal", l.state.NewFunction(l.LAPIFatal))
-	l.state.SetGlobal("error", l.state.NewFunction(l.LAPIError))
-	l.state.SetGlobal("warn", l.state.NewFunction(l.LAPIWarn))
-	l.state.SetGlobal("info", l.state.NewFunction(l.LAPIInfo))
-	l.state.SetGlobal("debug", l.state.NewFunction(l.LAPIDebug))
-	l.state.SetGlobal("trace", l.state.NewFunction(l.LAPITrace))
-
-	// binding graphite api
-	l.state.SetGlobal("graphite", l.state.NewFunction(l.LAPIGraphite))
+	l.script.current = l
+	for name, api := range l.apis {
+		l.state.SetGlobal(name, api)
+	}
+}
+
+// anchors returns the strings of which at least one must be present in the line for the logtric to match
+// the filter anchors are preferred over the parser anchors when they are more selective
+func (l *Logtric) anchors() []string {
+	p, f := anchors(l.parser), l.filter.Anchors()
+	if len(f) > 0 && (len(p) == 0 || shortest(f) > shortest(p)) {
+		return f
+	}
+	return p
+}
+
+// shortest returns the length of the shortest string
+func shortest(s []string) int {
+	n := len(s[0])
+	for _, v := range s[1:] {
+		if len(v) < n {
+			n = len(v)
+		}
+	}
+	return n
 }
 
 // Run runs the Logtric instance
@@ -180,6 +474,11 @@ func (l *Logtric) Run(ctx context.Context, event reader.LogEvent) error {
 		Protect: true,
 	}
 
+	if !l.filter.Accept(event.Line, event.Source) {
+		l.logger.Debug().Msg("line filtered")
+		return nil
+	}
+
 	// args := []string{event.Source, event.Line}
 	substrings, ok := l.parser.FindSubStrings(event.Line)
 	if !ok {
@@ -187,14 +486,56 @@ func (l *Logtric) Run(ctx context.Context, event reader.LogEvent) error {
 		return nil
 	}
 
+	values, err := l.fields.Convert(substrings)
+	if err != nil {
+		if l.fields.Policy == PolicyError {
+			return errors.Wrap(err, "field conversion failed")
+		}
+		l.logger.Debug().Err(err).Msg("field conversion failed, dropping event")
+		return nil
+	}
+	if !l.filter.Match(values) {
+		l.logger.Debug().Msg("fields filtered")
+		return nil
+	}
+
+	received := event.Time
+	if received.IsZero() {
+		received = time.Now()
+	}
+	l.eventTime = received
+	l.reader = readerName(event.Source)
+	if l.timestamp != nil {
+		eventTime, ok, err := l.timestamp.Resolve(substrings, received)
+		if err != nil {
+			if l.fields.Policy == PolicyError {
+				return err
+			}
+			l.logger.Debug().Err(err).Msg("timestamp parsing failed, dropping event")
+			return nil
+		}
+		if !ok {
+			l.logger.Debug().Time("time", eventTime).Msg("event time out of bounds, dropping event")
+			return nil
+		}
+		l.eventTime = eventTime
+	}
+
 	table := l.state.NewTable()
 	table.RawSetString("_source", lua.LString(event.Source))
 	table.RawSetString("_line", lua.LString(event.Line))
+	table.RawSetString("_time", unixSeconds(l.eventTime))
+	table.RawSetString("_received", unixSeconds(received))
 
-	for k, v := range substrings {
-		table.RawSetString(k, lua.LString(v))
+	for k, v := range values {
+		table.RawSetString(k, v)
 	}
-	err := l.state.CallByParam(p, table)
+	// the apis of the script are bound to the last created or run logtric
+	if l.script.current != l {
+		l.bindApis()
+	}
+	err = l.state.CallByParam(p, table)
+	l.eventTime = time.Time{}
 	if err != nil && err.Error() != "nil" {
 		return err
 	}
@@ -266,13 +607,27 @@ func (l *Logtric) LAPITrace(state *lua.LState) int {
 	return 0
 }
 
+// clock returns the time of the event being handled, current time otherwise
+func (l *Logtric) clock() time.Time {
+	if l.eventTime.IsZero() {
+		return time.Now()
+	}
+	return l.eventTime
+}
+
+// metricName returns the metric name with the prefix of the logtric
+func (l *Logtric) metricName(name string) string {
+	return l.prefix.Name(l.reader, name)
+}
+
 // LAPIGraphite is represents the lua binding for graphite() api call
 func (l *Logtric) LAPIGraphite(state *lua.LState) int {
 	if l.graphite == nil {
-		g, err := graphite.NewGraphite(l.conf, state, l.logger)
+		g, err := l.script.graphite.Graphite(l.conf, l.limiter, l.clock)
 		if err != nil {
 			state.RaiseError(err.Error())
 		}
+		g.SetPrefix(l.metricName)
 		l.graphite = g
 	}
 	table := state.NewTable()
@@ -280,6 +635,57 @@ func (l *Logtric) LAPIGraphite(state *lua.LState) int {
 	state.SetField(table, "timer", state.NewFunction(l.graphite.LAPITimer))
 	state.SetField(table, "gauge", state.NewFunction(l.graphite.LAPIGauge))
 	state.SetField(table, "meter", state.NewFunction(l.graphite.LAPIMeter))
+	state.SetField(table, "histogram", state.NewFunction(l.graphite.LAPIHistogram))
+	state.SetField(table, "node", state.NewFunction(l.graphite.LAPINode))
+	state.Push(table)
+	return 1
+}
+
+// LAPIPrometheus is represents the lua binding for prometheus() api call
+func (l *Logtric) LAPIPrometheus(state *lua.LState) int {
+	if l.prometheus == nil || !l.prometheus.Enabled() {
+		state.RaiseError("prometheus is not configured, the scrape endpoint is disabled without prometheus.port")
+	}
+	table := state.NewTable()
+	state.SetField(table, "counter", state.NewFunction(l.prometheus.LAPICounter))
+	state.SetField(table, "gauge", state.NewFunction(l.prometheus.LAPIGauge))
+	state.SetField(table, "histogram", state.NewFunction(l.prometheus.LAPIHistogram))
+	state.SetField(table, "summary", state.NewFunction(l.prometheus.LAPISummary))
+	state.Push(table)
+	return 1
+}
+
+// LAPIStatsd is represents the lua binding for statsd() api call
+func (l *Logtric) LAPIStatsd(state *lua.LState) int {
+	if l.statsd == nil {
+		s, err := l.script.statsd.Statsd(l.conf)
+		if err != nil {
+			state.RaiseError(err.Error())
+		}
+		s.SetPrefix(l.metricName)
+		l.statsd = s
+	}
+	table := state.NewTable()
+	state.SetField(table, "counter", state.NewFunction(l.statsd.LAPICounter))
+	state.SetField(table, "gauge", state.NewFunction(l.statsd.LAPIGauge))
+	state.SetField(table, "timer", state.NewFunction(l.statsd.LAPITimer))
+	state.SetField(table, "histogram", state.NewFunction(l.statsd.LAPIHistogram))
+	state.SetField(table, "set", state.NewFunction(l.statsd.LAPISet))
+	state.Push(table)
+	return 1
+}
+
+// LAPIInflux is represents the lua binding for influx() api call
+func (l *Logtric) LAPIInflux(state *lua.LState) int {
+	if l.influx == nil {
+		i, err := l.script.influx.Influx(l.conf, l.clock)
+		if err != nil {
+			state.RaiseError(err.Error())
+		}
+		l.influx = i
+	}
+	table := state.NewTable()
+	state.SetField(table, "point", state.NewFunction(l.influx.LAPIPoint))
 	state.Push(table)
 	return 1
 }
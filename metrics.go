@@ -0,0 +1,204 @@
+package logtrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/smitajit/logtrics/cardinality"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// MetricSink is the backend of the metrics api
+	MetricSink interface {
+		// Counter adds the value to the counter
+		Counter(name string, labels map[string]string, v float64) error
+		// Gauge sets the value of the gauge
+		Gauge(name string, labels map[string]string, v float64) error
+		// Histogram records the value in the histogram
+		Histogram(name string, labels map[string]string, v float64) error
+		// Timer records the duration in the timer
+		Timer(name string, labels map[string]string, d time.Duration) error
+		// Meter marks the number of occurrences in the meter
+		Meter(name string, labels map[string]string, v float64) error
+	}
+
+	// Metrics represents the backend neutral metrics api of the scripts
+	// The metrics are recorded in all the sinks configured in config.Metrics.Sinks
+	//
+	//	metrics.counter("requests", { status = "200" }).inc()
+	//	metrics.gauge("queue_size").set(12)
+	//	metrics.histogram("size", { path = "/" }).observe(512) -- integral values with the graphite sink
+	//	metrics.timer("latency").update(0.25) -- seconds or duration string e.g. "250ms"
+	//	metrics.meter("events").mark()
+	Metrics struct {
+		sinks []MetricSink
+		// limiter limits the number of distinct series, the rejected series are recorded in the overflow metric
+		limiter *cardinality.Limiter
+		// prefix returns the metric name with the prefix of the sinks of metric paths
+		prefix func(name string) string
+	}
+
+	// metric represents a metric of the metrics api with its labels
+	metric struct {
+		name   string
+		labels map[string]string
+	}
+)
+
+// NewMetrics returns a new Metrics instance
+func NewMetrics(sinks ...MetricSink) *Metrics {
+	return &Metrics{sinks: sinks}
+}
+
+// WithLimiter returns the Metrics instance recording in the same sinks with the limiter
+func (m *Metrics) WithLimiter(limiter *cardinality.Limiter) *Metrics {
+	return &Metrics{sinks: m.sinks, limiter: limiter, prefix: m.prefix}
+}
+
+// WithPrefix returns the metrics api prefixing the metric names of the graphite and statsd sinks
+func (m *Metrics) WithPrefix(prefix func(name string) string) *Metrics {
+	return &Metrics{sinks: m.sinks, limiter: m.limiter, prefix: prefix}
+}
+
+// record records the metric in all the sinks, the name is prefixed for the sinks of metric paths
+// A failing sink does not prevent the others from recording, the errors of the sinks are combined
+func (m *Metrics) record(name string, fn func(s MetricSink, name string) error) error {
+	var msgs []string
+	for _, s := range m.sinks {
+		n := name
+		if _, ok := s.(prefixedSink); ok && m.prefix != nil {
+			n = m.prefix(name)
+		}
+		if err := fn(s, n); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// Gauge sets the value of the gauge in the sinks, the series rejected by the limiter are recorded in the overflow metric
+func (m *Metrics) Gauge(name string, labels map[string]string, v float64) error {
+	if len(m.sinks) == 0 {
+		return fmt.Errorf("no metric sink is configured")
+	}
+	if !m.limiter.Allow(series("gauge", name, labels)) {
+		name, labels = m.limiter.Overflow()+".gauge", nil
+	}
+	return m.record(name, func(s MetricSink, name string) error { return s.Gauge(name, labels, v) })
+}
+
+// LTable returns the lua table of the metrics api
+func (m *Metrics) LTable(state *lua.LState) *lua.LTable {
+	table := state.NewTable()
+	state.SetField(table, "counter", state.NewFunction(m.LAPICounter))
+	state.SetField(table, "gauge", state.NewFunction(m.LAPIGauge))
+	state.SetField(table, "histogram", state.NewFunction(m.LAPIHistogram))
+	state.SetField(table, "timer", state.NewFunction(m.LAPITimer))
+	state.SetField(table, "meter", state.NewFunction(m.LAPIMeter))
+	return table
+}
+
+// LAPICounter is the lua binding for metrics.counter(name, labels) api call
+func (m *Metrics) LAPICounter(state *lua.LState) int {
+	c := m.metric(state, "counter")
+	table := state.NewTable()
+	state.SetField(table, "inc", state.NewFunction(func(state *lua.LState) int {
+		v := float64(state.OptNumber(1, 1))
+		check(state, m.record(c.name, func(s MetricSink, name string) error { return s.Counter(name, c.labels, v) }))
+		return 0
+	}))
+	state.Push(table)
+	return 1
+}
+
+// LAPIGauge is the lua binding for metrics.gauge(name, labels) api call
+func (m *Metrics) LAPIGauge(state *lua.LState) int {
+	g := m.metric(state, "gauge")
+	table := state.NewTable()
+	state.SetField(table, "set", state.NewFunction(func(state *lua.LState) int {
+		v := float64(state.CheckNumber(1))
+		check(state, m.record(g.name, func(s MetricSink, name string) error { return s.Gauge(name, g.labels, v) }))
+		return 0
+	}))
+	state.Push(table)
+	return 1
+}
+
+// LAPIHistogram is the lua binding for metrics.histogram(name, labels) api call
+func (m *Metrics) LAPIHistogram(state *lua.LState) int {
+	h := m.metric(state, "histogram")
+	table := state.NewTable()
+	state.SetField(table, "observe", state.NewFunction(func(state *lua.LState) int {
+		v := float64(state.CheckNumber(1))
+		check(state, m.record(h.name, func(s MetricSink, name string) error { return s.Histogram(name, h.labels, v) }))
+		return 0
+	}))
+	state.Push(table)
+	return 1
+}
+
+// LAPITimer is the lua binding for metrics.timer(name, labels) api call
+func (m *Metrics) LAPITimer(state *lua.LState) int {
+	t := m.metric(state, "timer")
+	table := state.NewTable()
+	state.SetField(table, "update", state.NewFunction(func(state *lua.LState) int {
+		d, err := luaDuration(state.CheckAny(1))
+		check(state, err)
+		check(state, m.record(t.name, func(s MetricSink, name string) error { return s.Timer(name, t.labels, d) }))
+		return 0
+	}))
+	state.Push(table)
+	return 1
+}
+
+// LAPIMeter is the lua binding for metrics.meter(name, labels) api call
+func (m *Metrics) LAPIMeter(state *lua.LState) int {
+	mt := m.metric(state, "meter")
+	table := state.NewTable()
+	state.SetField(table, "mark", state.NewFunction(func(state *lua.LState) int {
+		v := float64(state.OptNumber(1, 1))
+		check(state, m.record(mt.name, func(s MetricSink, name string) error { return s.Meter(name, mt.labels, v) }))
+		return 0
+	}))
+	state.Push(table)
+	return 1
+}
+
+func (m *Metrics) metric(state *lua.LState, kind string) *metric {
+	if len(m.sinks) == 0 {
+		state.RaiseError("metrics: no metric sink is configured")
+	}
+	name := state.CheckString(1)
+	labels := make(map[string]string)
+	if t := state.OptTable(2, nil); t != nil {
+		t.ForEach(func(k, v lua.LValue) {
+			labels[k.String()] = v.String()
+		})
+	}
+	if !m.limiter.Allow(series(kind, name, labels)) {
+		return &metric{name: m.limiter.Overflow() + "." + kind}
+	}
+	return &metric{name: name, labels: labels}
+}
+
+// series returns the key of the metric for the cardinality limits
+func series(kind, name string, labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return "metrics:" + kind + ":" + name + ";" + strings.Join(pairs, ";")
+}
+
+func check(state *lua.LState, err error) {
+	if err != nil {
+		state.RaiseError("metrics: %s", err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package logtrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/smitajit/logtrics/notify"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// notifyTable returns the lua table of the notify api
+//
+//	notify.webhook("https://hooks.example.com/T000", { text = "login failed for " .. event.user })
+//	notify.webhook(url, event, {
+//		template = '{"text": {{ json (printf "%s failed to login" .user) }}, "event": {{ json . }}}',
+//		headers = { Authorization = "Bearer token" },
+//		method = "PUT",
+//		timeout = "5s",
+//		retries = 5,
+//	})
+func notifyTable(state *lua.LState, n *notify.Notifier) *lua.LTable {
+	table := state.NewTable()
+	state.SetField(table, "webhook", state.NewFunction(func(state *lua.LState) int {
+		r, err := webhookRequest(state, n)
+		if err != nil {
+			state.RaiseError("notify: %s", err.Error())
+		}
+		state.Push(lua.LBool(n.Send(r)))
+		return 1
+	}))
+	return table
+}
+
+// webhookRequest returns the request of the arguments of the webhook function
+// The body is the template rendered with the payload, the json encoding of the payload table or the payload string otherwise
+func webhookRequest(state *lua.LState, n *notify.Notifier) (*notify.Request, error) {
+	u := state.CheckString(1)
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return nil, fmt.Errorf("invalid url %s", u)
+	}
+	payload, err := fromLua(state.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	r := &notify.Request{URL: u, Headers: make(map[string]string)}
+	var tmpl string
+	if opts := state.OptTable(3, nil); opts != nil {
+		opts.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch k.String() {
+			case "template":
+				tmpl = v.String()
+			case "method":
+				r.Method = strings.ToUpper(v.String())
+			case "headers":
+				t, ok := v.(*lua.LTable)
+				if !ok {
+					err = fmt.Errorf("invalid headers %s", v.String())
+					return
+				}
+				t.ForEach(func(k, v lua.LValue) {
+					r.Headers[k.String()] = v.String()
+				})
+			case "timeout":
+				r.Timeout, err = luaDuration(v)
+			case "retries":
+				retries := int(lua.LVAsNumber(v))
+				if retries < 0 {
+					err = fmt.Errorf("invalid retries %s", v.String())
+					return
+				}
+				r.Retries = &retries
+			default:
+				err = fmt.Errorf("invalid option %s", k.String())
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch p := payload.(type) {
+	case nil:
+	case string:
+		r.Body = []byte(p)
+	default:
+		r.Body, err = json.Marshal(p)
+	}
+	if tmpl != "" {
+		r.Body, err = n.Render(tmpl, payload)
+	}
+	return r, err
+}
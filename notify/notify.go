@@ -0,0 +1,315 @@
+// Package notify is responsible for the delivery of the notifications of the scripts
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+	"github.com/smitajit/logtrics/prometheus"
+)
+
+const (
+	defaultQueueSize = 1000
+	defaultWorkers   = 4
+	defaultTimeout   = 10 * time.Second
+	defaultRetries   = 3
+	minBackoff       = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+	// maxTemplates is the number of parsed templates cached, the cache is reset when it is full
+	maxTemplates = 100
+	// shutdownTimeout is the delay given to the queued notifications on close, the others are dropped
+	shutdownTimeout = 30 * time.Second
+)
+
+type (
+	// Notifier delivers the http requests of the notifications asynchronously
+	// The requests are queued and sent by the workers, the failures are queued again after an exponential backoff.
+	// The requests are dropped when the queue is full. The sent, failed and dropped requests are counted in prometheus
+	Notifier struct {
+		client  *http.Client
+		logger  zerolog.Logger
+		workers int
+		timeout time.Duration
+		retries int
+
+		mu        sync.Mutex
+		closed    bool
+		queue     chan *Request
+		templates map[string]*template.Template
+		// pending are the timers of the requests waiting for their retry
+		pending map[*Request]*time.Timer
+		wg      sync.WaitGroup
+		// ctx is cancelled when the shutdown timeout passes, the requests in flight are cancelled and the queued ones dropped
+		ctx     context.Context
+		cancel  context.CancelFunc
+		aborted int64
+
+		sent, failed, dropped *prometheus.Series
+	}
+
+	// Request is a http request of a notification
+	Request struct {
+		URL     string
+		Method  string
+		Headers map[string]string
+		Body    []byte
+		// Timeout overrides the default of the notifier if not 0
+		Timeout time.Duration
+		// Retries overrides the default of the notifier if not nil, no retries if 0
+		Retries *int
+
+		// attempt is the number of failed attempts
+		attempt int
+	}
+
+	// retryable is an error of a request which can be retried
+	retryable struct {
+		error
+	}
+)
+
+// NewNotifier returns a new Notifier instance and starts the workers
+func NewNotifier(conf *config.Notify, prom *prometheus.Prometheus, logger zerolog.Logger) *Notifier {
+	n := &Notifier{
+		client:    &http.Client{},
+		logger:    logger,
+		workers:   defaultWorkers,
+		timeout:   defaultTimeout,
+		retries:   defaultRetries,
+		templates: make(map[string]*template.Template),
+		pending:   make(map[*Request]*time.Timer),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	size := defaultQueueSize
+	if conf != nil {
+		if conf.QueueSize > 0 {
+			size = conf.QueueSize
+		}
+		if conf.Workers > 0 {
+			n.workers = conf.Workers
+		}
+		if conf.Timeout > 0 {
+			n.timeout = time.Duration(conf.Timeout) * time.Second
+		}
+		if conf.Retries != nil && *conf.Retries >= 0 {
+			n.retries = *conf.Retries
+		}
+	}
+	n.queue = make(chan *Request, size)
+	if prom != nil {
+		opts := prometheus.Options{Help: "number of notifications by delivery status"}
+		n.sent, _ = prom.Counter("logtrics_notify_total", map[string]string{"status": "sent"}, opts)
+		n.failed, _ = prom.Counter("logtrics_notify_total", map[string]string{"status": "failed"}, opts)
+		n.dropped, _ = prom.Counter("logtrics_notify_total", map[string]string{"status": "dropped"}, opts)
+	}
+	for i := 0; i < n.workers; i++ {
+		n.wg.Add(1)
+		go n.run()
+	}
+	return n
+}
+
+// Send queues the request, it returns false if the queue is full or the notifier is closed
+// note: this is a non blocking call
+func (n *Notifier) Send(r *Request) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		select {
+		case n.queue <- r:
+			return true
+		default:
+		}
+	}
+	add(n.dropped)
+	n.logger.Warn().Str("url", r.URL).Msg("notification queue full, dropping the notification")
+	return false
+}
+
+// Render returns the body of the template executed with the data. The template functions are json, to encode a value.
+// The values are not escaped, the strings of a json body are encoded with json
+//
+//	{"text": {{ json (printf "%s failed to login" .user) }}, "event": {{ json . }}}
+func (n *Notifier) Render(text string, data interface{}) ([]byte, error) {
+	n.mu.Lock()
+	t, ok := n.templates[text]
+	if !ok {
+		var err error
+		t, err = template.New("notify").Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+		if err != nil {
+			n.mu.Unlock()
+			return nil, fmt.Errorf("invalid template: %s", err.Error())
+		}
+		if len(n.templates) >= maxTemplates {
+			n.templates = make(map[string]*template.Template)
+		}
+		n.templates[text] = t
+	}
+	n.mu.Unlock()
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("failed to render the template: %s", err.Error())
+	}
+	return b.Bytes(), nil
+}
+
+// Close stops accepting the notifications and waits for the queued notifications to be sent, without retries.
+// The notifications waiting for a retry fail and the notifications not sent within the shutdown timeout are dropped
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	for r, timer := range n.pending {
+		timer.Stop()
+		delete(n.pending, r)
+		add(n.failed)
+		n.logger.Error().Str("url", r.URL).Int("attempts", r.attempt).Msg("failed to send the notification before shutdown")
+	}
+	n.mu.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		n.cancel()
+		<-stopped
+		n.logger.Error().Int64("notifications", atomic.LoadInt64(&n.aborted)).Msg("notifications not sent before the shutdown timeout, dropped")
+	}
+	n.cancel()
+}
+
+// run sends the queued requests until the queue is closed, the requests are dropped once the shutdown timeout passes
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for r := range n.queue {
+		if n.ctx.Err() != nil {
+			atomic.AddInt64(&n.aborted, 1)
+			add(n.dropped)
+			continue
+		}
+		n.deliver(r)
+	}
+}
+
+// deliver sends the request. The retryable failures are queued again after an exponential backoff,
+// so the workers keep sending the other requests meanwhile
+func (n *Notifier) deliver(r *Request) {
+	timeout, retries := n.timeout, n.retries
+	if r.Timeout > 0 {
+		timeout = r.Timeout
+	}
+	if r.Retries != nil {
+		retries = *r.Retries
+	}
+	err := n.send(r, timeout)
+	if err == nil {
+		add(n.sent)
+		n.logger.Debug().Str("url", r.URL).Msg("notification sent")
+		return
+	}
+	if _, ok := err.(retryable); !ok || r.attempt >= retries {
+		add(n.failed)
+		n.logger.Error().Err(err).Str("url", r.URL).Int("attempts", r.attempt+1).Msg("failed to send the notification")
+		return
+	}
+	backoff := minBackoff
+	for i := 0; i < r.attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	r.attempt++
+	n.logger.Warn().Err(err).Str("url", r.URL).Dur("backoff", backoff).Msg("retrying the notification")
+	n.retry(r, backoff)
+}
+
+// retry queues the request again after the backoff. The request fails if the notifier is closed
+// and is dropped if the queue is full
+func (n *Notifier) retry(r *Request, backoff time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		add(n.failed)
+		n.logger.Error().Str("url", r.URL).Int("attempts", r.attempt).Msg("failed to send the notification before shutdown")
+		return
+	}
+	n.pending[r] = time.AfterFunc(backoff, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		// the request is removed by Close once it is closed
+		if _, ok := n.pending[r]; !ok {
+			return
+		}
+		delete(n.pending, r)
+		select {
+		case n.queue <- r:
+		default:
+			add(n.dropped)
+			n.logger.Warn().Str("url", r.URL).Msg("notification queue full, dropping the notification retry")
+		}
+	})
+}
+
+// send sends the request, the network errors and the 429 and 5xx statuses are retryable
+func (n *Notifier) send(r *Request, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(n.ctx, timeout)
+	defer cancel()
+	method := r.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return retryable{err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode/100 == 5:
+		return retryable{fmt.Errorf("notification failed with status %d", resp.StatusCode)}
+	}
+	return fmt.Errorf("notification failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// toJSON returns the json encoding of the value for the templates
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func add(s *prometheus.Series) {
+	if s != nil {
+		s.Add(1)
+	}
+}
@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+)
+
+func TestNotifierRetries(t *testing.T) {
+	zero, one := 0, 1
+	tests := []struct {
+		name     string
+		conf     *int
+		request  *int
+		status   int
+		attempts int32
+	}{
+		{name: "default retries", status: http.StatusServiceUnavailable, attempts: defaultRetries + 1},
+		{name: "no retries", conf: &zero, status: http.StatusServiceUnavailable, attempts: 1},
+		{name: "request retries", conf: &zero, request: &one, status: http.StatusTooManyRequests, attempts: 2},
+		{name: "request without retries", request: &zero, status: http.StatusInternalServerError, attempts: 1},
+		{name: "not retryable", status: http.StatusBadRequest, attempts: 1},
+		{name: "sent", status: http.StatusOK, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			n := NewNotifier(&config.Notify{Retries: tt.conf}, nil, zerolog.Nop())
+			defer n.Close()
+			// the backoff of the retries is shortened by sending the queued request again
+			if !n.Send(&Request{URL: server.URL, Retries: tt.request}) {
+				t.Fatal("request not queued")
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			for time.Now().Before(deadline) && atomic.LoadInt32(&attempts) < tt.attempts {
+				time.Sleep(10 * time.Millisecond)
+			}
+			// the unexpected retries would happen within the backoff
+			time.Sleep(minBackoff * 2)
+			if got := atomic.LoadInt32(&attempts); got != tt.attempts {
+				t.Fatalf("expected %d attempts, got %d", tt.attempts, got)
+			}
+		})
+	}
+}
+
+func TestNotifierRetryDoesNotBlockWorker(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	sent := make(chan struct{}, 1)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- struct{}{}
+	}))
+	defer ok.Close()
+
+	n := NewNotifier(&config.Notify{Workers: 1}, nil, zerolog.Nop())
+	defer n.Close()
+	n.Send(&Request{URL: failing.URL})
+	n.Send(&Request{URL: ok.URL})
+	select {
+	case <-sent:
+	case <-time.After(minBackoff / 2):
+		t.Fatal("the request was delayed by the retries of the failing endpoint")
+	}
+}
+
+func TestNotifierCloseFailsPendingRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	n := NewNotifier(nil, nil, zerolog.Nop())
+	n.Send(&Request{URL: server.URL})
+	for atomic.LoadInt32(&attempts) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	n.Close()
+	if d := time.Since(start); d > minBackoff {
+		t.Fatalf("close waited %s for the pending retry", d)
+	}
+	time.Sleep(minBackoff * 2)
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("expected no retry after close, got %d attempts", got)
+	}
+}
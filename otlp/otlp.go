@@ -0,0 +1,318 @@
+// Package otlp is responsible for exporting metrics to OpenTelemetry collectors over OTLP/gRPC or OTLP/HTTP
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+)
+
+const (
+	// scopeName is the instrumentation scope of the exported metrics
+	scopeName = "github.com/smitajit/logtrics"
+
+	kindCounter = iota
+	kindGauge
+	kindHistogram
+	// kindTimer is the histogram of the durations in seconds
+	kindTimer
+)
+
+//nolint:gochecknoglobals
+var (
+	// defaultBounds are the explicit bucket boundaries of the histograms, same as the OpenTelemetry SDK defaults
+	defaultBounds = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+	// timerBounds are the explicit bucket boundaries of the timers in seconds
+	timerBounds = []float64{0, 0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+)
+
+type (
+	// Exporter represents the OTLP module of the application
+	// It aggregates the metrics cumulatively and exports them in a single request in regular interval (config.OTLP.Interval).
+	// The failed exports are retried with exponential backoff (config.OTLP.Retries)
+	Exporter struct {
+		conf      *config.OTLP
+		logger    zerolog.Logger
+		transport transport
+		resource  []attribute
+		start     time.Time
+		done      chan struct{}
+		stopped   chan struct{}
+		closed    sync.Once
+
+		mu          sync.Mutex
+		instruments map[string]*instrument
+		order       []string
+	}
+
+	// transport sends the encoded ExportMetricsServiceRequest
+	transport interface {
+		send(ctx context.Context, body []byte) error
+		close() error
+	}
+
+	// retryable is the error of a failed export which can be retried
+	retryable struct {
+		error
+	}
+
+	attribute struct {
+		key   string
+		value string
+	}
+
+	// instrument is the cumulative aggregation of a metric with its attributes
+	instrument struct {
+		name       string
+		kind       int
+		attributes []attribute
+		value      float64
+		count      uint64
+		sum        float64
+		min        float64
+		max        float64
+		counts     []uint64
+		bounds     []float64
+	}
+
+	// snapshot is the data point of an instrument at the time of the export
+	snapshot struct {
+		instrument
+		start time.Time
+		time  time.Time
+	}
+)
+
+// NewExporter returns a new Exporter instance
+func NewExporter(conf *config.Configuration, logger zerolog.Logger) (*Exporter, error) {
+	c := conf.OTLP
+	if c == nil || c.Endpoint == "" {
+		return nil, fmt.Errorf("invalid otlp configuration")
+	}
+	var (
+		t   transport
+		err error
+	)
+	switch c.Protocol {
+	case "", "grpc":
+		t, err = newGRPC(c)
+	case "http":
+		t, err = newHTTP(c)
+	default:
+		err = fmt.Errorf("invalid otlp protocol %s", c.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		conf:        c,
+		logger:      logger,
+		transport:   t,
+		resource:    resource(c),
+		start:       time.Now(),
+		done:        make(chan struct{}),
+		instruments: make(map[string]*instrument),
+	}, nil
+}
+
+// resource returns the resource attributes, service.name and host.name are set unless configured
+func resource(c *config.OTLP) []attribute {
+	attrs := make(map[string]string)
+	for k, v := range c.Attributes {
+		attrs[k] = v
+	}
+	if _, ok := attrs["service.name"]; !ok {
+		attrs["service.name"] = "logtrics"
+		if c.ServiceName != "" {
+			attrs["service.name"] = c.ServiceName
+		}
+	}
+	if _, ok := attrs["host.name"]; !ok {
+		if host, err := os.Hostname(); err == nil {
+			attrs["host.name"] = host
+		}
+	}
+	return attributes(attrs)
+}
+
+func attributes(m map[string]string) []attribute {
+	attrs := make([]attribute, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, attribute{key: k, value: v})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].key < attrs[j].key })
+	return attrs
+}
+
+// Start starts the thread which exports the metrics in regular interval, until the context is done or the exporter is closed
+func (e *Exporter) Start(ctx context.Context) {
+	interval := 10 * time.Second
+	if e.conf.Interval > 0 {
+		interval = time.Second * time.Duration(e.conf.Interval)
+	}
+	e.stopped = make(chan struct{})
+	go func() {
+		defer close(e.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.export(ctx)
+			case <-ctx.Done():
+				return
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the thread, exports the metrics one last time and closes the connection
+// It returns once the last export is done
+func (e *Exporter) Close() error {
+	var err error
+	e.closed.Do(func() {
+		close(e.done)
+		if e.stopped != nil {
+			<-e.stopped
+		}
+		// the last export gets its own deadline, the context of the application is done
+		e.export(context.Background())
+		err = e.transport.close()
+	})
+	return err
+}
+
+// Counter adds the value to the monotonic sum
+func (e *Exporter) Counter(name string, attrs map[string]string, v float64) error {
+	if v < 0 {
+		return fmt.Errorf("counter %s can not be decreased", name)
+	}
+	return e.record(name, kindCounter, attrs, func(i *instrument) { i.value += v })
+}
+
+// Gauge sets the last value of the gauge
+func (e *Exporter) Gauge(name string, attrs map[string]string, v float64) error {
+	return e.record(name, kindGauge, attrs, func(i *instrument) { i.value = v })
+}
+
+// Histogram records the value in the explicit bucket histogram
+func (e *Exporter) Histogram(name string, attrs map[string]string, v float64) error {
+	return e.record(name, kindHistogram, attrs, observe(v))
+}
+
+// Timer records the duration in seconds in the explicit bucket histogram with the timer bounds
+func (e *Exporter) Timer(name string, attrs map[string]string, d time.Duration) error {
+	return e.record(name, kindTimer, attrs, observe(d.Seconds()))
+}
+
+// observe returns the function recording the value in the histogram instrument
+func observe(v float64) func(*instrument) {
+	return func(i *instrument) {
+		if i.count == 0 || v < i.min {
+			i.min = v
+		}
+		if i.count == 0 || v > i.max {
+			i.max = v
+		}
+		i.count++
+		i.sum += v
+		i.counts[sort.SearchFloat64s(i.bounds, v)]++
+	}
+}
+
+func (e *Exporter) record(name string, kind int, attrs map[string]string, fn func(*instrument)) error {
+	if name == "" {
+		return fmt.Errorf("invalid metric name")
+	}
+	sorted := attributes(attrs)
+	var key strings.Builder
+	key.WriteString(name)
+	for _, a := range sorted {
+		key.WriteString("\xff" + a.key + "=" + a.value)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i, ok := e.instruments[key.String()]
+	if !ok {
+		for _, k := range e.order {
+			if other := e.instruments[k]; other.name == name && other.kind != kind {
+				return fmt.Errorf("metric %s is already registered with a different type", name)
+			}
+		}
+		i = &instrument{name: name, kind: kind, attributes: sorted}
+		switch kind {
+		case kindHistogram:
+			i.bounds = defaultBounds
+		case kindTimer:
+			i.bounds = timerBounds
+		}
+		if i.bounds != nil {
+			i.counts = make([]uint64, len(i.bounds)+1)
+		}
+		e.instruments[key.String()] = i
+		e.order = append(e.order, key.String())
+	}
+	fn(i)
+	return nil
+}
+
+// snapshots returns the data points of all the instruments
+func (e *Exporter) snapshots(now time.Time) []snapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	snapshots := make([]snapshot, 0, len(e.order))
+	for _, k := range e.order {
+		i := *e.instruments[k]
+		i.counts = append([]uint64(nil), i.counts...)
+		snapshots = append(snapshots, snapshot{instrument: i, start: e.start, time: now})
+	}
+	return snapshots
+}
+
+// export sends the data points, retrying the retryable failures with exponential backoff
+func (e *Exporter) export(ctx context.Context) {
+	snapshots := e.snapshots(time.Now())
+	if len(snapshots) == 0 {
+		return
+	}
+	body := e.encodeRequest(snapshots)
+	timeout := 10 * time.Second
+	if e.conf.Timeout > 0 {
+		timeout = time.Second * time.Duration(e.conf.Timeout)
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		c, cancel := context.WithTimeout(ctx, timeout)
+		err := e.transport.send(c, body)
+		cancel()
+		if err == nil {
+			e.logger.Debug().Int("points", len(snapshots)).Msg("exported otlp metrics")
+			return
+		}
+		if _, ok := err.(retryable); !ok || attempt >= e.conf.Retries {
+			e.logger.Error().Err(err).Int("points", len(snapshots)).Msg("failed to export otlp metrics")
+			return
+		}
+		e.logger.Warn().Err(err).Dur("backoff", backoff).Msg("retrying otlp export")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			e.logger.Error().Err(err).Int("points", len(snapshots)).Msg("failed to export otlp metrics")
+			return
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
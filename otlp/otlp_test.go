@@ -0,0 +1,250 @@
+package otlp
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fields decodes the fields of a protobuf message by their number, the length delimited values are returned as bytes,
+// fixed64 values as uint64
+func fields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	t.Helper()
+	m := make(map[protowire.Number][]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			m[num] = append(m[num], v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			m[num] = append(m[num], v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return m
+}
+
+// sums decodes the ExportMetricsServiceRequest and returns the value of the first data point of each sum metric
+func sums(t *testing.T, body []byte) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64)
+	for _, rm := range fields(t, body)[1] {
+		for _, sm := range fields(t, rm.([]byte))[2] {
+			for _, metric := range fields(t, sm.([]byte))[2] {
+				f := fields(t, metric.([]byte))
+				if len(f[1]) == 0 || len(f[7]) == 0 {
+					continue
+				}
+				name := string(f[1][0].([]byte))
+				point := fields(t, fields(t, f[7][0].([]byte))[1][0].([]byte))
+				values[name] = math.Float64frombits(point[4][0].(uint64))
+			}
+		}
+	}
+	return values
+}
+
+func TestExporterCloseExportsOverHTTP(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies [][]byte
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read the request: %v", err)
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	conf := &config.Configuration{OTLP: &config.OTLP{Protocol: "http", Endpoint: receiver.URL, Interval: 3600}}
+	e, err := NewExporter(conf, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.Start(ctx)
+	if err := e.Counter("requests", map[string]string{"status": "200"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Counter("requests", map[string]string{"status": "200"}, 1.5); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 export on close, got %d", len(bodies))
+	}
+	if v, ok := sums(t, bodies[0])["requests"]; !ok || v != 3.5 {
+		t.Fatalf("expected requests = 3.5, got %v (found %v)", v, ok)
+	}
+}
+
+// histograms decodes the ExportMetricsServiceRequest and returns the unit, the bucket counts and the bounds
+// of the first data point of each histogram metric
+func histograms(t *testing.T, body []byte) map[string]histogram {
+	t.Helper()
+	values := make(map[string]histogram)
+	for _, rm := range fields(t, body)[1] {
+		for _, sm := range fields(t, rm.([]byte))[2] {
+			for _, metric := range fields(t, sm.([]byte))[2] {
+				f := fields(t, metric.([]byte))
+				if len(f[1]) == 0 || len(f[9]) == 0 {
+					continue
+				}
+				var h histogram
+				if len(f[3]) > 0 {
+					h.unit = string(f[3][0].([]byte))
+				}
+				point := fields(t, fields(t, f[9][0].([]byte))[1][0].([]byte))
+				for b := point[6][0].([]byte); len(b) > 0; b = b[8:] {
+					v, _ := protowire.ConsumeFixed64(b)
+					h.counts = append(h.counts, v)
+				}
+				for b := point[7][0].([]byte); len(b) > 0; b = b[8:] {
+					v, _ := protowire.ConsumeFixed64(b)
+					h.bounds = append(h.bounds, math.Float64frombits(v))
+				}
+				values[string(f[1][0].([]byte))] = h
+			}
+		}
+	}
+	return values
+}
+
+type histogram struct {
+	unit   string
+	counts []uint64
+	bounds []float64
+}
+
+func TestExporterHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(e *Exporter) error
+		unit   string
+		bounds []float64
+		bucket int
+	}{
+		{
+			name:   "histogram",
+			record: func(e *Exporter) error { return e.Histogram("size", nil, 7) },
+			bounds: defaultBounds,
+			bucket: 2,
+		},
+		{
+			name:   "histogram on bound",
+			record: func(e *Exporter) error { return e.Histogram("size", nil, 10) },
+			bounds: defaultBounds,
+			bucket: 2,
+		},
+		{
+			name:   "histogram over the last bound",
+			record: func(e *Exporter) error { return e.Histogram("size", nil, 20000) },
+			bounds: defaultBounds,
+			bucket: len(defaultBounds),
+		},
+		{
+			name:   "timer in seconds",
+			record: func(e *Exporter) error { return e.Timer("size", nil, 30*time.Millisecond) },
+			unit:   "s",
+			bounds: timerBounds,
+			bucket: 4,
+		},
+		{
+			name:   "timer over a second",
+			record: func(e *Exporter) error { return e.Timer("size", nil, 1500*time.Millisecond) },
+			unit:   "s",
+			bounds: timerBounds,
+			bucket: 11,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &config.Configuration{OTLP: &config.OTLP{Protocol: "http", Endpoint: "http://127.0.0.1:4318"}}
+			e, err := NewExporter(conf, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.record(e); err != nil {
+				t.Fatal(err)
+			}
+			h, ok := histograms(t, e.encodeRequest(e.snapshots(time.Now())))["size"]
+			if !ok {
+				t.Fatal("histogram not exported")
+			}
+			if h.unit != tt.unit {
+				t.Errorf("expected unit %q, got %q", tt.unit, h.unit)
+			}
+			if !reflect.DeepEqual(h.bounds, tt.bounds) {
+				t.Errorf("expected bounds %v, got %v", tt.bounds, h.bounds)
+			}
+			if len(h.counts) != len(tt.bounds)+1 {
+				t.Fatalf("expected %d buckets, got %d", len(tt.bounds)+1, len(h.counts))
+			}
+			for i, c := range h.counts {
+				want := uint64(0)
+				if i == tt.bucket {
+					want = 1
+				}
+				if c != want {
+					t.Errorf("expected count %d in bucket %d, got %d", want, i, c)
+				}
+			}
+		})
+	}
+}
+
+func TestExporterRejectsKindChange(t *testing.T) {
+	conf := &config.Configuration{OTLP: &config.OTLP{Protocol: "http", Endpoint: "http://127.0.0.1:4318"}}
+	e, err := NewExporter(conf, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Histogram("latency", nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Timer("latency", map[string]string{"path": "/"}, time.Second); err == nil {
+		t.Fatal("expected an error for a timer with the name of a histogram")
+	}
+}
@@ -0,0 +1,158 @@
+package otlp
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobuf encoding of the OTLP metrics messages
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+const (
+	// temporalityCumulative is the AggregationTemporality of the exported metrics
+	temporalityCumulative = 2
+)
+
+// encodeRequest encodes the ExportMetricsServiceRequest
+func (e *Exporter) encodeRequest(snapshots []snapshot) []byte {
+	var scope []byte
+	scope = appendMessage(scope, 1, func(b []byte) []byte {
+		return appendString(b, 1, scopeName)
+	})
+	// metrics with same name are grouped in a single Metric
+	var (
+		names  []string
+		points = make(map[string][]snapshot)
+	)
+	for _, s := range snapshots {
+		if _, ok := points[s.name]; !ok {
+			names = append(names, s.name)
+		}
+		points[s.name] = append(points[s.name], s)
+	}
+	for _, name := range names {
+		scope = appendMessage(scope, 2, func(b []byte) []byte {
+			return encodeMetric(b, points[name])
+		})
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, func(b []byte) []byte {
+		for _, a := range e.resource {
+			b = appendMessage(b, 1, func(b []byte) []byte { return encodeKeyValue(b, a) })
+		}
+		return b
+	})
+	resourceMetrics = protowire.AppendTag(resourceMetrics, 2, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, scope)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	return protowire.AppendBytes(request, resourceMetrics)
+}
+
+// encodeMetric encodes the Metric with the data points
+func encodeMetric(b []byte, points []snapshot) []byte {
+	b = appendString(b, 1, points[0].name)
+	if points[0].kind == kindTimer {
+		b = appendString(b, 3, "s")
+	}
+	switch points[0].kind {
+	case kindCounter:
+		b = appendMessage(b, 7, func(b []byte) []byte {
+			for _, p := range points {
+				b = appendMessage(b, 1, p.encodeNumber)
+			}
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, temporalityCumulative)
+			b = protowire.AppendTag(b, 3, protowire.VarintType)
+			return protowire.AppendVarint(b, 1)
+		})
+	case kindGauge:
+		b = appendMessage(b, 5, func(b []byte) []byte {
+			for _, p := range points {
+				b = appendMessage(b, 1, p.encodeNumber)
+			}
+			return b
+		})
+	case kindHistogram, kindTimer:
+		b = appendMessage(b, 9, func(b []byte) []byte {
+			for _, p := range points {
+				b = appendMessage(b, 1, p.encodeHistogram)
+			}
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			return protowire.AppendVarint(b, temporalityCumulative)
+		})
+	}
+	return b
+}
+
+// encodeNumber encodes the NumberDataPoint
+func (s snapshot) encodeNumber(b []byte) []byte {
+	b = appendFixed64(b, 2, uint64(s.start.UnixNano()))
+	b = appendFixed64(b, 3, uint64(s.time.UnixNano()))
+	b = appendDouble(b, 4, s.value)
+	for _, a := range s.attributes {
+		b = appendMessage(b, 7, func(b []byte) []byte { return encodeKeyValue(b, a) })
+	}
+	return b
+}
+
+// encodeHistogram encodes the HistogramDataPoint
+func (s snapshot) encodeHistogram(b []byte) []byte {
+	b = appendFixed64(b, 2, uint64(s.start.UnixNano()))
+	b = appendFixed64(b, 3, uint64(s.time.UnixNano()))
+	b = appendFixed64(b, 4, s.count)
+	b = appendDouble(b, 5, s.sum)
+
+	var counts []byte
+	for _, c := range s.counts {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, counts)
+
+	var bounds []byte
+	for _, bound := range s.bounds {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+	}
+	b = protowire.AppendTag(b, 7, protowire.BytesType)
+	b = protowire.AppendBytes(b, bounds)
+
+	for _, a := range s.attributes {
+		b = appendMessage(b, 9, func(b []byte) []byte { return encodeKeyValue(b, a) })
+	}
+	if s.count > 0 {
+		b = appendDouble(b, 11, s.min)
+		b = appendDouble(b, 12, s.max)
+	}
+	return b
+}
+
+// encodeKeyValue encodes the KeyValue with string AnyValue
+func encodeKeyValue(b []byte, a attribute) []byte {
+	b = appendString(b, 1, a.key)
+	return appendMessage(b, 2, func(b []byte) []byte {
+		return appendString(b, 1, a.value)
+	})
+}
+
+func appendMessage(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendFixed64(b, num, math.Float64bits(v))
+}
@@ -0,0 +1,150 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/smitajit/logtrics/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// exportMethod is the gRPC method of the OTLP metrics service
+	exportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+	// metricsPath is the default path of the OTLP/HTTP metrics receiver
+	metricsPath = "/v1/metrics"
+)
+
+type (
+	// grpcTransport sends the requests with the OTLP/gRPC protocol
+	grpcTransport struct {
+		conn    *grpc.ClientConn
+		headers metadata.MD
+	}
+
+	// httpTransport sends the requests with the OTLP/HTTP protocol in binary protobuf encoding
+	httpTransport struct {
+		url     string
+		headers map[string]string
+		client  *http.Client
+	}
+
+	// rawCodec passes the already encoded messages to the gRPC transport
+	rawCodec struct{}
+)
+
+func newGRPC(c *config.OTLP) (*grpcTransport, error) {
+	creds := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	if c.Insecure {
+		creds = grpc.WithInsecure()
+	}
+	conn, err := grpc.Dial(c.Endpoint, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTransport{conn: conn, headers: metadata.New(c.Headers)}, nil
+}
+
+func (t *grpcTransport) send(ctx context.Context, body []byte) error {
+	ctx = metadata.NewOutgoingContext(ctx, t.headers)
+	var reply []byte
+	err := t.conn.Invoke(ctx, exportMethod, &body, &reply, grpc.ForceCodec(rawCodec{}))
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return retryable{err}
+	}
+	return err
+}
+
+func (t *grpcTransport) close() error {
+	return t.conn.Close()
+}
+
+func newHTTP(c *config.OTLP) (*httpTransport, error) {
+	endpoint := c.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+		if c.Insecure {
+			endpoint = "http://" + c.Endpoint
+		}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint %q", c.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = metricsPath
+	}
+	return &httpTransport{
+		url:     u.String(),
+		headers: c.Headers,
+		client:  &http.Client{},
+	}, nil
+}
+
+func (t *httpTransport) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return retryable{err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		return retryable{fmt.Errorf("otlp export failed with status %d", resp.StatusCode)}
+	}
+	return fmt.Errorf("otlp export failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+func (t *httpTransport) close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
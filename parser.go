@@ -3,8 +3,12 @@ package logtrics
 import (
 	"fmt"
 	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -14,14 +18,52 @@ type (
 		FindSubStrings(s string) (map[string]string, bool)
 	}
 
+	// Anchored is implemented by the parsers which can only match strings containing one of the anchors.
+	// It's used to skip the parsers cheaply before running the full parsing.
+	// nil anchors means the parser can match any string
+	Anchored interface {
+		Anchors() []string
+	}
+
 	// RE2 represents RE2 expression parser
 	RE2 struct {
 		regexp *regexp.Regexp
 	}
+
+	// Lua represents the parser implemented by a lua function
+	// The function receives the line and returns the fields table or nil for no match
+	Lua struct {
+		state  *lua.LState
+		fn     *lua.LFunction
+		logger zerolog.Logger
+	}
+
+	// FirstMatch represents the list of alternative parsers
+	// The first matching parser wins and its name is exposed as `_parser` field
+	FirstMatch struct {
+		names   []string
+		parsers []Parser
+	}
+
+	// Pipeline represents the list of parsers applied one after another
+	// Each stage parses the `input` field of the previous stages (the line by default),
+	// the fields of all the stages are merged
+	Pipeline struct {
+		inputs  []string
+		parsers []Parser
+	}
 )
 
 // NewParser returns a new parser instance
-func NewParser(table *lua.LTable) (Parser, error) {
+// The parser can be a table with the parser type or a lua function
+func NewParser(state *lua.LState, v lua.LValue, logger zerolog.Logger) (Parser, error) {
+	if fn, ok := v.(*lua.LFunction); ok {
+		return &Lua{state: state, fn: fn, logger: logger}, nil
+	}
+	table, ok := v.(*lua.LTable)
+	if !ok || table == nil {
+		return nil, fmt.Errorf("parser not found")
+	}
 	t := table.RawGet(lua.LString("type")).String()
 	switch t {
 	case "re2":
@@ -30,6 +72,22 @@ func NewParser(table *lua.LTable) (Parser, error) {
 			return nil, errors.Wrap(err, "invalid regular expression")
 		}
 		return &RE2{regexp: regexp}, nil
+	case "lua":
+		fn, ok := table.RawGet(lua.LString("fn")).(*lua.LFunction)
+		if !ok {
+			return nil, fmt.Errorf("lua parser function not found")
+		}
+		return &Lua{state: state, fn: fn, logger: logger}, nil
+	case "cef":
+		return &CEF{}, nil
+	case "leef":
+		return &LEEF{}, nil
+	case "json":
+		return &JSON{}, nil
+	case "first":
+		return newFirstMatch(state, table, logger)
+	case "pipeline":
+		return newPipeline(state, table, logger)
 
 	default:
 		return nil, fmt.Errorf("parser type not found")
@@ -38,11 +96,11 @@ func NewParser(table *lua.LTable) (Parser, error) {
 
 // FindSubStrings extracts the sub strings from the string
 func (p *RE2) FindSubStrings(s string) (map[string]string, bool) {
-	if ok := p.regexp.MatchString(s); !ok {
+	matches := p.regexp.FindStringSubmatch(s)
+	if matches == nil {
 		return nil, false
 	}
 	results := make(map[string]string)
-	matches := p.regexp.FindStringSubmatch(s)
 	n := p.regexp.SubexpNames()
 	for i, exp := range n {
 		if i >= len(matches) {
@@ -55,3 +113,211 @@ func (p *RE2) FindSubStrings(s string) (map[string]string, bool) {
 	}
 	return results, true
 }
+
+// Anchors returns the longest literal required by the expression
+func (p *RE2) Anchors() []string {
+	re, err := syntax.Parse(p.regexp.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	var anchor string
+	for _, lit := range requiredLiterals(re.Simplify()) {
+		if len(lit) > len(anchor) {
+			anchor = lit
+		}
+	}
+	if anchor == "" {
+		return nil
+	}
+	return []string{anchor}
+}
+
+// requiredLiterals returns the literals which are present in every string matching the expression
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var (
+			lits []string
+			cur  strings.Builder
+		)
+		flush := func() {
+			if cur.Len() > 0 {
+				lits = append(lits, cur.String())
+				cur.Reset()
+			}
+		}
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				cur.WriteString(string(sub.Rune))
+				continue
+			}
+			flush()
+			lits = append(lits, requiredLiterals(sub)...)
+		}
+		flush()
+		return lits
+	}
+	return nil
+}
+
+// FindSubStrings calls the lua function with the string and returns the fields from the returned table
+// nil or false return value is considered as no match
+func (p *Lua) FindSubStrings(s string) (map[string]string, bool) {
+	err := p.state.CallByParam(lua.P{
+		Fn:      p.fn,
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(s))
+	if err != nil {
+		p.logger.Error().Err(err).Msg("lua parser execution error")
+		return nil, false
+	}
+	ret := p.state.Get(-1)
+	p.state.Pop(1)
+
+	table, ok := ret.(*lua.LTable)
+	if !ok {
+		if lua.LVAsBool(ret) {
+			p.logger.Error().Msgf("lua parser returned [%s], expected table or nil", ret.Type())
+		}
+		return nil, false
+	}
+	results := make(map[string]string)
+	table.ForEach(func(k, v lua.LValue) {
+		switch v.(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			results[k.String()] = v.String()
+		}
+	})
+	return results, true
+}
+
+func newFirstMatch(state *lua.LState, table *lua.LTable, logger zerolog.Logger) (Parser, error) {
+	p := &FirstMatch{}
+	err := forEachParser(state, table, logger, func(i int, t *lua.LTable, parser Parser) {
+		name := strconv.Itoa(i)
+		if t != nil {
+			if n := t.RawGet(lua.LString("name")); n != lua.LNil {
+				name = n.String()
+			}
+		}
+		p.names = append(p.names, name)
+		p.parsers = append(p.parsers, parser)
+	})
+	return p, err
+}
+
+func newPipeline(state *lua.LState, table *lua.LTable, logger zerolog.Logger) (Parser, error) {
+	p := &Pipeline{}
+	err := forEachParser(state, table, logger, func(i int, t *lua.LTable, parser Parser) {
+		input := ""
+		if t != nil {
+			if in := t.RawGet(lua.LString("input")); in != lua.LNil {
+				input = in.String()
+			}
+		}
+		p.inputs = append(p.inputs, input)
+		p.parsers = append(p.parsers, parser)
+	})
+	return p, err
+}
+
+// forEachParser creates the parsers listed in the `parsers` key of the table
+func forEachParser(state *lua.LState, table *lua.LTable, logger zerolog.Logger, fn func(int, *lua.LTable, Parser)) error {
+	list, ok := table.RawGet(lua.LString("parsers")).(*lua.LTable)
+	if !ok || list.Len() == 0 {
+		return fmt.Errorf("parsers list not found")
+	}
+	for i := 1; i <= list.Len(); i++ {
+		v := list.RawGetInt(i)
+		parser, err := NewParser(state, v, logger)
+		if err != nil {
+			return errors.Wrapf(err, "invalid parser at index %d", i)
+		}
+		t, _ := v.(*lua.LTable)
+		fn(i, t, parser)
+	}
+	return nil
+}
+
+// Anchors returns the anchors of all the alternatives
+// nil if any of the alternatives can match any string
+func (p *FirstMatch) Anchors() []string {
+	var all []string
+	for _, parser := range p.parsers {
+		a := anchors(parser)
+		if a == nil {
+			return nil
+		}
+		all = append(all, a...)
+	}
+	return all
+}
+
+// Anchors returns the anchors of the first stage parsing the line
+func (p *Pipeline) Anchors() []string {
+	for i, parser := range p.parsers {
+		if p.inputs[i] == "" {
+			return anchors(parser)
+		}
+	}
+	return nil
+}
+
+// anchors returns the anchors of the parser, nil if the parser is not Anchored
+func anchors(p Parser) []string {
+	if a, ok := p.(Anchored); ok {
+		return a.Anchors()
+	}
+	return nil
+}
+
+// FindSubStrings returns the sub strings of the first matching parser
+func (p *FirstMatch) FindSubStrings(s string) (map[string]string, bool) {
+	for i, parser := range p.parsers {
+		results, ok := parser.FindSubStrings(s)
+		if !ok {
+			continue
+		}
+		if results == nil {
+			results = make(map[string]string)
+		}
+		results["_parser"] = p.names[i]
+		return results, true
+	}
+	return nil, false
+}
+
+// FindSubStrings runs the parsers in order, all the stages are required to match
+func (p *Pipeline) FindSubStrings(s string) (map[string]string, bool) {
+	results := make(map[string]string)
+	for i, parser := range p.parsers {
+		input := s
+		if p.inputs[i] != "" {
+			v, ok := results[p.inputs[i]]
+			if !ok {
+				return nil, false
+			}
+			input = v
+		}
+		fields, ok := parser.FindSubStrings(input)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range fields {
+			results[k] = v
+		}
+	}
+	return results, true
+}
@@ -0,0 +1,75 @@
+package logtrics
+
+import (
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"testing"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       []string
+	}{
+		{`ERROR`, []string{"ERROR"}},
+		{`^\d+ ERROR (?P<msg>.*)$`, []string{" ERROR "}},
+		{`(?P<level>WARN|ERROR): (?P<msg>.*)`, []string{": "}},
+		{`(?i)error`, nil},
+		{`status=(?P<status>\d+) took (?P<took>\d+)ms`, []string{"status=", " took ", "ms"}},
+		{`(abc)+x`, []string{"abc", "x"}},
+		{`a{2}b`, []string{"aa", "b"}},
+		{`(abc)?x`, []string{"x"}},
+		{`(abc)*`, nil},
+		{`.*`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			re, err := syntax.Parse(tt.expression, syntax.Perl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requiredLiterals(re.Simplify()); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAnchors(t *testing.T) {
+	re2 := func(expression string) Parser { return &RE2{regexp: regexp.MustCompile(expression)} }
+	tests := []struct {
+		name   string
+		parser Parser
+		want   []string
+	}{
+		{name: "longest literal", parser: re2(`status=(?P<status>\d+) took (?P<took>\d+)ms`), want: []string{"status="}},
+		{name: "no literal", parser: re2(`(?P<msg>.*)`), want: nil},
+		{name: "json", parser: &JSON{}, want: []string{"{"}},
+		{name: "cef", parser: &CEF{}, want: []string{"CEF:"}},
+		{name: "leef", parser: &LEEF{}, want: []string{"LEEF:"}},
+		{name: "lua", parser: &Lua{}, want: nil},
+		{
+			name:   "first match",
+			parser: &FirstMatch{parsers: []Parser{re2(`ERROR`), &JSON{}}},
+			want:   []string{"ERROR", "{"},
+		},
+		{
+			name:   "first match with unanchored alternative",
+			parser: &FirstMatch{parsers: []Parser{re2(`ERROR`), re2(`.*`)}},
+			want:   nil,
+		},
+		{
+			name:   "pipeline",
+			parser: &Pipeline{inputs: []string{"", "msg"}, parsers: []Parser{re2(`ERROR (?P<msg>.*)`), &JSON{}}},
+			want:   []string{"ERROR "},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := anchors(tt.parser); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package logtrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/smitajit/logtrics/graphite"
+)
+
+//nolint:gochecknoglobals
+var prefixVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+type (
+	// Prefix is the prefix of the metric names, rendered from the templates of the configuration and of the logtric
+	// The variables {host}, {script}, {logtric} and {env:NAME} are replaced when the prefix is created,
+	// {reader} is replaced with the reader of the event. Each value is a single node of the metric path
+	//
+	//	logtrics.{host}.{script}.{reader} => logtrics.web-1.nginx.udp
+	Prefix struct {
+		template string
+	}
+)
+
+// NewPrefix returns a new Prefix instance of the templates joined with dots
+func NewPrefix(vars map[string]string, templates ...string) (*Prefix, error) {
+	var (
+		nodes []string
+		err   error
+	)
+	for _, t := range templates {
+		rendered := prefixVariable.ReplaceAllStringFunc(t, func(v string) string {
+			name := v[1 : len(v)-1]
+			switch {
+			case name == "reader":
+				return v
+			case strings.HasPrefix(name, "env:"):
+				return graphite.SanitizeNode(os.Getenv(strings.TrimPrefix(name, "env:")))
+			}
+			value, ok := vars[name]
+			if !ok && err == nil {
+				err = fmt.Errorf("invalid prefix variable %s", v)
+			}
+			return graphite.SanitizeNode(value)
+		})
+		if rendered != "" {
+			nodes = append(nodes, rendered)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Prefix{template: strings.Join(nodes, ".")}, nil
+}
+
+// Name returns the metric name with the prefix, the name is returned as is if the prefix is empty
+func (p *Prefix) Name(reader, name string) string {
+	if p == nil || p.template == "" {
+		return name
+	}
+	prefix := graphite.SanitizeName(strings.Replace(p.template, "{reader}", graphite.SanitizeNode(reader), -1))
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// prefixVariables returns the variables of the prefix templates of the script and of the logtric
+// The logtric is empty for the metrics recorded outside of the handlers
+func prefixVariables(path, logtric string) map[string]string {
+	host, _ := os.Hostname()
+	return map[string]string{
+		"host":    host,
+		"script":  strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		"logtric": logtric,
+	}
+}
+
+// readerName returns the name of the reader of the event source. e.g. UDP:127.0.0.1:5000 => udp
+func readerName(source string) string {
+	if i := strings.IndexByte(source, ':'); i >= 0 {
+		source = source[:i]
+	}
+	return strings.ToLower(source)
+}
@@ -0,0 +1,486 @@
+// Package prometheus is responsible for exposing metrics in prometheus text exposition format
+package prometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	goMetrics "github.com/rcrowley/go-metrics"
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+	summaryType   = "summary"
+
+	// sampleScale is the scale of the summary observations stored in the integer sample
+	sampleScale = 1e6
+)
+
+//nolint:gochecknoglobals
+var (
+	// DefaultBuckets are the default histogram buckets
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// DefaultQuantiles are the default summary quantiles
+	DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+type (
+	// Prometheus represents the prometheus module of the application
+	// It stores the metric families and serves them on the scrape endpoint
+	Prometheus struct {
+		conf   *config.Configuration
+		logger zerolog.Logger
+
+		mu       sync.Mutex
+		families map[string]*family
+	}
+
+	// family represents the metrics with same name and different label values
+	family struct {
+		name       string
+		help       string
+		kind       string
+		labelNames []string
+		buckets    []float64
+		quantiles  []float64
+
+		mu     sync.Mutex
+		series map[string]*Series
+	}
+
+	// Series represents a single metric with its label values
+	Series struct {
+		family *family
+		labels []string
+
+		mu     sync.Mutex
+		value  float64
+		counts []uint64
+		sum    float64
+		count  uint64
+		sample goMetrics.Sample
+	}
+
+	// Options represents the optional metric properties
+	Options struct {
+		Help      string
+		Buckets   []float64
+		Quantiles []float64
+	}
+)
+
+// NewPrometheus returns a new Prometheus instance
+func NewPrometheus(conf *config.Configuration, logger zerolog.Logger) *Prometheus {
+	return &Prometheus{
+		conf:     conf,
+		logger:   logger,
+		families: make(map[string]*family),
+	}
+}
+
+// Enabled returns true if the scrape endpoint is configured
+func (p *Prometheus) Enabled() bool {
+	return p.conf.Prometheus != nil && p.conf.Prometheus.Port != 0
+}
+
+// Start starts the http server serving the metrics on the configured path
+// The server is stopped when the context is done
+func (p *Prometheus) Start(ctx context.Context) error {
+	if !p.Enabled() {
+		return nil
+	}
+	addr := fmt.Sprintf("%s:%d", p.conf.Prometheus.Host, p.conf.Prometheus.Port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to start prometheus server")
+	}
+	path := p.conf.Prometheus.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, p)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	p.logger.Debug().Msgf("prometheus server started at [%s%s]", addr, path)
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			p.logger.Error().Err(err).Msg("prometheus server failed")
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP writes the metrics in text exposition format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	p.Write(b)
+	_ = b.Flush()
+}
+
+// Counter returns the counter series for the name and labels
+func (p *Prometheus) Counter(name string, labels map[string]string, opts Options) (*Series, error) {
+	return p.series(counterType, name, labels, opts)
+}
+
+// Gauge returns the gauge series for the name and labels
+func (p *Prometheus) Gauge(name string, labels map[string]string, opts Options) (*Series, error) {
+	return p.series(gaugeType, name, labels, opts)
+}
+
+// Histogram returns the histogram series for the name and labels
+func (p *Prometheus) Histogram(name string, labels map[string]string, opts Options) (*Series, error) {
+	return p.series(histogramType, name, labels, opts)
+}
+
+// Summary returns the summary series for the name and labels
+func (p *Prometheus) Summary(name string, labels map[string]string, opts Options) (*Series, error) {
+	return p.series(summaryType, name, labels, opts)
+}
+
+func (p *Prometheus) series(kind, name string, labels map[string]string, opts Options) (*Series, error) {
+	name = sanitize(name)
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if !validLabel(k) {
+			return nil, fmt.Errorf("invalid label name %q for %s", k, name)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	p.mu.Lock()
+	f, ok := p.families[name]
+	if !ok {
+		f = newFamily(kind, name, names, opts)
+		p.families[name] = f
+	}
+	p.mu.Unlock()
+
+	if f.kind != kind {
+		return nil, fmt.Errorf("%s is already registered as %s", name, f.kind)
+	}
+	if strings.Join(f.labelNames, ",") != strings.Join(names, ",") {
+		return nil, fmt.Errorf("%s is already registered with labels [%s]", name, strings.Join(f.labelNames, ","))
+	}
+	values := make([]string, len(names))
+	for i, k := range names {
+		values[i] = labels[k]
+	}
+	return f.get(values), nil
+}
+
+func newFamily(kind, name string, labelNames []string, opts Options) *family {
+	f := &family{
+		name:       name,
+		help:       opts.Help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    DefaultBuckets,
+		quantiles:  DefaultQuantiles,
+		series:     make(map[string]*Series),
+	}
+	if len(opts.Buckets) > 0 {
+		f.buckets = append([]float64(nil), opts.Buckets...)
+		sort.Float64s(f.buckets)
+	}
+	if len(opts.Quantiles) > 0 {
+		f.quantiles = opts.Quantiles
+	}
+	return f
+}
+
+func (f *family) get(values []string) *Series {
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &Series{family: f, labels: values}
+		switch f.kind {
+		case histogramType:
+			s.counts = make([]uint64, len(f.buckets))
+		case summaryType:
+			s.sample = goMetrics.NewExpDecaySample(1028, 0.015)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add adds the value to the counter or gauge
+func (s *Series) Add(v float64) {
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+// Set sets the value of the gauge
+func (s *Series) Set(v float64) {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+// Observe adds the observation to the histogram or summary
+func (s *Series) Observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sum += v
+	s.count++
+	switch s.family.kind {
+	case histogramType:
+		for i, b := range s.family.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+	case summaryType:
+		s.sample.Update(int64(v * sampleScale))
+	}
+}
+
+// Write writes all the metric families in text exposition format
+func (p *Prometheus) Write(w io.Writer) {
+	p.mu.Lock()
+	families := make([]*family, 0, len(p.families))
+	for _, f := range p.families {
+		families = append(families, f)
+	}
+	p.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*Series, len(keys))
+	for i, k := range keys {
+		series[i] = f.series[k]
+	}
+	f.mu.Unlock()
+
+	if f.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpReplacer.Replace(f.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range series {
+		s.write(w)
+	}
+}
+
+func (s *Series) write(w io.Writer) {
+	f := s.family
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch f.kind {
+	case counterType, gaugeType:
+		fmt.Fprintf(w, "%s%s %s\n", f.name, s.labelString("", ""), formatFloat(s.value))
+	case histogramType:
+		for i, b := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, s.labelString("le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, s.labelString("le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, s.labelString("", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, s.labelString("", ""), s.count)
+	case summaryType:
+		ps := s.sample.Percentiles(f.quantiles)
+		for i, q := range f.quantiles {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, s.labelString("quantile", formatFloat(q)), formatFloat(ps[i]/sampleScale))
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, s.labelString("", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, s.labelString("", ""), s.count)
+	}
+}
+
+// labelString returns the label set of the series with the optional extra label
+func (s *Series) labelString(extraName, extraValue string) string {
+	if len(s.labels) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(s.labels)+1)
+	for i, name := range s.family.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelReplacer.Replace(s.labels[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//nolint:gochecknoglobals
+var (
+	labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sanitize replaces the characters not allowed in the metric names with underscore
+func sanitize(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func validLabel(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// LAPICounter is lua binding for counter function on the prometheus instance
+func (p *Prometheus) LAPICounter(state *lua.LState) int {
+	s := p.luaSeries(state, counterType)
+	table := state.NewTable()
+	state.SetField(table, "inc", state.NewFunction(s.LAPIInc))
+	state.Push(table)
+	return 1
+}
+
+// LAPIGauge is lua binding for gauge function on the prometheus instance
+func (p *Prometheus) LAPIGauge(state *lua.LState) int {
+	s := p.luaSeries(state, gaugeType)
+	table := state.NewTable()
+	state.SetField(table, "set", state.NewFunction(s.LAPISet))
+	state.SetField(table, "inc", state.NewFunction(s.LAPIInc))
+	state.SetField(table, "dec", state.NewFunction(s.LAPIDec))
+	state.Push(table)
+	return 1
+}
+
+// LAPIHistogram is lua binding for histogram function on the prometheus instance
+func (p *Prometheus) LAPIHistogram(state *lua.LState) int {
+	s := p.luaSeries(state, histogramType)
+	table := state.NewTable()
+	state.SetField(table, "observe", state.NewFunction(s.LAPIObserve))
+	state.Push(table)
+	return 1
+}
+
+// LAPISummary is lua binding for summary function on the prometheus instance
+func (p *Prometheus) LAPISummary(state *lua.LState) int {
+	s := p.luaSeries(state, summaryType)
+	table := state.NewTable()
+	state.SetField(table, "observe", state.NewFunction(s.LAPIObserve))
+	state.Push(table)
+	return 1
+}
+
+// luaSeries returns the series for the lua arguments (name, labels, options)
+//
+//	prometheus().histogram("latency_seconds", { method = "GET" }, { help = "request latency", buckets = { 0.1, 1, 10 } })
+func (p *Prometheus) luaSeries(state *lua.LState, kind string) *Series {
+	name := state.ToString(1)
+	if name == "" {
+		state.RaiseError("prometheus: invalid %s name", kind)
+	}
+	labels := make(map[string]string)
+	if t := state.OptTable(2, nil); t != nil {
+		t.ForEach(func(k, v lua.LValue) {
+			labels[k.String()] = v.String()
+		})
+	}
+	var opts Options
+	if t := state.OptTable(3, nil); t != nil {
+		if help := t.RawGetString("help"); help != lua.LNil {
+			opts.Help = help.String()
+		}
+		opts.Buckets = luaFloats(t.RawGetString("buckets"))
+		opts.Quantiles = luaFloats(t.RawGetString("quantiles"))
+	}
+	s, err := p.series(kind, name, labels, opts)
+	if err != nil {
+		state.RaiseError("prometheus: %s", err.Error())
+	}
+	return s
+}
+
+func luaFloats(v lua.LValue) []float64 {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	floats := make([]float64, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		floats = append(floats, float64(lua.LVAsNumber(t.RawGetInt(i))))
+	}
+	return floats
+}
+
+// LAPIInc is the lua binding for inc function call on the counter and gauge instance
+func (s *Series) LAPIInc(state *lua.LState) int {
+	v := float64(state.OptNumber(1, 1))
+	if s.family.kind == counterType && v < 0 {
+		state.RaiseError("prometheus: counter %s can not be decreased", s.family.name)
+	}
+	s.Add(v)
+	return 0
+}
+
+// LAPIDec is the lua binding for dec function call on the gauge instance
+func (s *Series) LAPIDec(state *lua.LState) int {
+	s.Add(-float64(state.OptNumber(1, 1)))
+	return 0
+}
+
+// LAPISet is the lua binding for set function call on the gauge instance
+func (s *Series) LAPISet(state *lua.LState) int {
+	s.Set(float64(state.ToNumber(1)))
+	return 0
+}
+
+// LAPIObserve is the lua binding for observe function call on the histogram and summary instance
+func (s *Series) LAPIObserve(state *lua.LState) int {
+	s.Observe(float64(state.ToNumber(1)))
+	return 0
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/rs/zerolog"
@@ -41,6 +42,8 @@ type (
 		Source string
 		Line   string
 		Err    error
+		// Time is the time when the line was received
+		Time time.Time
 	}
 
 	// LogReader is the interface to read logs
@@ -98,7 +101,7 @@ func (c *Console) Start(ctx context.Context, cb ReadCallBack) error {
 					return
 				}
 				fmt.Println(err)
-				cb(LogEvent{"console", line, err})
+				cb(LogEvent{"console", line, err, time.Now()})
 			}
 		}
 	}()
@@ -135,11 +138,11 @@ func (s *UDP) Start(ctx context.Context, cb ReadCallBack) error {
 				b := make([]byte, 1024)
 				len, remote, err := conn.ReadFromUDP(b)
 				if err != nil {
-					cb(LogEvent{fmt.Sprintf("UDP:%s", remote), "", err})
+					cb(LogEvent{fmt.Sprintf("UDP:%s", remote), "", err, time.Now()})
 				}
 				line := strings.TrimSpace(string(b[:len]))
 				line = strings.TrimSuffix(line, "\r\n")
-				cb(LogEvent{fmt.Sprintf("UDP:%s", remote), line, nil})
+				cb(LogEvent{fmt.Sprintf("UDP:%s", remote), line, nil, time.Now()})
 			}
 		}
 	}()
@@ -183,11 +186,11 @@ func (s *TCP) Start(ctx context.Context, cb ReadCallBack) error {
 					remote := conn.RemoteAddr().String()
 					len, err := conn.Read(b)
 					if err != nil {
-						cb(LogEvent{fmt.Sprintf("TCP:%s", conn.RemoteAddr().String()), "", err})
+						cb(LogEvent{fmt.Sprintf("TCP:%s", conn.RemoteAddr().String()), "", err, time.Now()})
 					}
 					line := strings.TrimSpace(string(b[:len]))
 					line = strings.TrimSuffix(line, "\r\n")
-					cb(LogEvent{fmt.Sprintf("TCP:%s", remote), line, nil})
+					cb(LogEvent{fmt.Sprintf("TCP:%s", remote), line, nil, time.Now()})
 				}()
 			}
 		}
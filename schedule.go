@@ -0,0 +1,132 @@
+package logtrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/smitajit/logtrics/scheduler"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// schedule is a function of a logtric called at the times of the schedule
+	schedule struct {
+		schedule scheduler.Schedule
+		fn       *lua.LFunction
+	}
+)
+
+// LAPISchedule is the lua binding for schedule(spec, fn) api call
+// The function is called at the times of the spec, an interval in seconds or duration string, or a cron expression.
+// The calls are serialized with the handlers of the script
+//
+//	schedule("30s", function() metrics.gauge("sessions.active").set(active) end)
+//	schedule("0 * * * *", function() info("hourly") end)
+func (s *Script) LAPISchedule(state *lua.LState) int {
+	sched, err := luaSchedule(state.CheckAny(1))
+	if err != nil {
+		state.RaiseError("schedule: %s", err.Error())
+	}
+	fn := state.CheckFunction(2)
+	s.start(sched, func() {
+		s.callback(fn)
+	})
+	return 0
+}
+
+// start calls the function with the lock of the script at the times of the schedule until the script is closed
+func (s *Script) start(sched scheduler.Schedule, fn func()) {
+	job := scheduler.Start(sched, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		fn()
+	})
+	s.closers = append(s.closers, job.Stop)
+}
+
+// newSchedules returns the schedules of the scheduler key of the logtric table, a schedule table or an array of schedule tables
+//
+//	scheduler = { every = "30s", fn = function() ... end }
+//	scheduler = { { every = 10, fn = ... }, { cron = "*/5 * * * *", fn = ... } }
+func newSchedules(v lua.LValue) ([]*schedule, error) {
+	table, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("invalid scheduler %s", v.String())
+	}
+	if table.RawGetString("fn") != lua.LNil || table.RawGetString("every") != lua.LNil || table.RawGetString("cron") != lua.LNil {
+		s, err := newSchedule(table)
+		if err != nil {
+			return nil, err
+		}
+		return []*schedule{s}, nil
+	}
+	var (
+		schedules []*schedule
+		err       error
+	)
+	table.ForEach(func(_, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			err = fmt.Errorf("invalid scheduler %s", v.String())
+			return
+		}
+		var s *schedule
+		if s, err = newSchedule(t); err == nil {
+			schedules = append(schedules, s)
+		}
+	})
+	return schedules, err
+}
+
+// newSchedule returns the schedule of the schedule table, with the every or the cron key and the fn key
+func newSchedule(table *lua.LTable) (*schedule, error) {
+	s := &schedule{}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "every":
+			var d time.Duration
+			if d, err = luaDuration(v); err == nil {
+				s.schedule, err = scheduler.Every(d)
+			}
+		case "cron":
+			s.schedule, err = scheduler.Parse(v.String())
+		case "fn":
+			fn, ok := v.(*lua.LFunction)
+			if !ok {
+				err = fmt.Errorf("invalid scheduler function %s", v.String())
+				return
+			}
+			s.fn = fn
+		default:
+			err = fmt.Errorf("invalid scheduler key %s", k.String())
+		}
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case s.schedule == nil:
+		return nil, fmt.Errorf("scheduler every or cron is required")
+	case s.fn == nil:
+		return nil, fmt.Errorf("scheduler fn is required")
+	}
+	return s, nil
+}
+
+// luaSchedule returns the schedule of the interval in seconds or duration string, or of the cron expression
+func luaSchedule(v lua.LValue) (scheduler.Schedule, error) {
+	d, err := luaDuration(v)
+	if err != nil {
+		if s, ok := v.(lua.LString); ok {
+			return scheduler.Parse(string(s))
+		}
+		return nil, err
+	}
+	return scheduler.Every(d)
+}
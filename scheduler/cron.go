@@ -0,0 +1,208 @@
+// Package scheduler is responsible for the periodic execution of the functions at fixed intervals or cron expressions
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Schedule returns the next time of execution after the time
+	Schedule interface {
+		Next(t time.Time) time.Time
+	}
+
+	// every is the schedule of a fixed interval
+	every struct {
+		interval time.Duration
+	}
+
+	// cron is the schedule of a cron expression, the fields are bit sets of the allowed values
+	cron struct {
+		minute, hour, dom, month, dow uint64
+		// domAny and dowAny are true if the day of month or the day of week starts with *, e.g. * or */2,
+		// the days match both fields then, either field otherwise
+		domAny, dowAny bool
+	}
+
+	// field is the range of the values of a cron field
+	field struct {
+		name     string
+		min, max int
+		names    map[string]int
+	}
+)
+
+//nolint:gochecknoglobals
+var (
+	fields = []field{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: map[string]int{
+			"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+		}},
+		{name: "day of week", min: 0, max: 7, names: map[string]int{
+			"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+		}},
+	}
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Every returns the schedule of the fixed interval
+func Every(interval time.Duration) (Schedule, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s", interval)
+	}
+	return &every{interval: interval}, nil
+}
+
+// Next returns the time after the interval
+func (e *every) Next(t time.Time) time.Time {
+	return t.Add(e.interval)
+}
+
+// Parse returns the schedule of the cron expression in the local time zone
+// The expressions have 5 fields, minute, hour, day of month, month and day of week, or are one of the descriptors
+// @yearly, @monthly, @weekly, @daily, @hourly and @every <duration>
+//
+//	*/5 * * * *        every 5 minutes
+//	0 9-17 * * mon-fri every hour from 9 to 17 on weekdays
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %s", expr)
+		}
+		return Every(d)
+	}
+	if e, ok := descriptors[expr]; ok {
+		expr = e
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid cron expression %s, expected %d fields", expr, len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := f.parse(strings.ToLower(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %s: %s", expr, err.Error())
+		}
+		bits[i] = b
+	}
+	// sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	c := &cron{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid cron expression %s, it never matches", expr)
+	}
+	return c, nil
+}
+
+// Next returns the next minute matching the expression after the time, zero if there is none in the next 5 years
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !has(c.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(c.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(c.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// day returns true if the day of month or the day of week of the time matches
+func (c *cron) day(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parse returns the bit set of the comma separated list of values, ranges and steps. e.g. 1,2,10-20/5,*/15
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid %s step %s", f.name, part)
+			}
+			step = s
+			part = part[:i]
+		}
+		start, end := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid %s range %s", f.name, part)
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value returns the value of the number or the name
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %s", f.name, s)
+	}
+	return v, nil
+}
+
+// has returns true if the value is in the bit set
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
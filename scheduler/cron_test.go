@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// a monday
+	start := time.Date(2021, time.March, 1, 10, 7, 30, 0, time.Local)
+	tests := []struct {
+		expr string
+		// next are the next times after the start, none if the expression is invalid
+		next []time.Time
+	}{
+		{"* * * * *", []time.Time{date(2021, 3, 1, 10, 8), date(2021, 3, 1, 10, 9)}},
+		{"*/15 * * * *", []time.Time{date(2021, 3, 1, 10, 15), date(2021, 3, 1, 10, 30)}},
+		{"5,10-20/5 * * * *", []time.Time{date(2021, 3, 1, 10, 10), date(2021, 3, 1, 10, 15), date(2021, 3, 1, 10, 20), date(2021, 3, 1, 11, 5)}},
+		{"50/5 * * * *", []time.Time{date(2021, 3, 1, 10, 50), date(2021, 3, 1, 10, 55), date(2021, 3, 1, 11, 50)}},
+		{"0 9-17 * * mon-fri", []time.Time{date(2021, 3, 1, 11, 0), date(2021, 3, 1, 12, 0)}},
+		{"0 18 * * MON-FRI", []time.Time{date(2021, 3, 1, 18, 0), date(2021, 3, 2, 18, 0)}},
+		{"0 0 * * 7", []time.Time{date(2021, 3, 7, 0, 0), date(2021, 3, 14, 0, 0)}},
+		{"0 0 * * sun", []time.Time{date(2021, 3, 7, 0, 0)}},
+		{"0 0 1 jan *", []time.Time{date(2022, 1, 1, 0, 0)}},
+		{"0 0 31 * *", []time.Time{date(2021, 3, 31, 0, 0), date(2021, 5, 31, 0, 0)}},
+		{"0 0 29 2 *", []time.Time{date(2024, 2, 29, 0, 0)}},
+		// either the day of month or the day of week matches if both are restricted
+		{"0 0 13 * fri", []time.Time{date(2021, 3, 5, 0, 0), date(2021, 3, 12, 0, 0), date(2021, 3, 13, 0, 0)}},
+		// both match if one of them starts with *
+		{"0 0 */2 * fri", []time.Time{date(2021, 3, 5, 0, 0), date(2021, 3, 19, 0, 0)}},
+		{"@daily", []time.Time{date(2021, 3, 2, 0, 0)}},
+		{"@weekly", []time.Time{date(2021, 3, 7, 0, 0)}},
+		{"@hourly", []time.Time{date(2021, 3, 1, 11, 0)}},
+		{"@every 90s", []time.Time{start.Add(90 * time.Second), start.Add(180 * time.Second)}},
+		{"  @monthly ", []time.Time{date(2021, 4, 1, 0, 0)}},
+		{"* * * *", nil},
+		{"* * * * * *", nil},
+		{"60 * * * *", nil},
+		{"* 24 * * *", nil},
+		{"* * 0 * *", nil},
+		{"* * * 13 *", nil},
+		{"* * * foo *", nil},
+		{"*/0 * * * *", nil},
+		{"*/x * * * *", nil},
+		{"30-10 * * * *", nil},
+		{"0 0 30 feb *", nil},
+		{"@every 0s", nil},
+		{"@every soon", nil},
+		{"@sometimes", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if tt.next == nil {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := start
+			for i, want := range tt.next {
+				if at = s.Next(at); !at.Equal(want) {
+					t.Fatalf("expected the execution %d at %s, got %s", i, want, at)
+				}
+			}
+		})
+	}
+}
+
+func date(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.Local)
+}
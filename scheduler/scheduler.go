@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"time"
+)
+
+type (
+	// Job calls a function at the times of its schedule until it is stopped
+	// The calls never overlap, the times passed while the function is running are skipped
+	Job struct {
+		schedule Schedule
+		fn       func()
+		done     chan struct{}
+		stopped  chan struct{}
+	}
+)
+
+// Start returns a new Job instance calling the function at the times of the schedule
+func Start(schedule Schedule, fn func()) *Job {
+	j := &Job{
+		schedule: schedule,
+		fn:       fn,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go j.run()
+	return j
+}
+
+// Stop stops the job, it waits for the running call to return
+func (j *Job) Stop() {
+	close(j.done)
+	<-j.stopped
+}
+
+func (j *Job) run() {
+	defer close(j.stopped)
+	next := j.schedule.Next(time.Now())
+	for !next.IsZero() {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-j.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			j.fn()
+		}
+		now := time.Now()
+		next = j.schedule.Next(next)
+		for !next.IsZero() && next.Before(now) {
+			next = j.schedule.Next(next)
+		}
+	}
+	<-j.done
+}
@@ -2,39 +2,125 @@ package logtrics
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/cardinality"
 	"github.com/smitajit/logtrics/config"
+	"github.com/smitajit/logtrics/graphite"
+	"github.com/smitajit/logtrics/influx"
+	"github.com/smitajit/logtrics/notify"
+	"github.com/smitajit/logtrics/prometheus"
 	"github.com/smitajit/logtrics/reader"
+	"github.com/smitajit/logtrics/statsd"
 	lua "github.com/yuin/gopher-lua"
 )
 
 type (
 	// Script represents the logtrics lua script
 	Script struct {
-		Path     string
-		logtrics []*Logtric
-		conf     *config.Configuration
-		logger   zerolog.Logger
+		Path       string
+		logtrics   []*Logtric
+		dispatcher *Dispatcher
+		prometheus *prometheus.Prometheus
+		graphite   *graphite.Manager
+		statsd     *statsd.Manager
+		influx     *influx.Manager
+		notifier   *notify.Notifier
+		metrics    *Metrics
+		limiter    *cardinality.Limiter
+		prefix     *Prefix
+		conf       *config.Configuration
+		logger     zerolog.Logger
+		// current is the logtric to which the lua apis are bound
+		current *Logtric
+		// closers stop the scheduled functions and close the aggregation windows, the sketches and the store of the script,
+		// in the reverse order of creation
+		closers []func()
+		// mu serializes the calls of the lua state, the windows, sketches and schedules call the functions from their own threads
+		mu    sync.Mutex
+		state *lua.LState
 	}
 )
 
 // NewScript returns a new Script instance which represents a lua script file
-func NewScript(path string, conf *config.Configuration) (*Script, error) {
+func NewScript(path string, conf *config.Configuration, prom *prometheus.Prometheus, manager *graphite.Manager,
+	statsdManager *statsd.Manager, influxManager *influx.Manager, notifier *notify.Notifier, metrics *Metrics, limiter *cardinality.Limiter) (*Script, error) {
 	s := &Script{
-		Path:     path,
-		conf:     conf,
-		logtrics: make([]*Logtric, 0),
-		logger:   conf.Logger(path),
+		Path:       path,
+		conf:       conf,
+		logtrics:   make([]*Logtric, 0),
+		prometheus: prom,
+		graphite:   manager,
+		statsd:     statsdManager,
+		influx:     influxManager,
+		notifier:   notifier,
+		metrics:    metrics,
+		limiter:    limiter,
+		logger:     conf.Logger(path),
 	}
+	var template string
+	if conf.Metrics != nil {
+		template = conf.Metrics.Prefix
+	}
+	prefix, err := NewPrefix(prefixVariables(path, ""), template)
+	if err != nil {
+		return nil, err
+	}
+	s.prefix = prefix
 	state := lua.NewState()
+	s.state = state
 	state.SetGlobal("logtrics", state.NewFunction(s.LAPILogtric))
-	if err := state.DoFile(s.Path); err != nil {
+	state.SetGlobal("metrics", metrics.WithLimiter(limiter).WithPrefix(func(name string) string {
+		return prefix.Name("", name)
+	}).LTable(state))
+	api := state.NewTable()
+	state.SetField(api, "window", state.NewFunction(s.LAPIAggregateWindow))
+	state.SetGlobal("aggregate", api)
+	api = state.NewTable()
+	state.SetField(api, "distinct", state.NewFunction(s.LAPISketchDistinct))
+	state.SetField(api, "topk", state.NewFunction(s.LAPISketchTopK))
+	state.SetGlobal("sketch", api)
+	state.SetGlobal("schedule", state.NewFunction(s.LAPISchedule))
+	st, err := s.newStore(conf.Store)
+	if err != nil {
+		return nil, err
+	}
+	state.SetGlobal("store", storeTable(state, st))
+	state.SetGlobal("notify", notifyTable(state, notifier))
+	api = state.NewTable()
+	state.SetField(api, "rule", state.NewFunction(s.LAPIAlertRule))
+	state.SetGlobal("alert", api)
+	// the scheduled functions may be called while the script is loaded
+	s.mu.Lock()
+	err = state.DoFile(s.Path)
+	s.mu.Unlock()
+	if err != nil {
+		s.Close()
 		return nil, err
 	}
+	s.dispatcher = NewDispatcher(s.logtrics)
+	if conf.Cardinality != nil && conf.Cardinality.Expiry > 0 {
+		s.expire(time.Second * time.Duration(conf.Cardinality.Expiry))
+	}
 	return s, nil
 }
 
+// expire makes the limiters of the script and of its logtrics forget the series of the metrics api not used for the ttl
+func (s *Script) expire(ttl time.Duration) {
+	period := time.Minute
+	if ttl < period {
+		period = ttl
+	}
+	s.every(period, func() {
+		s.limiter.Expire("metrics:", ttl)
+		for _, l := range s.logtrics {
+			l.limiter.Expire("metrics:", ttl)
+		}
+	})
+}
+
 // RunAsync runs the script in async mode
 // It consumes the log event from the channel
 // note: this is a blocking call
@@ -55,18 +141,78 @@ func (s *Script) RunAsync(ctx context.Context, c <-chan reader.LogEvent) {
 func (s *Script) Run(ctx context.Context, event reader.LogEvent) {
 	logger := s.conf.Logger(s.Path)
 	logger.Debug().Msgf("executing script")
-	for _, l := range s.logtrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.dispatcher.Candidates(event.Line) {
 		if err := l.Run(ctx, event); err != nil {
 			logger.Error().Err(err).Msgf("script execution error")
 		}
 	}
 }
 
+// Close stops the scheduled functions and closes the aggregation windows, the sketches and the store of the script
+// The results of the open windows and periods are emitted, then the store is snapshotted
+func (s *Script) Close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+}
+
+// clock returns the time of the event being handled by the logtric, the current time otherwise
+func (s *Script) clock() time.Time {
+	if s.current == nil {
+		return time.Now()
+	}
+	return s.current.clock()
+}
+
+// gauge sets the gauge of the metrics api of the script
+func (s *Script) gauge(name string, labels map[string]string, v float64) {
+	m := s.metrics.WithLimiter(s.limiter).WithPrefix(func(name string) string {
+		return s.prefix.Name("", name)
+	})
+	if err := m.Gauge(name, labels, v); err != nil {
+		s.logger.Error().Err(err).Msgf("failed to record the gauge %s", name)
+	}
+}
+
+// callback calls the lua function with the arguments. The caller must hold the lock
+func (s *Script) callback(fn *lua.LFunction, args ...lua.LValue) {
+	p := lua.P{Fn: fn, NRet: 0, Protect: true}
+	if err := s.state.CallByParam(p, args...); err != nil {
+		s.logger.Error().Err(err).Msg("lua callback error")
+	}
+}
+
+// every calls the function every period until the script is closed, the function is called a last time on close
+func (s *Script) every(period time.Duration, fn func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	s.closers = append(s.closers, func() {
+		close(done)
+		<-stopped
+		fn()
+	})
+}
+
 // LAPILogtric represents lua binding for logtric initialization
 func (s *Script) LAPILogtric(state *lua.LState) int {
 	// parsing the lua script
 	table := state.ToTable(1)
-	l, err := NewLogtric(s.Path, s.conf, state, table)
+	l, err := NewLogtric(s, state, table)
 	if err != nil {
 		state.RaiseError(err.Error())
 	}
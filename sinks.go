@@ -0,0 +1,287 @@
+package logtrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smitajit/logtrics/config"
+	"github.com/smitajit/logtrics/graphite"
+	"github.com/smitajit/logtrics/influx"
+	"github.com/smitajit/logtrics/otlp"
+	"github.com/smitajit/logtrics/prometheus"
+	"github.com/smitajit/logtrics/statsd"
+)
+
+type (
+	// graphiteSink records the metrics in graphite. The labels are sent as tags when config.Graphite.Tagged is enabled,
+	// the label values are appended to the metric path otherwise
+	graphiteSink struct {
+		graphite *graphite.Graphite
+		tagged   bool
+	}
+
+	// prometheusSink records the metrics in prometheus with the labels, timers are observed in seconds
+	prometheusSink struct {
+		prometheus *prometheus.Prometheus
+	}
+
+	// statsdSink sends the metrics to statsd. The labels are sent as DogStatsD tags when enabled,
+	// appended to the metric name otherwise
+	statsdSink struct {
+		statsd *statsd.Statsd
+	}
+
+	// influxSink writes a point per record with the labels as tags and the value field
+	influxSink struct {
+		influx *influx.Influx
+	}
+
+	// prefixedSink is implemented by the sinks of dot separated metric paths, their metric names are prefixed
+	// with config.Metrics.Prefix and the prefix of the logtric
+	prefixedSink interface {
+		prefixed()
+	}
+
+	// otlpSink records the metrics in the otlp exporter, timers are recorded as histograms in seconds
+	// with the second scale buckets and meters as counters
+	otlpSink struct {
+		*otlp.Exporter
+	}
+)
+
+// newSinks returns the metric sinks configured in config.Metrics.Sinks
+func newSinks(conf *config.Configuration, prom *prometheus.Prometheus, manager *graphite.Manager,
+	statsdManager *statsd.Manager, influxManager *influx.Manager) ([]MetricSink, *otlp.Exporter, error) {
+	var (
+		sinks    []MetricSink
+		exporter *otlp.Exporter
+	)
+	if conf.Metrics == nil {
+		return sinks, nil, nil
+	}
+	for _, name := range conf.Metrics.Sinks {
+		switch name {
+		case "graphite":
+			g, err := manager.Graphite(conf, nil, time.Now)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to initialize graphite sink")
+			}
+			sinks = append(sinks, &graphiteSink{graphite: g, tagged: conf.Graphite.Tagged})
+		case "prometheus":
+			if !prom.Enabled() {
+				return nil, nil, fmt.Errorf("prometheus sink requires the scrape endpoint, prometheus.port is not set")
+			}
+			sinks = append(sinks, &prometheusSink{prometheus: prom})
+		case "statsd":
+			s, err := statsdManager.Statsd(conf)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to initialize statsd sink")
+			}
+			sinks = append(sinks, &statsdSink{statsd: s})
+		case "influx":
+			i, err := influxManager.Influx(conf, time.Now)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to initialize influx sink")
+			}
+			sinks = append(sinks, &influxSink{influx: i})
+		case "otlp":
+			e, err := otlp.NewExporter(conf, conf.Logger("otlp"))
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to initialize otlp sink")
+			}
+			exporter = e
+			sinks = append(sinks, &otlpSink{Exporter: e})
+		default:
+			return nil, nil, fmt.Errorf(`invalid metric sink %s. Choices are "graphite", "prometheus", "statsd", "influx", "otlp"`, name)
+		}
+	}
+	return sinks, exporter, nil
+}
+
+// metricPath returns the metric name with the label values sorted by the label names.
+// e.g. requests {status = "200", method = "GET"} => requests.GET.200
+func metricPath(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("." + pathReplacer.Replace(labels[k]))
+	}
+	return b.String()
+}
+
+//nolint:gochecknoglobals
+var pathReplacer = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+
+func (s *graphiteSink) prefixed() {}
+
+func (s *graphiteSink) series(name string, labels map[string]string) string {
+	if s.tagged {
+		return graphite.Series(name, labels)
+	}
+	return graphite.SanitizeName(metricPath(name, labels))
+}
+
+func (s *graphiteSink) Counter(name string, labels map[string]string, v float64) error {
+	n, err := integral(name, v)
+	if err != nil {
+		return err
+	}
+	s.graphite.Counter(s.series(name, labels)).Inc(n)
+	return nil
+}
+
+func (s *graphiteSink) Gauge(name string, labels map[string]string, v float64) error {
+	s.graphite.GaugeFloat64(s.series(name, labels)).Update(v)
+	return nil
+}
+
+func (s *graphiteSink) Histogram(name string, labels map[string]string, v float64) error {
+	n, err := integral(name, v)
+	if err != nil {
+		return err
+	}
+	s.graphite.Histogram(s.series(name, labels)).Update(n)
+	return nil
+}
+
+func (s *graphiteSink) Timer(name string, labels map[string]string, d time.Duration) error {
+	s.graphite.Timer(s.series(name, labels)).Update(d)
+	return nil
+}
+
+func (s *graphiteSink) Meter(name string, labels map[string]string, v float64) error {
+	n, err := integral(name, v)
+	if err != nil {
+		return err
+	}
+	s.graphite.Meter(s.series(name, labels)).Mark(n)
+	return nil
+}
+
+// integral returns the value as an integer, the graphite counters, histograms and meters only record integers.
+// The fractional values are rejected instead of being truncated
+func integral(name string, v float64) (int64, error) {
+	if v != math.Trunc(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("graphite: %s records integral values, got %v", name, v)
+	}
+	return int64(v), nil
+}
+
+func (s *prometheusSink) Counter(name string, labels map[string]string, v float64) error {
+	if v < 0 {
+		return fmt.Errorf("prometheus: counter %s can not be decreased", name)
+	}
+	c, err := s.prometheus.Counter(name, labels, prometheus.Options{})
+	if err != nil {
+		return err
+	}
+	c.Add(v)
+	return nil
+}
+
+func (s *prometheusSink) Gauge(name string, labels map[string]string, v float64) error {
+	g, err := s.prometheus.Gauge(name, labels, prometheus.Options{})
+	if err != nil {
+		return err
+	}
+	g.Set(v)
+	return nil
+}
+
+func (s *prometheusSink) Histogram(name string, labels map[string]string, v float64) error {
+	h, err := s.prometheus.Histogram(name, labels, prometheus.Options{})
+	if err != nil {
+		return err
+	}
+	h.Observe(v)
+	return nil
+}
+
+func (s *prometheusSink) Timer(name string, labels map[string]string, d time.Duration) error {
+	return s.Histogram(name, labels, d.Seconds())
+}
+
+func (s *prometheusSink) Meter(name string, labels map[string]string, v float64) error {
+	return s.Counter(name, labels, v)
+}
+
+func (s *statsdSink) prefixed() {}
+
+func (s *statsdSink) Counter(name string, labels map[string]string, v float64) error {
+	s.statsd.Counter(name, labels).Send(formatFloat(v))
+	return nil
+}
+
+func (s *statsdSink) Gauge(name string, labels map[string]string, v float64) error {
+	g := s.statsd.Gauge(name, labels)
+	if v < 0 {
+		// negative gauge values are relative changes in statsd, the gauge is reset to 0 first
+		g.Send("0")
+	}
+	g.Send(formatFloat(v))
+	return nil
+}
+
+func (s *statsdSink) Histogram(name string, labels map[string]string, v float64) error {
+	s.statsd.Histogram(name, labels).Send(formatFloat(v))
+	return nil
+}
+
+func (s *statsdSink) Timer(name string, labels map[string]string, d time.Duration) error {
+	s.statsd.Timer(name, labels).Send(formatFloat(float64(d) / float64(time.Millisecond)))
+	return nil
+}
+
+func (s *statsdSink) Meter(name string, labels map[string]string, v float64) error {
+	return s.Counter(name, labels, v)
+}
+
+func (s *influxSink) write(name string, labels map[string]string, v float64) error {
+	return s.influx.Write(influx.Point{
+		Measurement: name,
+		Tags:        labels,
+		Fields:      map[string]interface{}{"value": v},
+		Time:        time.Now(),
+	})
+}
+
+func (s *influxSink) Counter(name string, labels map[string]string, v float64) error {
+	return s.write(name, labels, v)
+}
+
+func (s *influxSink) Gauge(name string, labels map[string]string, v float64) error {
+	return s.write(name, labels, v)
+}
+
+func (s *influxSink) Histogram(name string, labels map[string]string, v float64) error {
+	return s.write(name, labels, v)
+}
+
+func (s *influxSink) Timer(name string, labels map[string]string, d time.Duration) error {
+	return s.write(name, labels, d.Seconds())
+}
+
+func (s *influxSink) Meter(name string, labels map[string]string, v float64) error {
+	return s.write(name, labels, v)
+}
+
+func (s *otlpSink) Meter(name string, labels map[string]string, v float64) error {
+	return s.Counter(name, labels, v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
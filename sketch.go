@@ -0,0 +1,215 @@
+package logtrics
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/smitajit/logtrics/sketch"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultSketchPeriod is the default period of the resets of the sketches
+	defaultSketchPeriod = time.Minute
+	// defaultTopK is the default number of items of the top-K sketches
+	defaultTopK = 10
+	// topKCapacityFactor is the default number of counters per item of the top-K sketches
+	topKCapacityFactor = 10
+)
+
+type (
+	// sketchOptions are the options of the sketches of the lua apis
+	sketchOptions struct {
+		name      string
+		period    time.Duration
+		precision int
+		k         int
+		capacity  int
+		emit      *lua.LFunction
+		metrics   string
+	}
+)
+
+// LAPISketchDistinct is the lua binding for sketch.distinct(options) api call
+// It returns a HyperLogLog counting the distinct values of the period. At the end of each period, the emit function is called
+// with the count and the count is recorded as a gauge of the metrics api, then the sketch is reset
+//
+//	local users = sketch.distinct {
+//		name = "users",
+//		period = "1m",          -- duration string or seconds
+//		precision = 14,         -- 2^14 registers, 0.81% standard error
+//		emit = function(result) info("%d users", result.count) end,
+//		metrics = "users.unique",
+//	}
+//	users.add(event.user)
+//	users.count()
+func (s *Script) LAPISketchDistinct(state *lua.LState) int {
+	opts := s.sketchOptions(state)
+	hll, err := sketch.NewHyperLogLog(opts.precision)
+	if err != nil {
+		state.RaiseError("sketch: %s", err.Error())
+	}
+	start := time.Now()
+	s.every(opts.period, func() {
+		count := float64(hll.Flush())
+		end := time.Now()
+		s.logger.Debug().Str("sketch", opts.name).Float64("count", count).Msg("sketch period ended")
+		if opts.metrics != "" {
+			s.gauge(opts.metrics, nil, count)
+		}
+		if opts.emit != nil {
+			s.mu.Lock()
+			table := s.state.NewTable()
+			table.RawSetString("count", lua.LNumber(count))
+			table.RawSetString("start", unixSeconds(start))
+			table.RawSetString("end", unixSeconds(end))
+			s.callback(opts.emit, table)
+			s.mu.Unlock()
+		}
+		start = end
+	})
+
+	t := state.NewTable()
+	state.SetField(t, "add", state.NewFunction(func(state *lua.LState) int {
+		hll.Add(state.CheckAny(1).String())
+		return 0
+	}))
+	state.SetField(t, "count", state.NewFunction(func(state *lua.LState) int {
+		state.Push(lua.LNumber(hll.Count()))
+		return 1
+	}))
+	state.Push(t)
+	return 1
+}
+
+// LAPISketchTopK is the lua binding for sketch.topk(options) api call
+// It returns a Space-Saving sketch tracking the most frequent items of the period. At the end of each period, the emit function
+// is called with the k most frequent items and their counts are recorded as gauges of the metrics api with the rank label,
+// then the sketch is reset. The ranks without item are set to 0, the items leaving the top do not keep their series
+//
+//	local urls = sketch.topk {
+//		name = "urls",
+//		period = "1m",
+//		k = 10,
+//		capacity = 100,         -- number of tracked items, the higher the more accurate
+//		emit = function(result) for i, e in ipairs(result.items) do info("%d %s %d", i, e.item, e.count) end end,
+//		metrics = "urls.top",   -- urls.top { rank = "1" }
+//	}
+//
+// urls.add(event.url)         -- or urls.add(event.url, event.bytes)
+// urls.top(3)
+func (s *Script) LAPISketchTopK(state *lua.LState) int {
+	opts := s.sketchOptions(state)
+	topk, err := sketch.NewTopK(opts.capacity)
+	if err != nil {
+		state.RaiseError("sketch: %s", err.Error())
+	}
+	start := time.Now()
+	s.every(opts.period, func() {
+		items := topk.Flush(opts.k)
+		end := time.Now()
+		s.logger.Debug().Str("sketch", opts.name).Int("items", len(items)).Msg("sketch period ended")
+		if opts.metrics != "" {
+			for rank := 1; rank <= opts.k; rank++ {
+				var count float64
+				if rank <= len(items) {
+					count = float64(items[rank-1].Count)
+				}
+				s.gauge(opts.metrics, map[string]string{"rank": strconv.Itoa(rank)}, count)
+			}
+		}
+		if opts.emit != nil {
+			s.mu.Lock()
+			table := s.state.NewTable()
+			table.RawSetString("items", luaItems(s.state, items))
+			table.RawSetString("start", unixSeconds(start))
+			table.RawSetString("end", unixSeconds(end))
+			s.callback(opts.emit, table)
+			s.mu.Unlock()
+		}
+		start = end
+	})
+
+	t := state.NewTable()
+	state.SetField(t, "add", state.NewFunction(func(state *lua.LState) int {
+		n := state.OptNumber(2, 1)
+		if n < 1 {
+			state.RaiseError("sketch: invalid count %s", n.String())
+		}
+		topk.Add(state.CheckAny(1).String(), uint64(n))
+		return 0
+	}))
+	state.SetField(t, "top", state.NewFunction(func(state *lua.LState) int {
+		state.Push(luaItems(state, topk.Top(state.OptInt(1, opts.k))))
+		return 1
+	}))
+	state.Push(t)
+	return 1
+}
+
+// sketchOptions returns the options of the options table argument of the sketch functions
+func (s *Script) sketchOptions(state *lua.LState) *sketchOptions {
+	table := state.CheckTable(1)
+	opts := &sketchOptions{period: defaultSketchPeriod, precision: sketch.DefaultPrecision, k: defaultTopK}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "name":
+			opts.name = v.String()
+		case "period":
+			opts.period, err = luaDuration(v)
+			if err == nil && opts.period <= 0 {
+				err = fmt.Errorf("invalid period %s", v.String())
+			}
+		case "precision":
+			opts.precision = int(lua.LVAsNumber(v))
+		case "k":
+			opts.k = int(lua.LVAsNumber(v))
+			if opts.k <= 0 {
+				err = fmt.Errorf("invalid k %s", v.String())
+			}
+		case "capacity":
+			opts.capacity = int(lua.LVAsNumber(v))
+		case "emit":
+			fn, ok := v.(*lua.LFunction)
+			if !ok {
+				err = fmt.Errorf("invalid emit function %s", v.String())
+				return
+			}
+			opts.emit = fn
+		case "metrics":
+			opts.metrics = v.String()
+		default:
+			err = fmt.Errorf("invalid key %s", k.String())
+		}
+	})
+	if err != nil {
+		state.RaiseError("sketch: %s", err.Error())
+	}
+	if opts.capacity == 0 {
+		opts.capacity = opts.k * topKCapacityFactor
+	}
+	if opts.capacity < opts.k {
+		state.RaiseError("sketch: capacity %d is lower than k %d", opts.capacity, opts.k)
+	}
+	return opts
+}
+
+// luaItems returns the lua array of the items
+//
+//	{ { item = "/index.html", count = 120, error = 2 }, ... }
+func luaItems(state *lua.LState, items []sketch.Item) *lua.LTable {
+	table := state.CreateTable(len(items), 0)
+	for _, i := range items {
+		t := state.CreateTable(0, 3)
+		t.RawSetString("item", lua.LString(i.Item))
+		t.RawSetString("count", lua.LNumber(i.Count))
+		t.RawSetString("error", lua.LNumber(i.Error))
+		table.Append(t)
+	}
+	return table
+}
@@ -0,0 +1,112 @@
+// Package sketch is responsible for the approximate distinct counts and top-K of the values of the events with bounded memory
+package sketch
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// DefaultPrecision is the default precision of the HyperLogLog, 2^14 registers with a standard error of 0.81%
+	DefaultPrecision = 14
+	minPrecision     = 4
+	maxPrecision     = 18
+)
+
+type (
+	// HyperLogLog estimates the number of distinct values with 2^precision registers of a byte
+	// The standard error is 1.04 / sqrt(2^precision)
+	HyperLogLog struct {
+		precision uint8
+		mu        sync.Mutex
+		registers []uint8
+	}
+)
+
+// NewHyperLogLog returns a new HyperLogLog instance with the precision in [4, 18]
+func NewHyperLogLog(precision int) (*HyperLogLog, error) {
+	if precision < minPrecision || precision > maxPrecision {
+		return nil, fmt.Errorf("invalid precision %d, must be in [%d, %d]", precision, minPrecision, maxPrecision)
+	}
+	return &HyperLogLog{precision: uint8(precision), registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Add adds the value
+func (h *HyperLogLog) Add(value string) {
+	x := hash(value)
+	i := x >> (64 - h.precision)
+	// the rank of the first set bit of the remaining bits, bounded by the bit set after them
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1)) + 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Count returns the estimated number of distinct values
+func (h *HyperLogLog) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count()
+}
+
+// Flush returns the estimated number of distinct values and resets the HyperLogLog
+func (h *HyperLogLog) Flush() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.count()
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+	return n
+}
+
+// count returns the estimation, with the linear counting correction of the small cardinalities. The caller must hold the lock
+func (h *HyperLogLog) count() uint64 {
+	m := float64(len(h.registers))
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// alpha returns the bias correction constant of the number of registers
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/m)
+}
+
+// hash returns the 64 bits hash of the value, fnv-1a with the murmur3 finalizer to spread the bits
+func hash(value string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(value))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
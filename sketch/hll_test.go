@@ -0,0 +1,66 @@
+package sketch
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogErrorBounds(t *testing.T) {
+	tests := []struct {
+		precision int
+		distinct  int
+	}{
+		{precision: DefaultPrecision, distinct: 0},
+		{precision: DefaultPrecision, distinct: 1},
+		{precision: DefaultPrecision, distinct: 100},
+		{precision: DefaultPrecision, distinct: 10000},
+		{precision: DefaultPrecision, distinct: 200000},
+		{precision: minPrecision, distinct: 1000},
+		{precision: 10, distinct: 50000},
+		{precision: maxPrecision, distinct: 100000},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.precision)+"/"+strconv.Itoa(tt.distinct), func(t *testing.T) {
+			h, err := NewHyperLogLog(tt.precision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the values are added twice, the duplicates are not counted
+			for n := 0; n < 2; n++ {
+				for i := 0; i < tt.distinct; i++ {
+					h.Add("value-" + strconv.Itoa(i))
+				}
+			}
+			// 4 standard errors, the linear counting of the small cardinalities is more precise
+			bound := 4 * 1.04 / math.Sqrt(float64(uint64(1)<<tt.precision)) * float64(tt.distinct)
+			if got := float64(h.Count()); math.Abs(got-float64(tt.distinct)) > math.Max(bound, 1) {
+				t.Fatalf("expected %d distinct values within %.0f, got %.0f", tt.distinct, bound, got)
+			}
+			h.Flush()
+			if got := h.Count(); got != 0 {
+				t.Fatalf("expected no value after the flush, got %d", got)
+			}
+		})
+	}
+}
+
+func TestNewHyperLogLogPrecision(t *testing.T) {
+	tests := []struct {
+		precision int
+		valid     bool
+	}{
+		{minPrecision - 1, false},
+		{minPrecision, true},
+		{DefaultPrecision, true},
+		{maxPrecision, true},
+		{maxPrecision + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.precision), func(t *testing.T) {
+			if _, err := NewHyperLogLog(tt.precision); (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
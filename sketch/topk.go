@@ -0,0 +1,123 @@
+package sketch
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type (
+	// TopK tracks the most frequent items with the Space-Saving algorithm
+	// It keeps at most capacity counters, the least frequent counter is replaced by a new item. The count of an item
+	// is overestimated by at most its Error, the items more frequent than total/capacity are guaranteed to be tracked
+	TopK struct {
+		capacity int
+		mu       sync.Mutex
+		counters map[string]*counter
+		heap     counters
+	}
+
+	// Item is a tracked item with its estimated count and the maximum overestimation of the count
+	Item struct {
+		Item  string
+		Count uint64
+		Error uint64
+	}
+
+	counter struct {
+		Item
+		index int
+	}
+
+	// counters is a min heap of the counters by count
+	counters []*counter
+)
+
+// NewTopK returns a new TopK instance tracking up to capacity items
+func NewTopK(capacity int) (*TopK, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %d", capacity)
+	}
+	return &TopK{capacity: capacity, counters: make(map[string]*counter, capacity)}, nil
+}
+
+// Add adds n occurrences of the item
+func (t *TopK) Add(item string, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.counters[item]; ok {
+		c.Count += n
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		c := &counter{Item: Item{Item: item, Count: n}}
+		heap.Push(&t.heap, c)
+		t.counters[item] = c
+		return
+	}
+	// the least frequent item is replaced, the new item may have occurred up to its count
+	c := t.heap[0]
+	delete(t.counters, c.Item.Item)
+	c.Item = Item{Item: item, Count: c.Count + n, Error: c.Count}
+	t.counters[item] = c
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns the k most frequent items, sorted by count
+func (t *TopK) Top(k int) []Item {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.top(k)
+}
+
+// Flush returns the k most frequent items and resets the TopK
+func (t *TopK) Flush(k int) []Item {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	items := t.top(k)
+	t.counters = make(map[string]*counter, t.capacity)
+	t.heap = nil
+	return items
+}
+
+// top returns the k most frequent items. The caller must hold the lock
+func (t *TopK) top(k int) []Item {
+	items := make([]Item, 0, len(t.heap))
+	for _, c := range t.heap {
+		items = append(items, c.Item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Item < items[j].Item
+	})
+	if k > 0 && k < len(items) {
+		items = items[:k]
+	}
+	return items
+}
+
+func (c counters) Len() int           { return len(c) }
+func (c counters) Less(i, j int) bool { return c[i].Count < c[j].Count }
+
+func (c counters) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+	c[i].index = i
+	c[j].index = j
+}
+
+func (c *counters) Push(x interface{}) {
+	item := x.(*counter)
+	item.index = len(*c)
+	*c = append(*c, item)
+}
+
+func (c *counters) Pop() interface{} {
+	old := *c
+	item := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,89 @@
+package sketch
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopKErrorBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		// counts are the occurrences of the items, added round robin
+		counts map[string]uint64
+		k      int
+		want   []string
+	}{
+		{
+			name:     "under capacity",
+			capacity: 10,
+			counts:   map[string]uint64{"a": 5, "b": 3, "c": 1},
+			k:        2,
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "heavy hitters over capacity",
+			capacity: 5,
+			counts:   withNoise(map[string]uint64{"a": 500, "b": 300, "c": 200}, 100, 2),
+			k:        3,
+			want:     []string{"a", "b", "c"},
+		},
+		{
+			name:     "ties sorted by item",
+			capacity: 3,
+			counts:   map[string]uint64{"b": 2, "a": 2, "c": 1},
+			k:        0,
+			want:     []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topk, err := NewTopK(tt.capacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total uint64
+			remaining := make(map[string]uint64, len(tt.counts))
+			for item, n := range tt.counts {
+				remaining[item] = n
+				total += n
+			}
+			for added := uint64(0); added < total; {
+				for item, n := range remaining {
+					if n == 0 {
+						continue
+					}
+					topk.Add(item, 1)
+					remaining[item]--
+					added++
+				}
+			}
+
+			items := topk.Top(tt.k)
+			if len(items) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, items)
+			}
+			for i, item := range items {
+				if item.Item != tt.want[i] {
+					t.Fatalf("expected %v, got %v", tt.want, items)
+				}
+				// the count is overestimated by at most the error, itself at most total/capacity
+				actual := tt.counts[item.Item]
+				if item.Count < actual || item.Count-item.Error > actual || item.Error > total/uint64(tt.capacity) {
+					t.Fatalf("item %s: count %d with error %d, actual count %d", item.Item, item.Count, item.Error, actual)
+				}
+			}
+			if len(topk.Flush(0)) == 0 || len(topk.Top(0)) != 0 {
+				t.Fatal("expected no item after the flush")
+			}
+		})
+	}
+}
+
+// withNoise adds the items occurring n times each to the counts
+func withNoise(counts map[string]uint64, items int, n uint64) map[string]uint64 {
+	for i := 0; i < items; i++ {
+		counts["noise-"+strconv.Itoa(i)] = n
+	}
+	return counts
+}
@@ -0,0 +1,438 @@
+// Package statsd is responsible for pushing metrics to statsd compatible agents
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/smitajit/logtrics/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// DefaultMTU is the default maximum size of the packet
+	DefaultMTU = 1432
+	// queueSize is the number of full packets waiting for the sender, the packets are dropped when the queue is full
+	queueSize = 100
+	// dialTimeout is the timeout of the connection to the agent and of the writes
+	dialTimeout = 5 * time.Second
+)
+
+type (
+	// Manager shares a client, its buffer and its connection, between the statsd instances with the same configuration
+	Manager struct {
+		logger zerolog.Logger
+
+		mu      sync.Mutex
+		clients map[string]*client
+		closed  bool
+	}
+
+	// Statsd represents the statsd module of the application
+	// It batches the metrics in packets of config.Statsd.MTU size and sends them in regular interval (config.Statsd.Interval)
+	Statsd struct {
+		conf   *config.Configuration
+		client *client
+		// prefix returns the metric name with the prefix, before config.Statsd.Prefix
+		prefix func(name string) string
+	}
+
+	// client buffers the lines of a statsd agent. The packets are sent by the sender goroutine,
+	// so the writers never wait for the network
+	client struct {
+		network string
+		address string
+		mtu     int
+		logger  zerolog.Logger
+		packets chan []byte
+		done    chan struct{}
+		stopped chan struct{}
+		// conn is only used by the sender goroutine
+		conn net.Conn
+
+		mu      sync.Mutex
+		buf     []byte
+		dropped int
+	}
+
+	// Metric represents a statsd metric with its type and tags
+	Metric struct {
+		statsd *Statsd
+		name   string
+		kind   string
+		tags   string
+	}
+)
+
+// NewManager returns a new Manager instance
+func NewManager(logger zerolog.Logger) *Manager {
+	return &Manager{
+		logger:  logger,
+		clients: make(map[string]*client),
+	}
+}
+
+// Statsd returns a new statsd instance sending the metrics to the client of config.Statsd
+// The client and its sender goroutine are created on the first call for the configuration
+func (m *Manager) Statsd(conf *config.Configuration) (*Statsd, error) {
+	if conf.Statsd == nil || conf.Statsd.Address == "" {
+		return nil, fmt.Errorf("invalid statsd configuration")
+	}
+	switch conf.Statsd.Network {
+	case "", "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("invalid statsd network %s", conf.Statsd.Network)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, fmt.Errorf("statsd is closed")
+	}
+	// the configurations are compared by their values
+	key := fmt.Sprintf("%+v", *conf.Statsd)
+	c, ok := m.clients[key]
+	if !ok {
+		c = newClient(conf.Statsd, m.logger)
+		m.clients[key] = c
+	}
+	return &Statsd{conf: conf, client: c}, nil
+}
+
+// Close stops the clients and sends the buffered metrics a last time
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var err error
+	for _, c := range m.clients {
+		if cerr := c.close(); cerr != nil {
+			m.logger.Error().Err(cerr).Str("address", c.address).Msg("failed to send the last statsd metrics")
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newClient returns a new client and starts its sender goroutine
+func newClient(conf *config.Statsd, logger zerolog.Logger) *client {
+	c := &client{
+		network: conf.Network,
+		address: conf.Address,
+		mtu:     conf.MTU,
+		logger:  logger,
+		packets: make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if c.network == "" {
+		c.network = "udp"
+	}
+	if c.mtu <= 0 {
+		c.mtu = DefaultMTU
+	}
+	interval := time.Second
+	if conf.Interval > 0 {
+		interval = time.Second * time.Duration(conf.Interval)
+	}
+	go c.run(interval)
+	return c
+}
+
+// Counter returns the counter metric
+func (s *Statsd) Counter(name string, tags map[string]string) *Metric {
+	return s.metric(name, "c", tags)
+}
+
+// Gauge returns the gauge metric
+func (s *Statsd) Gauge(name string, tags map[string]string) *Metric {
+	return s.metric(name, "g", tags)
+}
+
+// Timer returns the timer metric, values are in milliseconds
+func (s *Statsd) Timer(name string, tags map[string]string) *Metric {
+	return s.metric(name, "ms", tags)
+}
+
+// Histogram returns the histogram metric
+func (s *Statsd) Histogram(name string, tags map[string]string) *Metric {
+	return s.metric(name, "h", tags)
+}
+
+// Set returns the set metric, which counts the unique values
+func (s *Statsd) Set(name string, tags map[string]string) *Metric {
+	return s.metric(name, "s", tags)
+}
+
+// SetPrefix sets the function returning the metric names with the prefix
+func (s *Statsd) SetPrefix(prefix func(name string) string) {
+	s.prefix = prefix
+}
+
+func (s *Statsd) metric(name, kind string, tags map[string]string) *Metric {
+	if s.prefix != nil {
+		name = s.prefix(name)
+	}
+	if !s.conf.Statsd.DogStatsd {
+		name = path(name, tags)
+	}
+	m := &Metric{
+		statsd: s,
+		name:   nameReplacer.Replace(s.conf.Statsd.Prefix + name),
+		kind:   kind,
+	}
+	if s.conf.Statsd.DogStatsd && len(tags) > 0 {
+		pairs := make([]string, 0, len(tags))
+		for k, v := range tags {
+			pairs = append(pairs, tagReplacer.Replace(k)+":"+tagReplacer.Replace(v))
+		}
+		sort.Strings(pairs)
+		m.tags = "|#" + strings.Join(pairs, ",")
+	}
+	return m
+}
+
+// path returns the name with the tag values appended as nodes, sorted by tag name
+// It's used for the plain statsd agents which don't support tags
+func path(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("." + nodeReplacer.Replace(tags[k]))
+	}
+	return b.String()
+}
+
+// Send sends the value of the metric
+func (m *Metric) Send(value string) {
+	m.statsd.client.write(m.name + ":" + value + "|" + m.kind + m.tags)
+}
+
+// write appends the line to the packet buffer. When the packet exceeds the mtu, it is handed to the sender
+// and dropped if the queue of the sender is full
+func (c *client) write(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) > 0 && len(c.buf)+len(line)+1 > c.mtu {
+		select {
+		case c.packets <- c.buf:
+		default:
+			c.dropped++
+		}
+		c.buf = nil
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// take returns the buffered packet and the number of dropped packets since the last call
+func (c *client) take() ([]byte, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf, dropped := c.buf, c.dropped
+	c.buf, c.dropped = nil, 0
+	return buf, dropped
+}
+
+// run sends the full packets as they come and the buffered packet every interval until the client is closed
+func (c *client) run(interval time.Duration) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case packet := <-c.packets:
+			c.send(packet)
+		case <-ticker.C:
+			packet, dropped := c.take()
+			if dropped > 0 {
+				c.logger.Warn().Int("packets", dropped).Msg("statsd queue is full, packets dropped")
+			}
+			c.send(packet)
+		}
+	}
+}
+
+// close stops the sender, sends the queued and the buffered packets and closes the connection
+func (c *client) close() error {
+	close(c.done)
+	<-c.stopped
+	var err error
+	for len(c.packets) > 0 {
+		if perr := c.flush(<-c.packets); perr != nil {
+			err = perr
+		}
+	}
+	packet, dropped := c.take()
+	if dropped > 0 {
+		c.logger.Warn().Int("packets", dropped).Msg("statsd queue is full, packets dropped")
+	}
+	if perr := c.flush(packet); perr != nil {
+		err = perr
+	}
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// send sends the packet and logs the failure
+func (c *client) send(packet []byte) {
+	if err := c.flush(packet); err != nil {
+		c.logger.Error().Err(err).Msg("failed to send statsd metrics")
+	}
+}
+
+// flush sends the packet, the connection is opened on the first packet and after a failure.
+// Only the sender goroutine, or close once it is stopped, calls it
+func (c *client) flush(packet []byte) error {
+	if len(packet) == 0 {
+		return nil
+	}
+	if c.conn == nil {
+		conn, err := net.DialTimeout(c.network, c.address, dialTimeout)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	if c.stream() {
+		packet = append(packet, '\n')
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	if _, err := c.conn.Write(packet); err != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// stream returns true for the stream oriented networks, which need the line terminator
+func (c *client) stream() bool {
+	return c.network == "tcp" || c.network == "unix"
+}
+
+//nolint:gochecknoglobals
+var (
+	nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	tagReplacer  = strings.NewReplacer(",", "_", "|", "_", ":", "_", "\n", "_")
+	nodeReplacer = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+)
+
+// LAPICounter is lua binding for counter function on the statsd instance
+func (s *Statsd) LAPICounter(state *lua.LState) int {
+	m := s.Counter(luaName(state, "counter"), luaTags(state))
+	table := state.NewTable()
+	state.SetField(table, "inc", state.NewFunction(m.LAPIInc))
+	state.SetField(table, "dec", state.NewFunction(m.LAPIDec))
+	state.Push(table)
+	return 1
+}
+
+// LAPIGauge is lua binding for gauge function on the statsd instance
+func (s *Statsd) LAPIGauge(state *lua.LState) int {
+	m := s.Gauge(luaName(state, "gauge"), luaTags(state))
+	table := state.NewTable()
+	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
+	state.Push(table)
+	return 1
+}
+
+// LAPITimer is lua binding for timer function on the statsd instance
+func (s *Statsd) LAPITimer(state *lua.LState) int {
+	m := s.Timer(luaName(state, "timer"), luaTags(state))
+	table := state.NewTable()
+	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
+	state.Push(table)
+	return 1
+}
+
+// LAPIHistogram is lua binding for histogram function on the statsd instance
+func (s *Statsd) LAPIHistogram(state *lua.LState) int {
+	m := s.Histogram(luaName(state, "histogram"), luaTags(state))
+	table := state.NewTable()
+	state.SetField(table, "update", state.NewFunction(m.LAPIUpdate))
+	state.Push(table)
+	return 1
+}
+
+// LAPISet is lua binding for set function on the statsd instance
+func (s *Statsd) LAPISet(state *lua.LState) int {
+	m := s.Set(luaName(state, "set"), luaTags(state))
+	table := state.NewTable()
+	state.SetField(table, "add", state.NewFunction(m.LAPIAdd))
+	state.Push(table)
+	return 1
+}
+
+func luaName(state *lua.LState, kind string) string {
+	name := state.ToString(1)
+	if name == "" {
+		state.RaiseError("statsd: invalid %s name", kind)
+	}
+	return name
+}
+
+func luaTags(state *lua.LState) map[string]string {
+	t := state.OptTable(2, nil)
+	if t == nil {
+		return nil
+	}
+	tags := make(map[string]string)
+	t.ForEach(func(k, v lua.LValue) {
+		tags[k.String()] = v.String()
+	})
+	return tags
+}
+
+// LAPIInc is the lua binding for inc function call on the counter instance
+func (m *Metric) LAPIInc(state *lua.LState) int {
+	m.Send(formatFloat(float64(state.OptNumber(1, 1))))
+	return 0
+}
+
+// LAPIDec is the lua binding for dec function call on the counter instance
+func (m *Metric) LAPIDec(state *lua.LState) int {
+	m.Send(formatFloat(-float64(state.OptNumber(1, 1))))
+	return 0
+}
+
+// LAPIUpdate is the lua binding for update function call on the gauge, timer and histogram instance
+func (m *Metric) LAPIUpdate(state *lua.LState) int {
+	v := float64(state.ToNumber(1))
+	if m.kind == "g" && v < 0 {
+		// negative gauge values are relative changes in statsd, the gauge is reset to 0 first
+		m.Send("0")
+	}
+	m.Send(formatFloat(v))
+	return 0
+}
+
+// LAPIAdd is the lua binding for add function call on the set instance
+func (m *Metric) LAPIAdd(state *lua.LState) int {
+	m.Send(nameReplacer.Replace(state.ToString(1)))
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
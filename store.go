@@ -0,0 +1,220 @@
+package logtrics
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/smitajit/logtrics/config"
+	"github.com/smitajit/logtrics/store"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultStoreInterval is the default interval of the store snapshots
+	defaultStoreInterval = 30 * time.Second
+	// maxDepth is the maximum depth of the nested tables converted to go values
+	maxDepth = 32
+)
+
+// newStore returns the store of the script, in the file of the script path in the store directory or memory only
+// The store is snapshotted every interval and when the script is closed, the changes are journaled in between
+func (s *Script) newStore(conf *config.Store) (*store.Store, error) {
+	var file string
+	interval := defaultStoreInterval
+	if conf != nil {
+		if conf.Path != "" {
+			file = filepath.Join(conf.Path, s.storeName()+".json")
+		}
+		if conf.Interval > 0 {
+			interval = time.Duration(conf.Interval) * time.Second
+		}
+	}
+	st, err := store.Open(file, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	// the closers run in reverse order, the journal is closed after the last snapshot
+	s.closers = append(s.closers, func() {
+		if err := st.Close(); err != nil {
+			s.logger.Error().Err(err).Msg("failed to close the store")
+		}
+	})
+	s.every(interval, func() {
+		if err := st.Snapshot(); err != nil {
+			s.logger.Error().Err(err).Msg("failed to snapshot the store")
+		}
+	})
+	return st, nil
+}
+
+// storeName returns the path of the script relative to the script directory without the extension, e.g. a/nginx,
+// the base name of the script outside of the script directory
+func (s *Script) storeName() string {
+	name := filepath.Base(s.Path)
+	if s.conf.ScriptFile == "" {
+		if rel, err := filepath.Rel(s.conf.ScriptDir, s.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// storeTable returns the lua table of the store api
+//
+//	store.set("last_seen", event._time)
+//	store.set("session:" .. event.id, { user = event.user }, "30m") -- ttl in seconds or duration string
+//	store.get("last_seen", 0)                                       -- default if the key does not exist
+//	store.incr("total", event.bytes)
+//	store.ttl("session:1")                                          -- remaining seconds, -1 if it never expires, nil if it does not exist
+//	store.expire("session:1", "1h")
+//	store.delete("session:1")
+func storeTable(state *lua.LState, st *store.Store) *lua.LTable {
+	table := state.NewTable()
+	state.SetField(table, "get", state.NewFunction(func(state *lua.LState) int {
+		v, ok := st.Get(state.CheckString(1))
+		if !ok {
+			state.Push(state.Get(2))
+			return 1
+		}
+		state.Push(toLua(state, v))
+		return 1
+	}))
+	state.SetField(table, "set", state.NewFunction(func(state *lua.LState) int {
+		key := state.CheckString(1)
+		if state.Get(2) == lua.LNil {
+			st.Delete(key)
+			return 0
+		}
+		v, err := fromLua(state.Get(2))
+		checkStore(state, err)
+		st.Set(key, v, optTTL(state, 3))
+		return 0
+	}))
+	state.SetField(table, "incr", state.NewFunction(func(state *lua.LState) int {
+		n, err := st.Incr(state.CheckString(1), float64(state.OptNumber(2, 1)), optTTL(state, 3))
+		checkStore(state, err)
+		state.Push(lua.LNumber(n))
+		return 1
+	}))
+	state.SetField(table, "delete", state.NewFunction(func(state *lua.LState) int {
+		st.Delete(state.CheckString(1))
+		return 0
+	}))
+	state.SetField(table, "ttl", state.NewFunction(func(state *lua.LState) int {
+		ttl, ok := st.TTL(state.CheckString(1))
+		switch {
+		case !ok:
+			state.Push(lua.LNil)
+		case ttl == 0:
+			state.Push(lua.LNumber(-1))
+		default:
+			state.Push(lua.LNumber(ttl.Seconds()))
+		}
+		return 1
+	}))
+	state.SetField(table, "expire", state.NewFunction(func(state *lua.LState) int {
+		state.Push(lua.LBool(st.Expire(state.CheckString(1), optTTL(state, 2))))
+		return 1
+	}))
+	return table
+}
+
+// optTTL returns the ttl argument in seconds or duration string, 0 if it is nil
+func optTTL(state *lua.LState, n int) time.Duration {
+	v := state.Get(n)
+	if v == lua.LNil {
+		return 0
+	}
+	d, err := luaDuration(v)
+	if err != nil || d < 0 {
+		state.RaiseError("store: invalid ttl %s", v.String())
+	}
+	return d
+}
+
+func checkStore(state *lua.LState, err error) {
+	if err != nil {
+		state.RaiseError("store: %s", err.Error())
+	}
+}
+
+// fromLua returns the go value of the lua value. The tables are converted to slices if they are arrays, to maps otherwise
+func fromLua(v lua.LValue) (interface{}, error) {
+	return fromLuaDepth(v, 0)
+}
+
+func fromLuaDepth(v lua.LValue, depth int) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("unsupported number %s", v.String())
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("table nested deeper than %d levels", maxDepth)
+		}
+		var (
+			m   = make(map[string]interface{})
+			err error
+		)
+		v.ForEach(func(k, e lua.LValue) {
+			if err != nil {
+				return
+			}
+			m[k.String()], err = fromLuaDepth(e, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n := v.MaxN(); n > 0 && n == len(m) {
+			a := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				a[i-1] = m[fmt.Sprint(i)]
+			}
+			return a, nil
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %s", v.Type().String())
+}
+
+// toLua returns the lua value of the go value of fromLua
+func toLua(state *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := state.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(toLua(state, e))
+		}
+		return t
+	case map[string]interface{}:
+		t := state.CreateTable(0, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			t.RawSetString(k, toLua(state, v[k]))
+		}
+		return t
+	}
+	return lua.LNil
+}
@@ -0,0 +1,326 @@
+// Package store is responsible for the key value state of the scripts, kept in memory and persisted to disk
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type (
+	// Store is a key value store kept in memory. The values are any json value, e.g. the numbers, strings, arrays and maps.
+	// With a file, the changes are appended to the journal of the file and Snapshot writes the entries to the file
+	// and truncates the journal. The store is loaded from the file and the journal. It is memory only otherwise
+	Store struct {
+		file   string
+		logger zerolog.Logger
+
+		mu      sync.Mutex
+		entries map[string]*entry
+		// journal is the file of the changes since the last snapshot, nil if memory only
+		journal *os.File
+		// dirty is true if the entries changed since the last snapshot
+		dirty bool
+	}
+
+	// entry is a value of the store with its expiry time in unix nanoseconds, never expires if zero
+	entry struct {
+		Value   interface{} `json:"value"`
+		Expires int64       `json:"expires,omitempty"`
+	}
+
+	// record is a change of the journal, the entry of the key or its deletion
+	record struct {
+		Key     string `json:"key"`
+		Deleted bool   `json:"deleted,omitempty"`
+		entry
+	}
+)
+
+// Open returns a new Store instance loaded from the file and its journal, memory only if the file is empty
+func Open(file string, logger zerolog.Logger) (*Store, error) {
+	s := &Store{file: file, logger: logger, entries: make(map[string]*entry)}
+	if file == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read the store %s: %s", file, err.Error())
+	default:
+		if err := json.Unmarshal(b, &s.entries); err != nil {
+			return nil, fmt.Errorf("failed to decode the store %s: %s", file, err.Error())
+		}
+	}
+	size, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the store directory: %s", err.Error())
+	}
+	journal, err := os.OpenFile(s.journalFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the store journal: %s", err.Error())
+	}
+	// a partial change is removed, so the next changes are appended after the last complete one
+	if err := journal.Truncate(size); err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to truncate the store journal: %s", err.Error())
+	}
+	s.journal = journal
+	s.expire(time.Now())
+	return s, nil
+}
+
+// Close closes the journal. The entries are not written, Snapshot is called before
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	return err
+}
+
+// journalFile returns the file of the journal, next to the file of the snapshot
+func (s *Store) journalFile() string {
+	return s.file + ".log"
+}
+
+// replay applies the changes of the journal to the entries loaded from the snapshot and returns the size of the complete changes
+// A partially written change, the last one of a crash, is ignored
+func (s *Store) replay() (int64, error) {
+	f, err := os.Open(s.journalFile())
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("failed to read the store journal: %s", err.Error())
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var size int64
+	for n := 0; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				s.logger.Warn().Str("file", s.journalFile()).Msg("store journal ends with a partial change, change ignored")
+			}
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the store journal: %s", err.Error())
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("failed to decode the change %d of the store journal: %s", n+1, err.Error())
+		}
+		size += int64(len(line))
+		if rec.Deleted {
+			delete(s.entries, rec.Key)
+		} else {
+			e := rec.entry
+			s.entries[rec.Key] = &e
+		}
+		s.dirty = true
+	}
+}
+
+// append appends the change of the key to the journal, e is nil for a deletion. The caller must hold the lock
+func (s *Store) append(key string, e *entry) {
+	if s.journal == nil {
+		return
+	}
+	rec := record{Key: key, Deleted: e == nil}
+	if e != nil {
+		rec.entry = *e
+	}
+	b, err := json.Marshal(rec)
+	if err == nil {
+		_, err = s.journal.Write(append(b, '\n'))
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to append the change to the store journal")
+	}
+}
+
+// Get returns the value of the key, false if the key does not exist or is expired
+func (s *Store) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Set sets the value of the key, expiring after the ttl if not 0
+func (s *Store) Set(key string, value interface{}, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &entry{Value: value}
+	if ttl > 0 {
+		e.Expires = time.Now().Add(ttl).UnixNano()
+	}
+	s.entries[key] = e
+	s.dirty = true
+	s.append(key, e)
+}
+
+// Incr adds the delta to the number of the key and returns the sum. The key is set to the delta if it does not exist,
+// expiring after the ttl if not 0, the expiry of an existing key is kept
+func (s *Store) Incr(key string, delta float64, ttl time.Duration) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		e = &entry{Value: float64(0)}
+		if ttl > 0 {
+			e.Expires = time.Now().Add(ttl).UnixNano()
+		}
+		s.entries[key] = e
+	}
+	n, ok := e.Value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("value of %s is not a number", key)
+	}
+	if math.IsNaN(n+delta) || math.IsInf(n+delta, 0) {
+		return 0, fmt.Errorf("invalid sum %v of %s", n+delta, key)
+	}
+	e.Value = n + delta
+	s.dirty = true
+	s.append(key, e)
+	return n + delta, nil
+}
+
+// Delete deletes the key
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.dirty = true
+		s.append(key, nil)
+	}
+}
+
+// TTL returns the remaining time to live of the key, 0 if the key never expires. false if the key does not exist
+func (s *Store) TTL(key string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return 0, false
+	}
+	if e.Expires == 0 {
+		return 0, true
+	}
+	return time.Until(time.Unix(0, e.Expires)), true
+}
+
+// Expire sets the time to live of the key, the key never expires if the ttl is 0. false if the key does not exist
+func (s *Store) Expire(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(key)
+	if e == nil {
+		return false
+	}
+	e.Expires = 0
+	if ttl > 0 {
+		e.Expires = time.Now().Add(ttl).UnixNano()
+	}
+	s.dirty = true
+	s.append(key, e)
+	return true
+}
+
+// Snapshot removes the expired keys, writes the entries to the file if they changed since the last snapshot
+// and truncates the journal. The file is replaced atomically, the store is not written if it is memory only
+func (s *Store) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	if s.file == "" || !s.dirty {
+		return nil
+	}
+	b, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode the store: %s", err.Error())
+	}
+	if err := write(s.file, b); err != nil {
+		return fmt.Errorf("failed to write the store %s: %s", s.file, err.Error())
+	}
+	s.dirty = false
+	// the changes are in the snapshot, the journal is written from the start again
+	if s.journal != nil {
+		if err := s.journal.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate the store journal: %s", err.Error())
+		}
+	}
+	s.logger.Debug().Str("file", s.file).Int("bytes", len(b)).Msg("store snapshot written")
+	return nil
+}
+
+// get returns the entry of the key, nil if it does not exist or is expired. The caller must hold the lock
+func (s *Store) get(key string) *entry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.Expires != 0 && e.Expires <= time.Now().UnixNano() {
+		delete(s.entries, key)
+		s.dirty = true
+		return nil
+	}
+	return e
+}
+
+// expire removes the keys expired at the time. The caller must hold the lock
+func (s *Store) expire(now time.Time) {
+	for k, e := range s.entries {
+		if e.Expires != 0 && e.Expires <= now.UnixNano() {
+			delete(s.entries, k)
+			s.dirty = true
+		}
+	}
+}
+
+// write writes the content to a temporary file renamed to the file
+func write(file string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		// change changes the store before it is reopened
+		change func(t *testing.T, s *Store)
+		// snapshot writes a snapshot after the change, the journal is replayed otherwise
+		snapshot bool
+		want     map[string]interface{}
+	}{
+		{
+			name:   "set",
+			change: func(t *testing.T, s *Store) { s.Set("a", "b", 0) },
+			want:   map[string]interface{}{"a": "b"},
+		},
+		{
+			name: "set snapshotted",
+			change: func(t *testing.T, s *Store) {
+				s.Set("a", map[string]interface{}{"user": "u", "pages": []interface{}{"/", "/a"}}, 0)
+			},
+			snapshot: true,
+			want:     map[string]interface{}{"a": map[string]interface{}{"user": "u", "pages": []interface{}{"/", "/a"}}},
+		},
+		{
+			name: "incr",
+			change: func(t *testing.T, s *Store) {
+				for i := 0; i < 3; i++ {
+					if _, err := s.Incr("n", 1.5, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			want: map[string]interface{}{"n": 4.5},
+		},
+		{
+			name: "delete",
+			change: func(t *testing.T, s *Store) {
+				s.Set("a", 1.0, 0)
+				s.Set("b", 2.0, 0)
+				s.Delete("a")
+			},
+			want: map[string]interface{}{"b": 2.0},
+		},
+		{
+			name: "delete after snapshot",
+			change: func(t *testing.T, s *Store) {
+				s.Set("a", 1.0, 0)
+				if err := s.Snapshot(); err != nil {
+					t.Fatal(err)
+				}
+				s.Delete("a")
+			},
+			want: map[string]interface{}{},
+		},
+		{
+			name: "expired",
+			change: func(t *testing.T, s *Store) {
+				s.Set("a", 1.0, time.Nanosecond)
+				s.Set("b", 2.0, time.Hour)
+				time.Sleep(time.Millisecond)
+			},
+			want: map[string]interface{}{"b": 2.0},
+		},
+		{
+			name: "expire",
+			change: func(t *testing.T, s *Store) {
+				s.Set("a", 1.0, time.Hour)
+				s.Expire("a", time.Nanosecond)
+				time.Sleep(time.Millisecond)
+			},
+			snapshot: true,
+			want:     map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "a", "script.json")
+
+			s, err := Open(file, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, s)
+			if tt.snapshot {
+				if err := s.Snapshot(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the store is reopened without the last snapshot of the shutdown, like after a crash
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = Open(file, zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			got := make(map[string]interface{})
+			for k := range s.entries {
+				if v, ok := s.Get(k); ok {
+					got[k] = v
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStoreSnapshotTruncatesJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "script.json")
+
+	s, err := Open(file, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("a", 1.0, 0)
+	if info, err := os.Stat(file + ".log"); err != nil || info.Size() == 0 {
+		t.Fatalf("expected the change in the journal, got %v %v", info, err)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file + ".log"); err != nil || info.Size() != 0 {
+		t.Fatalf("expected an empty journal after the snapshot, got %v %v", info, err)
+	}
+	s.Set("b", 2.0, 0)
+	if info, err := os.Stat(file + ".log"); err != nil || info.Size() == 0 {
+		t.Fatalf("expected the change in the journal after the snapshot, got %v %v", info, err)
+	}
+}
+
+func TestStorePartialJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "script.json")
+	journal := `{"key":"a","value":1}` + "\n" + `{"key":"b","val`
+	if err := ioutil.WriteFile(file+".log", []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(file, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, ok := s.Get("a"); !ok || v != 1.0 {
+		t.Fatalf("expected a = 1, got %v %v", v, ok)
+	}
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("expected the partial change to be ignored")
+	}
+	s.Set("c", 3.0, 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(file, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, ok := s.Get("c"); !ok || v != 3.0 {
+		t.Fatalf("expected c = 3 appended after the partial change, got %v %v", v, ok)
+	}
+}
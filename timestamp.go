@@ -0,0 +1,130 @@
+package logtrics
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// TimeAccept keeps the event time of late or future events as it is
+	TimeAccept = "accept"
+
+	// TimeDrop drops the late or future events
+	TimeDrop = "drop"
+
+	// TimeClamp replaces the event time of late or future events with the received time
+	TimeClamp = "clamp"
+)
+
+type (
+	// Timestamp represents the event time extraction configured in the logtrics table
+	//
+	//	timestamp = { field = "time", layout = "rfc3339", max_delay = "1h", late = "drop", max_ahead = "1m", future = "clamp" }
+	Timestamp struct {
+		Field  string
+		Layout string
+		// MaxDelay is the duration after which an event is considered late. 0 means no limit
+		MaxDelay time.Duration
+		// MaxAhead is the duration before which an event is considered future dated. 0 means no limit
+		MaxAhead time.Duration
+		Late     string
+		Future   string
+	}
+)
+
+// NewTimestamp returns a new Timestamp instance from the timestamp table
+func NewTimestamp(table *lua.LTable) (*Timestamp, error) {
+	t := &Timestamp{Late: TimeAccept, Future: TimeAccept}
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k.String() {
+		case "field":
+			t.Field = v.String()
+		case "layout":
+			t.Layout = v.String()
+		case "max_delay":
+			t.MaxDelay, err = luaDuration(v)
+		case "max_ahead":
+			t.MaxAhead, err = luaDuration(v)
+		case "late":
+			t.Late, err = timePolicy(v)
+		case "future":
+			t.Future, err = timePolicy(v)
+		default:
+			err = fmt.Errorf("invalid key %s", k.String())
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "invalid timestamp [%s]", k.String())
+		}
+	})
+	if err == nil && t.Field == "" {
+		err = fmt.Errorf("timestamp field not found")
+	}
+	return t, err
+}
+
+// Resolve returns the event time from the fields.
+// The received time is returned when the field is not present.
+// false is returned when the event has to be dropped as per the late or future policy
+func (t *Timestamp) Resolve(fields map[string]string, received time.Time) (time.Time, bool, error) {
+	v, ok := fields[t.Field]
+	if !ok || v == "" {
+		return received, true, nil
+	}
+	ts, err := parseTimestamp(t.Layout, v)
+	if err != nil {
+		return received, false, errors.Wrapf(err, "timestamp field [%s]", t.Field)
+	}
+	switch {
+	case t.MaxDelay > 0 && received.Sub(ts) > t.MaxDelay:
+		return apply(t.Late, ts, received)
+	case t.MaxAhead > 0 && ts.Sub(received) > t.MaxAhead:
+		return apply(t.Future, ts, received)
+	}
+	return ts, true, nil
+}
+
+func apply(policy string, ts, received time.Time) (time.Time, bool, error) {
+	switch policy {
+	case TimeDrop:
+		return ts, false, nil
+	case TimeClamp:
+		return received, true, nil
+	default:
+		return ts, true, nil
+	}
+}
+
+func timePolicy(v lua.LValue) (string, error) {
+	switch p := v.String(); p {
+	case TimeAccept, TimeDrop, TimeClamp:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid policy [%s]. Choices are %q, %q, %q", p, TimeAccept, TimeDrop, TimeClamp)
+	}
+}
+
+// luaDuration converts the lua value to duration
+// numbers are considered as seconds, strings are parsed as go durations (e.g. "1m30s")
+func luaDuration(v lua.LValue) (time.Duration, error) {
+	if n, ok := v.(lua.LNumber); ok {
+		return time.Duration(float64(n) * float64(time.Second)), nil
+	}
+	// numeric strings are seconds too
+	if f, err := strconv.ParseFloat(v.String(), 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v.String())
+}
+
+// unixSeconds returns the time as fractional unix seconds
+func unixSeconds(t time.Time) lua.LNumber {
+	return lua.LNumber(float64(t.UnixNano()) / float64(time.Second))
+}